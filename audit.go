@@ -0,0 +1,488 @@
+// audit.go
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Режимы обезличивания журнала
+const (
+	redactNone = "none" // текст сохраняется как есть
+	redactPII  = "pii"  // скрываются почта, username, телефоны, номера карт и ключи
+	redactFull = "full" // вместо текста сохраняются длина и хеш
+)
+
+// Шаблоны личных данных для режима pii
+var redactPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`), "[email]"},
+	{regexp.MustCompile(`@[A-Za-z][A-Za-z0-9_]{4,31}\b`), "[username]"},
+	{regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}`), "[key]"},
+	{regexp.MustCompile(`\b\d{4}[ -]?\d{4}[ -]?\d{4}[ -]?\d{4}\b`), "[card]"},
+	{regexp.MustCompile(`\+?\d[\d ()-]{8,}\d`), "[phone]"},
+}
+
+// Сообщение диалога в журнале; изображения не сохраняются, только их число
+type auditMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	Images  int    `json:"images,omitempty"`
+}
+
+// Запись журнала об одном запросе к модели
+type auditEntry struct {
+	Time         time.Time      `json:"time"`
+	ChatID       int64          `json:"chat_id"`
+	UserID       int64          `json:"user_id"`
+	Provider     string         `json:"provider"`
+	Model        string         `json:"model"`
+	Route        string         `json:"route,omitempty"`
+	Prompt       []auditMessage `json:"prompt"`
+	Response     string         `json:"response,omitempty"`
+	ToolCalls    []llmToolCall  `json:"tool_calls,omitempty"`
+	FinishReason string         `json:"finish_reason,omitempty"`
+	Usage        llmUsage       `json:"usage"`
+	CostUSD      float64        `json:"cost_usd"`
+	LatencyMS    int64          `json:"latency_ms"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// Журнал запросов в формате JSON Lines с ротацией по размеру.
+// Заполненный файл переименовывается в <path>.1, старые сдвигаются до <path>.<maxFiles>.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	redact   string
+	file     *os.File
+	size     int64
+}
+
+// Журнал запросов; nil — журнал не ведется
+var auditLogger *auditLog
+
+// Открывает журнал согласно настройкам [audit]. Пустой путь отключает журнал.
+func openAuditLog(cfg *Config) (*auditLog, error) {
+	if cfg.Audit.Path == "" {
+		return nil, nil
+	}
+	switch cfg.Audit.Redact {
+	case redactNone, redactPII, redactFull:
+	default:
+		return nil, fmt.Errorf("неизвестный режим обезличивания %q", cfg.Audit.Redact)
+	}
+
+	l := &auditLog{
+		path:     cfg.Audit.Path,
+		maxSize:  int64(cfg.Audit.MaxSizeMB) << 20,
+		maxFiles: cfg.Audit.MaxFiles,
+		redact:   cfg.Audit.Redact,
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := l.openLocked(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) openLocked() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Дописывает запись в журнал
+func (l *auditLog) write(entry auditEntry) {
+	for i := range entry.Prompt {
+		entry.Prompt[i].Content = l.redactText(entry.Prompt[i].Content)
+	}
+	entry.Response = l.redactText(entry.Response)
+	entry.Error = l.redactText(entry.Error)
+	// Аргументы инструментов содержат имена и username участников;
+	// копия нужна, чтобы не изменить вызовы в самом ответе модели
+	toolCalls := make([]llmToolCall, len(entry.ToolCalls))
+	for i, call := range entry.ToolCalls {
+		call.Arguments = l.redactText(call.Arguments)
+		toolCalls[i] = call
+	}
+	entry.ToolCalls = toolCalls
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Ошибка при записи журнала запросов: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotateLocked(); err != nil {
+			log.Printf("Ошибка при ротации журнала запросов: %v", err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Ошибка при записи журнала запросов: %v", err)
+	}
+}
+
+// Сдвигает файлы журнала и начинает новый
+func (l *auditLog) rotateLocked() error {
+	l.file.Close()
+	l.file = nil
+	if l.maxFiles > 0 {
+		os.Remove(l.rotatedPath(l.maxFiles))
+		for i := l.maxFiles - 1; i >= 1; i-- {
+			os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+		}
+		if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.openLocked()
+}
+
+func (l *auditLog) rotatedPath(n int) string {
+	return l.path + "." + strconv.Itoa(n)
+}
+
+// Обезличивает текст согласно режиму журнала
+func (l *auditLog) redactText(text string) string {
+	switch l.redact {
+	case redactPII:
+		for _, rule := range redactPatterns {
+			text = rule.pattern.ReplaceAllString(text, rule.replacement)
+		}
+	case redactFull:
+		if text == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(text))
+		return fmt.Sprintf("[%d символов, sha256:%s]", len([]rune(text)), hex.EncodeToString(sum[:8]))
+	}
+	return text
+}
+
+// Предельный размер одной части выгрузки: Telegram принимает от ботов файлы до 50 МБ
+const auditExportPartBytes = 45 << 20
+
+// Часть выгрузки журнала во временном файле
+type auditExportPart struct {
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+}
+
+// Файл журнала, открытый для выгрузки, и его размер на момент открытия
+type auditSource struct {
+	file *os.File
+	size int64
+}
+
+// Открывает все файлы журнала от старых к новым. Блокировка держится только
+// на время открытия: дальше файлы читаются без нее, и открытые дескрипторы
+// остаются действительными, даже если ротация переименует или удалит файлы.
+// Чтение ограничено размером на момент открытия, чтобы не захватить
+// недописанную строку.
+func (l *auditLog) openSources() ([]auditSource, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths := []string{l.path}
+	for i := 1; i <= l.maxFiles; i++ {
+		paths = append([]string{l.rotatedPath(i)}, paths...)
+	}
+	var sources []auditSource
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			var info os.FileInfo
+			if info, err = file.Stat(); err == nil {
+				sources = append(sources, auditSource{file: file, size: info.Size()})
+				continue
+			}
+			file.Close()
+		}
+		closeAuditSources(sources)
+		return nil, err
+	}
+	return sources, nil
+}
+
+func closeAuditSources(sources []auditSource) {
+	for _, source := range sources {
+		source.file.Close()
+	}
+}
+
+// Собирает записи чата из всех файлов журнала, от старых к новым, во временные
+// файлы не больше auditExportPartBytes. Записи читаются и пишутся построчно,
+// без загрузки журнала в память и без блокировки журнала, поэтому запись
+// запросов во время выгрузки не ждет. Вызывающий удаляет файлы после отправки.
+func (l *auditLog) export(chatID int64) (paths []string, err error) {
+	sources, err := l.openSources()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuditSources(sources)
+
+	var part *auditExportPart
+	closePart := func() error {
+		if part == nil {
+			return nil
+		}
+		flushErr := part.writer.Flush()
+		closeErr := part.file.Close()
+		part = nil
+		return errors.Join(flushErr, closeErr)
+	}
+	defer func() {
+		if closeErr := closePart(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			removeFiles(paths)
+			paths = nil
+		}
+	}()
+
+	for _, source := range sources {
+		scanner := bufio.NewScanner(io.LimitReader(source.file, source.size))
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var entry struct {
+				ChatID int64 `json:"chat_id"`
+			}
+			line := scanner.Bytes()
+			if json.Unmarshal(line, &entry) != nil || entry.ChatID != chatID {
+				continue
+			}
+			if part == nil || part.size+int64(len(line))+1 > auditExportPartBytes {
+				if err := closePart(); err != nil {
+					return paths, err
+				}
+				tmp, err := os.CreateTemp("", "gpt_log_*.jsonl")
+				if err != nil {
+					return paths, err
+				}
+				paths = append(paths, tmp.Name())
+				part = &auditExportPart{file: tmp, writer: bufio.NewWriter(tmp)}
+			}
+			part.writer.Write(line)
+			part.writer.WriteByte('\n')
+			part.size += int64(len(line)) + 1
+		}
+		if err := scanner.Err(); err != nil {
+			return paths, err
+		}
+	}
+	return paths, nil
+}
+
+// Удаляет временные файлы
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// Записывает запрос к модели в журнал, если он ведется
+func auditGPTRequest(started time.Time, userID, chatID int64, req llmRequest, resp llmResponse, cost float64, route string, err error) {
+	if auditLogger == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:         started,
+		ChatID:       chatID,
+		UserID:       userID,
+		Provider:     llm.Name(),
+		Model:        req.Model,
+		Route:        route,
+		Response:     resp.Content,
+		ToolCalls:    resp.ToolCalls,
+		FinishReason: resp.FinishReason,
+		Usage:        resp.Usage,
+		CostUSD:      cost,
+		LatencyMS:    time.Since(started).Milliseconds(),
+	}
+	if resp.Model != "" {
+		entry.Model = resp.Model
+	}
+	for _, message := range req.Messages {
+		entry.Prompt = append(entry.Prompt, auditMessage{Role: message.Role, Content: message.Content, Images: len(message.Images)})
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	auditLogger.write(entry)
+}
+
+// Записывает запрос картинки в журнал, если он ведется.
+// Сама картинка не сохраняется, только уточненный моделью промпт.
+func auditImageRequest(started time.Time, userID, chatID int64, prompt string, result imageResult, cost float64, err error) {
+	if auditLogger == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:      started,
+		ChatID:    chatID,
+		UserID:    userID,
+		Provider:  llm.Name(),
+		Model:     config.Images.Model,
+		Route:     "draw",
+		Prompt:    []auditMessage{{Role: roleUser, Content: prompt}},
+		Response:  result.RevisedPrompt,
+		CostUSD:   cost,
+		LatencyMS: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	auditLogger.write(entry)
+}
+
+// Идет ли выгрузка журнала: одновременно выполняется только одна
+var auditExportRunning atomic.Bool
+
+// Обработка команды /gptlog: выгрузка журнала запросов чата файлами.
+// В журнале вопросы всех участников, поэтому файлы приходят запросившему
+// в личные сообщения. Владелец бота может указать ID другого чата.
+// Чтение журнала и отправка файлов идут в отдельной горутине, чтобы
+// не задерживать обработку остальных обновлений.
+func handleAuditExportCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	if auditLogger == nil {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Журнал запросов не ведется."))
+		return
+	}
+
+	exportID := chatID
+	if len(ctx.Args) > 0 {
+		if ctx.Message.From.ID != config.Bot.OwnerID || config.Bot.OwnerID == 0 {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Журнал другого чата может выгрузить только владелец бота."))
+			return
+		}
+		parsed, err := strconv.ParseInt(ctx.Args[0], 10, 64)
+		if err != nil {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Укажите числовой ID чата."))
+			return
+		}
+		exportID = parsed
+	} else if !isChatAdmin(ctx.Bot, ctx.Message.Chat, ctx.Message.From.ID) {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Журнал могут выгружать только администраторы чата."))
+		return
+	}
+
+	if !auditExportRunning.CompareAndSwap(false, true) {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Журнал уже выгружается. Попробуйте чуть позже."))
+		return
+	}
+	go func() {
+		defer auditExportRunning.Store(false)
+		exportAuditLog(ctx.Bot, ctx.Message, exportID)
+	}()
+}
+
+// Выгружает журнал чата exportID и отправляет его автору сообщения
+func exportAuditLog(bot *tgbotapi.BotAPI, message *tgbotapi.Message, exportID int64) {
+	chatID := message.Chat.ID
+	paths, err := auditLogger.export(exportID)
+	if err != nil {
+		log.Printf("Ошибка при выгрузке журнала чата %d: %v", exportID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Не удалось прочитать журнал."))
+		return
+	}
+	defer removeFiles(paths)
+	if len(paths) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "В журнале нет запросов этого чата."))
+		return
+	}
+
+	requesterID := message.From.ID
+	for i, path := range paths {
+		if err := sendAuditExportPart(bot, requesterID, exportID, path, i+1, len(paths)); err != nil {
+			log.Printf("Ошибка при отправке журнала чата %d: %v", exportID, err)
+			if i == 0 && !message.Chat.IsPrivate() {
+				bot.Send(tgbotapi.NewMessage(chatID, "Не удалось отправить журнал в личные сообщения. Напишите боту /start в личке и повторите команду."))
+			} else {
+				bot.Send(tgbotapi.NewMessage(requesterID, "Не удалось отправить файл журнала."))
+			}
+			return
+		}
+	}
+	if !message.Chat.IsPrivate() {
+		bot.Send(tgbotapi.NewMessage(chatID, "Журнал запросов отправлен вам в личные сообщения."))
+	}
+}
+
+// Отправляет одну часть выгрузки, читая ее с диска
+func sendAuditExportPart(bot *tgbotapi.BotAPI, userID, exportID int64, path string, part, parts int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("gpt_log_%d.jsonl", exportID)
+	caption := fmt.Sprintf("Журнал запросов к модели, чат %d", exportID)
+	if parts > 1 {
+		name = fmt.Sprintf("gpt_log_%d_part%d.jsonl", exportID, part)
+		caption += fmt.Sprintf(", часть %d из %d", part, parts)
+	}
+	document := tgbotapi.NewDocument(userID, tgbotapi.FileReader{Name: name, Reader: file})
+	document.Caption = caption
+	_, err = bot.Send(document)
+	return err
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "gptlog",
+		Usage:       "[ID чата]",
+		Description: "Выгрузить журнал запросов к модели (только для администраторов)",
+		Feature:     "gpt",
+		Handler:     handleAuditExportCommand,
+	})
+}
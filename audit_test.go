@@ -0,0 +1,97 @@
+// audit_test.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Журнал во временном каталоге с ротацией после каждой пары записей
+func openTestAuditLog(t *testing.T) *auditLog {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Audit.Path = filepath.Join(t.TempDir(), "gpt.jsonl")
+	cfg.Audit.MaxFiles = 10
+	cfg.Audit.Redact = redactNone
+	l, err := openAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.maxSize = 400
+	t.Cleanup(func() { l.file.Close() })
+	return l
+}
+
+// Читает выгрузку и возвращает ответы записей по порядку
+func readAuditExport(t *testing.T, paths []string) []string {
+	t.Helper()
+	var responses []string
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, entry.Response)
+		}
+		file.Close()
+	}
+	return responses
+}
+
+func TestAuditExportAcrossRotation(t *testing.T) {
+	l := openTestAuditLog(t)
+	for i, response := range []string{"a", "x", "b", "y", "c"} {
+		chatID := int64(1)
+		if i%2 == 1 {
+			chatID = 2
+		}
+		l.write(auditEntry{ChatID: chatID, Response: response})
+	}
+	if _, err := os.Stat(l.rotatedPath(1)); err != nil {
+		t.Fatalf("журнал не ротировался: %v", err)
+	}
+
+	paths, err := l.export(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeFiles(paths)
+	got := readAuditExport(t, paths)
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("выгружено %v вместо [a b c]", got)
+	}
+}
+
+func TestAuditOpenSourcesReleasesLock(t *testing.T) {
+	l := openTestAuditLog(t)
+	l.write(auditEntry{ChatID: 1, Response: "до"})
+
+	sources, err := l.openSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAuditSources(sources)
+	// Запись и ротация во время чтения не ждут выгрузку и не портят ее
+	for i := 0; i < 5; i++ {
+		l.write(auditEntry{ChatID: 1, Response: "после"})
+	}
+	if len(sources) != 1 || sources[0].size == 0 {
+		t.Fatalf("открыто %d файлов", len(sources))
+	}
+	buf := make([]byte, sources[0].size+1)
+	n, _ := sources[0].file.Read(buf)
+	var entry auditEntry
+	if err := json.Unmarshal(buf[:sources[0].size], &entry); err != nil || entry.Response != "до" || int64(n) < sources[0].size {
+		t.Errorf("снимок журнала прочитан неверно: %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,183 @@
+// budget.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Месячный бюджет израсходован: запросы к модели остановлены
+var errBudgetExhausted = errors.New("месячный бюджет на модель израсходован")
+
+// Уведомления владельцу бота о расходах
+var budgetAlerts = make(chan string, 16)
+
+// Модели без цены, о которых уже предупредили в логе
+var unpricedModels sync.Map
+
+// Ищет цену модели: сначала точное совпадение, затем самый длинный префикс,
+// потому что API возвращает имена с датой версии, например gpt-4o-2024-08-06
+func modelPrice(model string) ([]float64, bool) {
+	if price, ok := config.Pricing[model]; ok && len(price) == 2 {
+		return price, true
+	}
+	best := ""
+	for name, price := range config.Pricing {
+		if len(price) == 2 && strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return nil, false
+	}
+	return config.Pricing[best], true
+}
+
+// Стоимость запроса в долларах
+func requestCost(model string, usage llmUsage) float64 {
+	price, ok := modelPrice(model)
+	if !ok {
+		if _, warned := unpricedModels.LoadOrStore(model, true); !warned {
+			log.Printf("Нет цены для модели %q, расходы на нее не учитываются. Добавьте ее в [pricing]", model)
+		}
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price[0] + float64(usage.CompletionTokens)*price[1]) / 1e6
+}
+
+// Расходы бота за сегодня и за текущий месяц
+func spentUSD() (day, month float64) {
+	dayPeriod, monthPeriod := usagePeriods(time.Now())
+	var record usageRecord
+	if db.get(usageBucket, usageKey("global", 0, dayPeriod), &record) {
+		day = record.CostUSD
+	}
+	record = usageRecord{}
+	if db.get(usageBucket, usageKey("global", 0, monthPeriod), &record) {
+		month = record.CostUSD
+	}
+	return day, month
+}
+
+// Стоимость запросов, которые еще выполняются. Защищена usageMutex.
+var budgetReserved float64
+
+// Достигнут ли месячный предел расходов с учетом выполняющихся запросов
+func budgetExhausted() bool {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	return budgetLeftLocked() == 0
+}
+
+// Остаток месячного бюджета за вычетом резерва; -1, если предела нет.
+// Вызывается под usageMutex.
+func budgetLeftLocked() float64 {
+	limit := config.Budget.MonthlyCap
+	if limit <= 0 {
+		return -1
+	}
+	_, month := spentUSD()
+	return max(limit-month-budgetReserved, 0)
+}
+
+// Резервирует стоимость запроса в месячном бюджете до его завершения,
+// чтобы параллельные запросы не могли вместе выйти за предел.
+// Возвращает false, если остатка бюджета не хватает.
+func reserveBudget(cost float64) bool {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	if left := budgetLeftLocked(); left == 0 || left > 0 && cost > left {
+		return false
+	}
+	budgetReserved += cost
+	return true
+}
+
+// Снимает резерв бюджета
+func releaseBudget(cost float64) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	releaseBudgetLocked(cost)
+}
+
+func releaseBudgetLocked(cost float64) {
+	// Сравнение с допуском: сумма и разность float64 не всегда дают ровно ноль
+	if budgetReserved -= cost; budgetReserved < 1e-9 {
+		budgetReserved = 0
+	}
+}
+
+// Проверяет пороги расходов и ставит в очередь уведомления владельцу.
+// Каждый порог срабатывает один раз за период: отметка хранится рядом
+// со счетчиками и удаляется вместе с ними.
+func checkBudgetAlerts(day, month float64) {
+	now := time.Now()
+	dayPeriod, monthPeriod := usagePeriods(now)
+
+	var alerts []string
+	crossed := func(thresholds []float64, spent float64, period, label string) {
+		for _, threshold := range thresholds {
+			if threshold <= 0 || spent < threshold {
+				continue
+			}
+			key := "alert:" + strconv.FormatFloat(threshold, 'f', -1, 64) + ":" + period
+			var sent bool
+			if db.get(usageBucket, key, &sent) {
+				continue
+			}
+			db.put(usageBucket, key, true)
+			alerts = append(alerts, fmt.Sprintf("Расходы на модель %s превысили $%.2f: сейчас $%.2f.", label, threshold, spent))
+		}
+	}
+	crossed(config.Budget.DailyAlerts, day, dayPeriod, "за сегодня")
+	crossed(config.Budget.MonthlyAlerts, month, monthPeriod, "за месяц")
+
+	if limit := config.Budget.MonthlyCap; limit > 0 && month >= limit {
+		key := "alert:cap:" + monthPeriod
+		var sent bool
+		if !db.get(usageBucket, key, &sent) {
+			db.put(usageBucket, key, true)
+			alerts = append(alerts, fmt.Sprintf("Месячный бюджет $%.2f израсходован ($%.2f). Запросы к модели остановлены до начала следующего месяца.", limit, month))
+		}
+	}
+
+	for _, alert := range alerts {
+		select {
+		case budgetAlerts <- alert:
+		default:
+			log.Printf("Очередь уведомлений переполнена: %s", alert)
+		}
+	}
+}
+
+// Отправляет уведомления о расходах владельцу бота в личные сообщения
+func sendBudgetAlerts(bot *tgbotapi.BotAPI) {
+	for alert := range budgetAlerts {
+		log.Print(alert)
+		if config.Bot.OwnerID == 0 {
+			continue
+		}
+		if _, err := bot.Send(tgbotapi.NewMessage(config.Bot.OwnerID, alert)); err != nil {
+			log.Printf("Не удалось отправить уведомление владельцу: %v", err)
+		}
+	}
+}
+
+// Строка о месячном бюджете для /usage
+func budgetSummary() string {
+	day, month := spentUSD()
+	summary := fmt.Sprintf("Расходы: сегодня $%.4f, за месяц $%.4f", day, month)
+	if limit := config.Budget.MonthlyCap; limit > 0 {
+		summary += fmt.Sprintf(" из $%.2f", limit)
+	}
+	return summary
+}
@@ -0,0 +1,274 @@
+// commands.go
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Контекст вызова команды
+type commandContext struct {
+	Bot     *tgbotapi.BotAPI
+	Message *tgbotapi.Message
+	Command string   // имя команды или сработавшее ключевое слово
+	Args    []string // аргументы команды с учетом кавычек
+	RawArgs string   // текст после команды без разбора
+}
+
+// Описание команды бота
+type botCommand struct {
+	Name        string   // имя команды без "/", латиницей в нижнем регистре
+	Aliases     []string // дополнительные имена команды
+	Keywords    []string // слова, вызывающие команду без "/"
+	Usage       string   // подсказка по аргументам для /help
+	Description string   // описание для /help и setMyCommands
+	Hidden      bool     // не публиковать в меню команд Telegram
+	Feature     string   // функция, которую можно отключить в настройках чата
+	Handler     func(ctx *commandContext)
+}
+
+// Обработчик нажатия на кнопку; args — части callback data после префикса
+type callbackHandler func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string)
+
+// Реестр команд, ключевых слов и обработчиков кнопок
+type commandRegistry struct {
+	commands  []*botCommand
+	byName    map[string]*botCommand
+	callbacks map[string]callbackHandler
+
+	patternsMu sync.Mutex
+	patterns   map[string]*regexp.Regexp
+}
+
+var commands = newCommandRegistry()
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{
+		byName:    make(map[string]*botCommand),
+		callbacks: make(map[string]callbackHandler),
+		patterns:  make(map[string]*regexp.Regexp),
+	}
+}
+
+// Регистрирует команду вместе с ее псевдонимами и ключевыми словами
+func (r *commandRegistry) register(cmd *botCommand) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, exists := r.byName[name]; exists {
+			log.Panicf("Команда /%s зарегистрирована дважды", name)
+		}
+		r.byName[name] = cmd
+	}
+	r.commands = append(r.commands, cmd)
+}
+
+// Регистрирует обработчик кнопок с заданным префиксом callback data
+func (r *commandRegistry) registerCallback(prefix string, handler callbackHandler) {
+	if _, exists := r.callbacks[prefix]; exists {
+		log.Panicf("Обработчик кнопок %s зарегистрирован дважды", prefix)
+	}
+	r.callbacks[prefix] = handler
+}
+
+// Находит и выполняет команду или ключевое слово из сообщения.
+// Возвращает true, если сообщение было обработано.
+func (r *commandRegistry) dispatch(bot *tgbotapi.BotAPI, message *tgbotapi.Message) bool {
+	// Настройки читаются из хранилища один раз на сообщение
+	settings := getChatSettings(message.Chat.ID)
+	if message.IsCommand() {
+		name, target, _ := strings.Cut(message.CommandWithAt(), "@")
+		if target != "" && !strings.EqualFold(target, bot.Self.UserName) {
+			// Команда адресована другому боту
+			return false
+		}
+		cmd, ok := r.byName[strings.ToLower(name)]
+		if !ok || !settings.featureEnabled(cmd.Feature) {
+			return false
+		}
+		cmd.Handler(&commandContext{
+			Bot:     bot,
+			Message: message,
+			Command: cmd.Name,
+			Args:    parseArgs(message.CommandArguments()),
+			RawArgs: strings.TrimSpace(message.CommandArguments()),
+		})
+		return true
+	}
+
+	for _, cmd := range r.commands {
+		if !settings.featureEnabled(cmd.Feature) {
+			continue
+		}
+		for _, keyword := range r.chatKeywords(settings, cmd) {
+			if r.keywordPattern(keyword).MatchString(message.Text) {
+				cmd.Handler(&commandContext{
+					Bot:     bot,
+					Message: message,
+					Command: keyword,
+				})
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ключевые слова команды с учетом настроек чата
+func (r *commandRegistry) chatKeywords(settings chatSettings, cmd *botCommand) []string {
+	if keywords, ok := settings.Triggers[cmd.Name]; ok {
+		return keywords
+	}
+	return cmd.Keywords
+}
+
+// Передает нажатие на кнопку зарегистрированному обработчику
+func (r *commandRegistry) dispatchCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery) bool {
+	if callback.Message == nil {
+		return false
+	}
+	parts := strings.Split(callback.Data, "|")
+	handler, ok := r.callbacks[parts[0]]
+	if !ok {
+		return false
+	}
+	handler(bot, callback, parts[1:])
+	return true
+}
+
+// Разбирает числовые аргументы callback data в переданные указатели
+func parseCallbackArgs(args []string, targets ...interface{}) bool {
+	if len(args) < len(targets) {
+		return false
+	}
+	for i, target := range targets {
+		if _, err := fmt.Sscan(args[i], target); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Формирует текст справки по командам, доступным в чате
+func (r *commandRegistry) helpText(chatID int64) string {
+	settings := getChatSettings(chatID)
+	var help strings.Builder
+	help.WriteString("Команды бота:\n")
+	for _, cmd := range r.commands {
+		if !settings.featureEnabled(cmd.Feature) {
+			continue
+		}
+		line := "/" + cmd.Name
+		if cmd.Usage != "" {
+			line += " " + cmd.Usage
+		}
+		fmt.Fprintf(&help, "\n<b>%s</b> — %s", html.EscapeString(line), html.EscapeString(cmd.Description))
+		if len(cmd.Aliases) > 0 {
+			fmt.Fprintf(&help, "\n  также: /%s", strings.Join(cmd.Aliases, ", /"))
+		}
+		if keywords := r.chatKeywords(settings, cmd); len(keywords) > 0 {
+			fmt.Fprintf(&help, "\n  или просто напишите: %s", html.EscapeString(strings.Join(keywords, ", ")))
+		}
+	}
+	return help.String()
+}
+
+// Публикует список команд в меню Telegram через setMyCommands
+func (r *commandRegistry) publish(bot *tgbotapi.BotAPI) error {
+	var botCommands []tgbotapi.BotCommand
+	for _, cmd := range r.commands {
+		if cmd.Hidden {
+			continue
+		}
+		botCommands = append(botCommands, tgbotapi.BotCommand{
+			Command:     cmd.Name,
+			Description: cmd.Description,
+		})
+	}
+	_, err := bot.Request(tgbotapi.NewSetMyCommands(botCommands...))
+	return err
+}
+
+// Регулярное выражение для поиска ключевого слова целиком, без учета регистра.
+// Граница слова учитывает буквы любых алфавитов, в отличие от \b.
+func (r *commandRegistry) keywordPattern(keyword string) *regexp.Regexp {
+	r.patternsMu.Lock()
+	defer r.patternsMu.Unlock()
+
+	pattern, ok := r.patterns[keyword]
+	if !ok {
+		pattern = regexp.MustCompile(`(?i)(^|[^\p{L}\p{N}_])` + regexp.QuoteMeta(keyword) + `($|[^\p{L}\p{N}_])`)
+		r.patterns[keyword] = pattern
+	}
+	return pattern
+}
+
+// Разбивает строку аргументов на части, учитывая кавычки "…" и «…».
+// Апостроф кавычкой не считается: он встречается внутри слов, как в don't.
+func parseArgs(input string) []string {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range input {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			current.WriteRune(r)
+		case r == '"':
+			quote = r
+			inArg = true
+		case r == '«':
+			quote = '»'
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// Снимает с текста парные кавычки, если он ими обрамлен
+func trimQuotes(text string) string {
+	text = strings.TrimSpace(text)
+	for _, pair := range [][2]string{{`"`, `"`}, {"'", "'"}, {"«", "»"}, {"“", "”"}} {
+		if len(text) >= len(pair[0])+len(pair[1]) && strings.HasPrefix(text, pair[0]) && strings.HasSuffix(text, pair[1]) {
+			return strings.TrimSpace(text[len(pair[0]) : len(text)-len(pair[1])])
+		}
+	}
+	return text
+}
+
+// Обработка команды /help
+func handleHelpCommand(ctx *commandContext) {
+	msg := newHTMLMessage(ctx.Message.Chat.ID, commands.helpText(ctx.Message.Chat.ID))
+	ctx.Bot.Send(msg)
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "help",
+		Aliases:     []string{"start"},
+		Description: "Список команд",
+		Handler:     handleHelpCommand,
+	})
+}
@@ -0,0 +1,113 @@
+// commands_test.go
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"  один   два\tтри ", []string{"один", "два", "три"}},
+		{`"два слова" и «еще два»`, []string{"два слова", "и", "еще два"}},
+		{"don't stop", []string{"don't", "stop"}},
+		{"O'Neil и д'Артаньян", []string{"O'Neil", "и", "д'Артаньян"}},
+		{`""`, []string{""}},
+		{`"не закрыта`, []string{"не закрыта"}},
+	} {
+		if got := parseArgs(tc.input); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+			t.Errorf("parseArgs(%q) = %q вместо %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestKeywordPattern(t *testing.T) {
+	r := newCommandRegistry()
+	for _, tc := range []struct {
+		keyword, text string
+		match         bool
+	}{
+		{"дуэль", "Дуэль!", true},
+		{"дуэль", "давай дуэль с Васей", true},
+		{"дуэль", "дуэльный пистолет", false},
+		{"дуэль", "передуэль", false},
+		{"roulette", "play roulette_now", false},
+		{"рулетка", "рулетка2", false},
+		{"c++", "пишу на c++ давно", true},
+	} {
+		if got := r.keywordPattern(tc.keyword).MatchString(tc.text); got != tc.match {
+			t.Errorf("ключевое слово %q в %q: %v", tc.keyword, tc.text, got)
+		}
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	r := newCommandRegistry()
+	r.register(&botCommand{Name: "duel", Aliases: []string{"d"}})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("повторное имя команды не отклонено")
+		}
+	}()
+	r.register(&botCommand{Name: "d"})
+}
+
+// Сообщение с командой в начале, как его присылает Telegram
+func commandMessage(chatID int64, text string) *tgbotapi.Message {
+	command, _, _ := strings.Cut(text, " ")
+	return &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: 10},
+		Chat:      &tgbotapi.Chat{ID: chatID},
+		Text:      text,
+		Entities:  []tgbotapi.MessageEntity{{Type: "bot_command", Length: len(command)}},
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	useMockProvider(t)
+	bot := newTestBot(t)
+	r := newCommandRegistry()
+	var called []string
+	handler := func(ctx *commandContext) {
+		called = append(called, ctx.Command+":"+strings.Join(ctx.Args, ","))
+	}
+	r.register(&botCommand{Name: "duel", Keywords: []string{"дуэль"}, Feature: "games", Handler: handler})
+	r.register(&botCommand{Name: "ask", Aliases: []string{"a"}, Feature: "gpt", Handler: handler})
+	r.register(&botCommand{Name: "help", Handler: handler})
+
+	disabled := false
+	if err := saveChatOverrides(2, chatOverrides{GamesEnabled: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		message *tgbotapi.Message
+		handled bool
+	}{
+		{commandMessage(1, `/A@salty_bot "два слова" ещё`), true},
+		{commandMessage(1, "/ask@other_bot вопрос"), false},
+		{commandMessage(1, "/unknown"), false},
+		{commandMessage(2, "/duel"), false},
+		{commandMessage(2, "/help"), true},
+		{&tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, Text: "Вызываю на дуэль!"}, true},
+		{&tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 2}, Text: "Вызываю на дуэль!"}, false},
+		{&tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, Text: "дуэльный пистолет"}, false},
+	} {
+		if got := r.dispatch(bot, tc.message); got != tc.handled {
+			t.Errorf("сообщение %q в чате %d: обработано %v", tc.message.Text, tc.message.Chat.ID, got)
+		}
+	}
+	want := []string{"ask:два слова,ещё", "help:", "дуэль:"}
+	if fmt.Sprint(called) != fmt.Sprint(want) {
+		t.Errorf("вызваны обработчики %q вместо %q", called, want)
+	}
+}
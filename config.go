@@ -0,0 +1,449 @@
+// config.go
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Глобальные настройки бота.
+// Значения по умолчанию задаются в defaultConfig, затем перекрываются
+// файлом конфигурации (TOML) и переменными окружения SALTY_<РАЗДЕЛ>_<КЛЮЧ>.
+type Config struct {
+	Bot struct {
+		Language string `toml:"language"` // язык ответов по умолчанию
+		OwnerID  int64  `toml:"owner_id"` // владелец бота, получает служебные уведомления
+	} `toml:"bot"`
+
+	Storage struct {
+		Path string `toml:"path"` // файл с данными чатов; пусто — хранить только в памяти
+	} `toml:"storage"`
+
+	LLM struct {
+		Provider      string   `toml:"provider"`       // openai, openai_compatible, mock или none; пусто — openai при наличии ключа
+		BaseURL       string   `toml:"base_url"`       // адрес OpenAI-совместимого сервера
+		APIKey        string   `toml:"api_key"`        // по умолчанию берется из OPENAI_API_KEY
+		MockResponses []string `toml:"mock_responses"` // ответы провайдера mock
+
+		Timeout          time.Duration `toml:"timeout"`           // предельное время одной попытки
+		MaxRetries       int           `toml:"max_retries"`       // повторы при лимите частоты, сбоях сервера и сети
+		RetryBaseDelay   time.Duration `toml:"retry_base_delay"`  // задержка перед первым повтором, дальше удваивается
+		RetryMaxDelay    time.Duration `toml:"retry_max_delay"`   // предельная задержка между повторами
+		BreakerThreshold int           `toml:"breaker_threshold"` // сбоев подряд до паузы в запросах; 0 — без паузы
+		BreakerCooldown  time.Duration `toml:"breaker_cooldown"`  // длительность паузы
+	} `toml:"llm"`
+
+	GPT struct {
+		Model           string        `toml:"model"`
+		MaxTokens       int           `toml:"max_tokens"`
+		RequestInterval time.Duration `toml:"request_interval"`  // за сколько пользователь получает новый запрос
+		TokenUsageLimit int           `toml:"token_usage_limit"` // общий дневной лимит токенов бота
+		HistoryWindow   int           `toml:"history_window"`    // сообщений чата в контексте; 0 — только цепочка ответов
+		ContextTokens   int           `toml:"context_tokens"`    // бюджет токенов на историю диалога
+		MaxPromptTokens int           `toml:"max_prompt_tokens"` // предел всего запроса; 0 — без проверки
+		OversizedPrompt string        `toml:"oversized_prompt"`  // reject или truncate для слишком длинного вопроса
+		HistoryTTL      time.Duration `toml:"history_ttl"`       // сколько хранить диалоги
+		Persona         string        `toml:"persona"`           // персона по умолчанию
+		Stream          bool          `toml:"stream"`            // показывать ответ по мере генерации
+		StreamInterval  time.Duration `toml:"stream_interval"`   // минимальная пауза между правками сообщения
+	} `toml:"gpt"`
+
+	// Лимиты токенов; 0 — без ограничения
+	Quotas struct {
+		UserDaily     int `toml:"user_daily"`
+		UserMonthly   int `toml:"user_monthly"`
+		ChatDaily     int `toml:"chat_daily"`
+		ChatMonthly   int `toml:"chat_monthly"`
+		GlobalMonthly int `toml:"global_monthly"`
+	} `toml:"quotas"`
+
+	// Вопросы к фото
+	Vision struct {
+		Enabled       bool   `toml:"enabled"`
+		Model         string `toml:"model"`           // модель, понимающая изображения
+		MaxImageBytes int    `toml:"max_image_bytes"` // крупнее фото не скачиваются
+		Detail        string `toml:"detail"`          // low, high или auto; low дешевле всего
+	} `toml:"vision"`
+
+	// Генерация картинок командой /draw
+	Images struct {
+		Enabled    bool          `toml:"enabled"`
+		Model      string        `toml:"model"`
+		Size       string        `toml:"size"`       // например 1024x1024
+		Quality    string        `toml:"quality"`    // standard или hd
+		Price      float64       `toml:"price"`      // стоимость одной картинки в долларах
+		UserDaily  int           `toml:"user_daily"` // картинок на пользователя в день; 0 — без ограничения
+		Moderation bool          `toml:"moderation"` // проверять запрос модерацией перед генерацией
+		Timeout    time.Duration `toml:"timeout"`
+	} `toml:"images"`
+
+	// Модерация вопросов к модели и ее ответов
+	Moderation struct {
+		Provider string   `toml:"provider"`  // openai, local или none; пусто — модерация провайдера LLM, если она есть
+		Level    string   `toml:"level"`     // строгость по умолчанию: off, low, medium или high
+		Patterns []string `toml:"patterns"`  // регулярные выражения локального фильтра
+		FailOpen bool     `toml:"fail_open"` // пропускать текст, если модерация не ответила; на уровне low пропускается всегда
+	} `toml:"moderation"`
+
+	// Сводки переписки командой /summary; включаются в настройках чата
+	Summary struct {
+		MaxMessages  int           `toml:"max_messages"`  // сколько последних сообщений помнить в каждом чате; 0 — не запоминать
+		MaxAge       time.Duration `toml:"max_age"`       // более старые сообщения забываются
+		DefaultCount int           `toml:"default_count"` // сколько сообщений пересказывать без аргумента
+		ChunkTokens  int           `toml:"chunk_tokens"`  // размер фрагмента длинной истории для одного запроса
+	} `toml:"summary"`
+
+	// Инструменты бота, которые модель вызывает сама: турнирная таблица, история чата и игры
+	Tools struct {
+		Enabled   bool `toml:"enabled"`
+		MaxRounds int  `toml:"max_rounds"` // сколько раз подряд модель может вызывать инструменты до ответа
+	} `toml:"tools"`
+
+	// Расшифровка голосовых сообщений
+	Speech struct {
+		Provider       string        `toml:"provider"`         // openai, whisper_cpp или none; пусто — openai при наличии ключа
+		BaseURL        string        `toml:"base_url"`         // адрес сервера whisper.cpp или OpenAI-совместимого API
+		APIKey         string        `toml:"api_key"`          // по умолчанию [llm] api_key или OPENAI_API_KEY
+		Model          string        `toml:"model"`            // модель распознавания для openai
+		Language       string        `toml:"language"`         // язык записей, например ru; пусто — определяется автоматически
+		MaxDuration    time.Duration `toml:"max_duration"`     // более длинные записи не расшифровываются
+		MaxFileBytes   int           `toml:"max_file_bytes"`   // Telegram отдает ботам файлы до 20 МБ
+		Timeout        time.Duration `toml:"timeout"`          // предельное время расшифровки
+		PricePerMinute float64       `toml:"price_per_minute"` // стоимость минуты записи в долларах для учета расходов
+		Answer         bool          `toml:"answer"`           // отвечать моделью на голосовые, адресованные боту
+	} `toml:"speech"`
+
+	// Выбор модели для запроса; дешевая модель — gpt.model
+	Routing struct {
+		StrongModel      string  `toml:"strong_model"`       // пусто — всегда дешевая модель
+		LongPromptTokens int     `toml:"long_prompt_tokens"` // более длинные запросы получает сильная модель; 0 — не учитывать
+		LowBudgetShare   float64 `toml:"low_budget_share"`   // при остатке бюджета или квоты меньше этой доли — только дешевая
+	} `toml:"routing"`
+
+	// Ограничения частоты: burst действий подряд, затем одно за interval
+	RateLimits struct {
+		GPTUserBurst    int           `toml:"gpt_user_burst"` // interval — gpt.request_interval или пауза чата
+		GPTChatBurst    int           `toml:"gpt_chat_burst"`
+		GPTChatInterval time.Duration `toml:"gpt_chat_interval"`
+		GamesBurst      int           `toml:"games_burst"`
+		GamesInterval   time.Duration `toml:"games_interval"`
+	} `toml:"rate_limits"`
+
+	// Очередь запросов к модели
+	Queue struct {
+		Workers    int           `toml:"workers"`      // одновременных запросов к модели
+		MaxPending int           `toml:"max_pending"`  // ожидающих запросов во всех чатах
+		MaxPerChat int           `toml:"max_per_chat"` // ожидающих запросов в одном чате
+		MaxWait    time.Duration `toml:"max_wait"`     // дольше запрос не ждет и отменяется
+		JobTimeout time.Duration `toml:"job_timeout"`  // предельное время выполнения запроса с повторами
+	} `toml:"queue"`
+
+	// Журнал запросов к модели
+	Audit struct {
+		Path      string `toml:"path"`        // файл JSON Lines; пусто — журнал не ведется
+		MaxSizeMB int    `toml:"max_size_mb"` // размер файла, после которого начинается новый
+		MaxFiles  int    `toml:"max_files"`   // сколько старых файлов хранить
+		Redact    string `toml:"redact"`      // none, pii или full
+	} `toml:"audit"`
+
+	Triggers struct {
+		Duel     []string `toml:"duel"`
+		Roulette []string `toml:"roulette"`
+	} `toml:"triggers"`
+
+	// Бюджет в долларах по ценам из [pricing]
+	Budget struct {
+		MonthlyCap    float64   `toml:"monthly_cap"`    // при достижении запросы к модели прекращаются; 0 — без ограничения
+		DailyAlerts   []float64 `toml:"daily_alerts"`   // пороги дневных расходов для уведомлений владельцу
+		MonthlyAlerts []float64 `toml:"monthly_alerts"` // пороги месячных расходов для уведомлений владельцу
+	} `toml:"budget"`
+
+	// Системные промпты персон: имя = текст
+	Personas map[string]string `toml:"personas"`
+
+	// Цены моделей в долларах за миллион токенов: модель = [запрос, ответ]
+	Pricing map[string][]float64 `toml:"pricing"`
+}
+
+// Текущая конфигурация бота
+var config = defaultConfig()
+
+// Конфигурация со значениями, которые раньше были зашиты в код
+func defaultConfig() *Config {
+	cfg := &Config{}
+	cfg.Bot.Language = "ru"
+	cfg.Storage.Path = "salty_data.json"
+	cfg.LLM.Timeout = 90 * time.Second
+	cfg.LLM.MaxRetries = 3
+	cfg.LLM.RetryBaseDelay = time.Second
+	cfg.LLM.RetryMaxDelay = 20 * time.Second
+	cfg.LLM.BreakerThreshold = 5
+	cfg.LLM.BreakerCooldown = time.Minute
+	cfg.GPT.Model = "gpt-3.5-turbo"
+	cfg.GPT.MaxTokens = 1000
+	cfg.GPT.RequestInterval = time.Minute
+	cfg.GPT.TokenUsageLimit = 100000
+	cfg.Vision.Enabled = true
+	cfg.Vision.Model = "gpt-4o-mini"
+	cfg.Vision.MaxImageBytes = 5 << 20
+	cfg.Vision.Detail = "auto"
+	cfg.Images.Enabled = true
+	cfg.Images.Model = "dall-e-3"
+	cfg.Images.Size = "1024x1024"
+	cfg.Images.Quality = "standard"
+	cfg.Images.Price = 0.04
+	cfg.Images.UserDaily = 5
+	cfg.Images.Moderation = true
+	cfg.Images.Timeout = 2 * time.Minute
+	cfg.Moderation.Level = moderationMedium
+	cfg.Summary.MaxMessages = 500
+	cfg.Summary.MaxAge = 24 * time.Hour
+	cfg.Summary.DefaultCount = 100
+	cfg.Summary.ChunkTokens = 2000
+	cfg.Tools.Enabled = true
+	cfg.Tools.MaxRounds = 3
+	cfg.Speech.Model = "whisper-1"
+	cfg.Speech.MaxDuration = 5 * time.Minute
+	cfg.Speech.MaxFileBytes = 20 << 20
+	cfg.Speech.Timeout = 2 * time.Minute
+	cfg.Speech.PricePerMinute = 0.006
+	cfg.Speech.Answer = true
+	cfg.Routing.StrongModel = "gpt-4o"
+	cfg.Routing.LongPromptTokens = 1500
+	cfg.Routing.LowBudgetShare = 0.2
+	cfg.Quotas.UserDaily = 20000
+	cfg.Audit.Path = "logs/requests.jsonl"
+	cfg.Audit.MaxSizeMB = 10
+	cfg.Audit.MaxFiles = 5
+	cfg.Audit.Redact = redactNone
+	cfg.Budget.DailyAlerts = []float64{5}
+	cfg.Budget.MonthlyAlerts = []float64{20, 50}
+	cfg.Queue.Workers = 4
+	cfg.Queue.MaxPending = 50
+	cfg.Queue.MaxPerChat = 5
+	cfg.Queue.MaxWait = 2 * time.Minute
+	cfg.Queue.JobTimeout = 5 * time.Minute
+	cfg.RateLimits.GPTUserBurst = 3
+	cfg.RateLimits.GPTChatBurst = 10
+	cfg.RateLimits.GPTChatInterval = 10 * time.Second
+	cfg.RateLimits.GamesBurst = 3
+	cfg.RateLimits.GamesInterval = 30 * time.Second
+	cfg.GPT.ContextTokens = 2000
+	cfg.GPT.MaxPromptTokens = 3000
+	cfg.GPT.OversizedPrompt = oversizedReject
+	cfg.GPT.HistoryTTL = 7 * 24 * time.Hour
+	cfg.GPT.Persona = "salty"
+	cfg.GPT.Stream = true
+	cfg.GPT.StreamInterval = 2 * time.Second
+	cfg.Triggers.Duel = []string{"дуэль"}
+	cfg.Triggers.Roulette = []string{"рулетка"}
+	cfg.Personas = map[string]string{
+		"salty": "Ты — salty_ai, язвительный и остроумный участник группового чата. " +
+			"Отвечаешь коротко, с сарказмом и подколками, но по делу и без оскорблений по личным признакам.",
+		"polite": "Ты — вежливый и доброжелательный помощник в групповом чате. " +
+			"Отвечаешь кратко, понятно и по существу.",
+	}
+	cfg.Pricing = map[string][]float64{
+		"gpt-3.5-turbo": {0.5, 1.5},
+		"gpt-4o-mini":   {0.15, 0.6},
+		"gpt-4o":        {2.5, 10},
+		"gpt-4.1-mini":  {0.4, 1.6},
+		"gpt-4.1":       {2, 8},
+	}
+	return cfg
+}
+
+// Загружает конфигурацию из файла и переменных окружения.
+// Отсутствующий файл не считается ошибкой: используются значения по умолчанию.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		if err := decodeConfigFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	envValues := make(map[string]map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		for _, section := range mapSections(cfg) {
+			if key, ok := strings.CutPrefix(name, "SALTY_"+strings.ToUpper(section)+"_"); ok && key != "" {
+				if envValues[section] == nil {
+					envValues[section] = make(map[string]string)
+				}
+				envValues[section][strings.ToLower(key)] = value
+			}
+		}
+	}
+	walkConfig(cfg, func(section, key string, _ reflect.Value) {
+		name := "SALTY_" + strings.ToUpper(section) + "_" + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(name); ok {
+			if envValues[section] == nil {
+				envValues[section] = make(map[string]string)
+			}
+			envValues[section][key] = value
+		}
+	})
+	if err := applyConfigValues(cfg, envValues, func(section, key string) string {
+		return "SALTY_" + strings.ToUpper(section) + "_" + strings.ToUpper(key)
+	}); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Возвращает имена разделов-словарей, например personas
+func mapSections(cfg *Config) []string {
+	var sections []string
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		if root.Field(i).Kind() == reflect.Map {
+			sections = append(sections, root.Type().Field(i).Tag.Get("toml"))
+		}
+	}
+	return sections
+}
+
+// Обходит все поля конфигурации вида [раздел] ключ.
+// Разделы-словари (например, [personas]) обрабатываются в applyConfigValues.
+func walkConfig(cfg *Config, visit func(section, key string, field reflect.Value)) {
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i).Tag.Get("toml")
+		sectionValue := root.Field(i)
+		if sectionValue.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < sectionValue.NumField(); j++ {
+			key := sectionValue.Type().Field(j).Tag.Get("toml")
+			visit(section, key, sectionValue.Field(j))
+		}
+	}
+}
+
+// Перекрывает значения конфигурации содержимым файла TOML.
+// Разделы-словари дополняют значения по умолчанию, неизвестные параметры — ошибка.
+func decodeConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		key := undecoded[0]
+		if len(key) == 1 {
+			return fmt.Errorf("%s: [%s]: неизвестный параметр", path, key[0])
+		}
+		return fmt.Errorf("%s: [%s] %s: неизвестный параметр", path, key[0], strings.Join(key[1:], "."))
+	}
+	return nil
+}
+
+// Записывает значения из переменных окружения в поля конфигурации
+func applyConfigValues(cfg *Config, values map[string]map[string]string, source func(section, key string) string) error {
+	known := make(map[string]bool)
+	var applyErr error
+	walkConfig(cfg, func(section, key string, field reflect.Value) {
+		known[section+"."+key] = true
+		raw, ok := values[section][key]
+		if !ok || applyErr != nil {
+			return
+		}
+		if err := setConfigField(field, raw); err != nil {
+			applyErr = fmt.Errorf("%s: %v", source(section, key), err)
+		}
+	})
+	if applyErr != nil {
+		return applyErr
+	}
+	// Разделы-словари: ключ переменной — имя элемента, например SALTY_PERSONAS_PIRATE
+	root := reflect.ValueOf(cfg).Elem()
+	maps := make(map[string]bool)
+	for i := 0; i < root.NumField(); i++ {
+		mapValue := root.Field(i)
+		if mapValue.Kind() != reflect.Map {
+			continue
+		}
+		section := root.Type().Field(i).Tag.Get("toml")
+		maps[section] = true
+		for key, raw := range values[section] {
+			item := reflect.New(mapValue.Type().Elem()).Elem()
+			if err := setConfigField(item, raw); err != nil {
+				return fmt.Errorf("%s: %v", source(section, key), err)
+			}
+			mapValue.SetMapIndex(reflect.ValueOf(key), item)
+		}
+	}
+	for section, keys := range values {
+		if maps[section] {
+			continue
+		}
+		for key := range keys {
+			if !known[section+"."+key] {
+				return fmt.Errorf("%s: неизвестный параметр", source(section, key))
+			}
+		}
+	}
+	return nil
+}
+
+// Преобразует значение переменной окружения в тип поля.
+// Значение разбирается как значение TOML; строки, длительности и списки
+// можно писать без кавычек и скобок, список — через запятую.
+func setConfigField(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	quoted := strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'")
+	switch field.Interface().(type) {
+	case time.Duration:
+		if !quoted {
+			duration, err := time.ParseDuration(raw)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(duration))
+			return nil
+		}
+	case []string:
+		if !strings.HasPrefix(raw, "[") {
+			items := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+	case []float64:
+		if !strings.HasPrefix(raw, "[") {
+			raw = "[" + raw + "]"
+		}
+	}
+	if field.Kind() == reflect.String && !quoted {
+		field.SetString(raw)
+		return nil
+	}
+
+	holder := reflect.New(reflect.StructOf([]reflect.StructField{{
+		Name: "Value",
+		Type: field.Type(),
+		Tag:  `toml:"value"`,
+	}}))
+	if _, err := toml.Decode("value = "+raw, holder.Interface()); err != nil {
+		return err
+	}
+	field.Set(holder.Elem().Field(0))
+	return nil
+}
@@ -0,0 +1,155 @@
+// config_test.go
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Записывает конфигурацию во временный файл
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	cfg, err := loadConfig("config.example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GPT.Model == "" || len(cfg.Personas) < 2 || len(cfg.Pricing) == 0 {
+		t.Errorf("пример конфигурации прочитан не полностью: %+v", cfg.GPT)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("без файла должны использоваться значения по умолчанию")
+	}
+}
+
+func TestLoadConfigArraysWithCommas(t *testing.T) {
+	path := writeConfigFile(t, `
+[llm]
+mock_responses = ["Да, конечно.", "Нет, # не сейчас"]
+
+[moderation]
+patterns = ["a{1,3}", '\d{2,}']
+
+[budget]
+daily_alerts = [1, 2.5]
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Да, конечно.", "Нет, # не сейчас"}; !reflect.DeepEqual(cfg.LLM.MockResponses, want) {
+		t.Errorf("mock_responses = %q, ожидалось %q", cfg.LLM.MockResponses, want)
+	}
+	if want := []string{"a{1,3}", `\d{2,}`}; !reflect.DeepEqual(cfg.Moderation.Patterns, want) {
+		t.Errorf("patterns = %q, ожидалось %q", cfg.Moderation.Patterns, want)
+	}
+	if want := []float64{1, 2.5}; !reflect.DeepEqual(cfg.Budget.DailyAlerts, want) {
+		t.Errorf("daily_alerts = %v, ожидалось %v", cfg.Budget.DailyAlerts, want)
+	}
+}
+
+func TestLoadConfigValues(t *testing.T) {
+	path := writeConfigFile(t, `
+[gpt]
+model = "gpt-4o-mini"
+max_tokens = 2_000
+request_interval = "30s"
+stream = false
+
+[personas]
+pirate = "Ты — пират."
+
+[pricing]
+"gpt-4o-mini" = [0.2, 0.8]
+`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GPT.Model != "gpt-4o-mini" || cfg.GPT.MaxTokens != 2000 || cfg.GPT.RequestInterval != 30*time.Second || cfg.GPT.Stream {
+		t.Errorf("раздел [gpt] прочитан неверно: %+v", cfg.GPT)
+	}
+	// Разделы-словари дополняют встроенные значения
+	if cfg.Personas["pirate"] != "Ты — пират." || cfg.Personas["salty"] == "" {
+		t.Errorf("personas = %v", cfg.Personas)
+	}
+	if !reflect.DeepEqual(cfg.Pricing["gpt-4o-mini"], []float64{0.2, 0.8}) || len(cfg.Pricing["gpt-4o"]) != 2 {
+		t.Errorf("pricing = %v", cfg.Pricing)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    string
+	}{
+		{"[gpt]\nmodle = \"gpt-4o\"\n", "[gpt] modle: неизвестный параметр"},
+		{"[unknown]\nkey = 1\n", "[unknown]: неизвестный параметр"},
+		{"[gpt]\nmax_tokens = \"много\"\n", "max_tokens"},
+		{"[gpt]\nrequest_interval = \"минута\"\n", "минута"},
+		{"[gpt\nmodel = 1\n", "config.toml"},
+	} {
+		_, err := loadConfig(writeConfigFile(t, tc.content))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("для %q ошибка %v, ожидалось упоминание %q", tc.content, err, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	t.Setenv("SALTY_GPT_MODEL", "gpt-4.1")
+	t.Setenv("SALTY_GPT_REQUEST_INTERVAL", "45s")
+	t.Setenv("SALTY_GPT_STREAM", "false")
+	t.Setenv("SALTY_TRIGGERS_DUEL", "дуэль, вызов")
+	t.Setenv("SALTY_MODERATION_PATTERNS", `["a{1,3}", "b"]`)
+	t.Setenv("SALTY_BUDGET_MONTHLY_ALERTS", "10, 20")
+	t.Setenv("SALTY_PERSONAS_PIRATE", "Ты — пират.")
+	t.Setenv("SALTY_PRICING_GPT-4O", "[3, 12]")
+
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GPT.Model != "gpt-4.1" || cfg.GPT.RequestInterval != 45*time.Second || cfg.GPT.Stream {
+		t.Errorf("раздел [gpt] из окружения прочитан неверно: %+v", cfg.GPT)
+	}
+	if want := []string{"дуэль", "вызов"}; !reflect.DeepEqual(cfg.Triggers.Duel, want) {
+		t.Errorf("triggers.duel = %q, ожидалось %q", cfg.Triggers.Duel, want)
+	}
+	if want := []string{"a{1,3}", "b"}; !reflect.DeepEqual(cfg.Moderation.Patterns, want) {
+		t.Errorf("moderation.patterns = %q, ожидалось %q", cfg.Moderation.Patterns, want)
+	}
+	if want := []float64{10, 20}; !reflect.DeepEqual(cfg.Budget.MonthlyAlerts, want) {
+		t.Errorf("budget.monthly_alerts = %v, ожидалось %v", cfg.Budget.MonthlyAlerts, want)
+	}
+	if cfg.Personas["pirate"] != "Ты — пират." {
+		t.Errorf("personas = %v", cfg.Personas)
+	}
+	if want := []float64{3, 12}; !reflect.DeepEqual(cfg.Pricing["gpt-4o"], want) {
+		t.Errorf("pricing = %v", cfg.Pricing)
+	}
+
+	t.Setenv("SALTY_GPT_MAX_TOKENS", "много")
+	if _, err := loadConfig(""); err == nil || !strings.Contains(err.Error(), "SALTY_GPT_MAX_TOKENS") {
+		t.Errorf("ошибка для SALTY_GPT_MAX_TOKENS: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+// conversation.go
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Разделы хранилища с историей диалогов
+const (
+	conversationBucket     = "conversations"
+	chatHistoryBucket      = "chat_history"
+	conversationDaysBucket = "conversation_days" // ID сообщений диалогов по дням и чатам
+)
+
+// Предел длины процитированного сообщения в запросе, в токенах
+const quotedMessageTokens = 1000
+
+// Вопрос по умолчанию, если бота позвали ответом на сообщение без текста вопроса
+const defaultQuoteQuestion = "Что скажешь об этом сообщении?"
+
+// Защищает списки скользящего окна и индекс дней: ответы в разных чатах
+// и очистка идут параллельно
+var chatHistoryMutex sync.Mutex
+
+// Сообщение диалога с GPT.
+// Parent указывает на предыдущее сообщение цепочки ответов (0 — начало цепочки).
+type conversationNode struct {
+	Role    string    `json:"role"`
+	Content string    `json:"content"`
+	Parent  int       `json:"parent,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func conversationKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
+
+// Ключ индекса дней: дата по UTC и чат
+func conversationDayKey(t time.Time, chatID int64) string {
+	return fmt.Sprintf("%s:%d", t.UTC().Format(time.DateOnly), chatID)
+}
+
+// Разбирает ключ индекса дней
+func parseConversationDayKey(key string) (day time.Time, chatID int64, ok bool) {
+	date, chat, found := strings.Cut(key, ":")
+	if !found {
+		return time.Time{}, 0, false
+	}
+	day, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	chatID, err = strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return day, chatID, true
+}
+
+// Загружает сообщение диалога по его ID в чате
+func loadConversationNode(chatID int64, messageID int) (conversationNode, bool) {
+	var node conversationNode
+	ok := db.get(conversationBucket, conversationKey(chatID, messageID), &node)
+	return node, ok
+}
+
+// Восстанавливает цепочку ответов, заканчивающуюся сообщением messageID,
+// в порядке от старых сообщений к новым
+func loadReplyChain(chatID int64, messageID int) []conversationNode {
+	var chain []conversationNode
+	seen := make(map[int]bool)
+	for messageID != 0 && !seen[messageID] {
+		seen[messageID] = true
+		node, ok := loadConversationNode(chatID, messageID)
+		if !ok {
+			break
+		}
+		chain = append(chain, node)
+		messageID = node.Parent
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// Возвращает последние сообщения диалогов с ботом в чате
+func loadChatWindow(chatID int64, size int) []conversationNode {
+	var messageIDs []int
+	db.get(chatHistoryBucket, strconv.FormatInt(chatID, 10), &messageIDs)
+	if len(messageIDs) > size {
+		messageIDs = messageIDs[len(messageIDs)-size:]
+	}
+
+	var window []conversationNode
+	for _, messageID := range messageIDs {
+		if node, ok := loadConversationNode(chatID, messageID); ok {
+			window = append(window, node)
+		}
+	}
+	return window
+}
+
+// Собирает историю для запроса: цепочку ответов, если пользователь
+// отвечает боту, иначе скользящее окно чата, если оно включено
+func buildConversationHistory(bot *tgbotapi.BotAPI, message *tgbotapi.Message, settings chatSettings) []conversationNode {
+	chatID := message.Chat.ID
+	if reply := message.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == bot.Self.ID {
+		chain := loadReplyChain(chatID, reply.MessageID)
+		if len(chain) == 0 {
+			// Сообщение бота не сохранилось: берем его текст из самого ответа
+			chain = []conversationNode{{Role: roleAssistant, Content: reply.Text}}
+		}
+		return chain
+	}
+	if settings.HistoryWindow > 0 {
+		return loadChatWindow(chatID, settings.HistoryWindow)
+	}
+	return nil
+}
+
+// Сообщение другого участника, на которое ответил пользователь, позвав бота.
+// Возвращает текст и автора; у пересланного сообщения автор — исходный отправитель.
+func quotedMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) (text, author string, ok bool) {
+	reply := message.ReplyToMessage
+	if reply == nil || reply.From == nil || reply.From.ID == bot.Self.ID {
+		return "", "", false
+	}
+	text, _ = messageText(reply)
+	if strings.TrimSpace(text) == "" {
+		return "", "", false
+	}
+	switch {
+	case reply.ForwardFrom != nil:
+		author = displayName(reply.ForwardFrom)
+	case reply.ForwardSenderName != "":
+		author = reply.ForwardSenderName
+	default:
+		author = displayName(reply.From)
+	}
+	return text, author, true
+}
+
+// Добавляет к вопросу сообщение, на которое ответил пользователь, чтобы
+// бота можно было попросить проверить, перевести или объяснить любое
+// сообщение чата. Длинная цитата обрезается.
+func withQuotedMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, query string) string {
+	text, author, ok := quotedMessage(bot, message)
+	if !ok {
+		return query
+	}
+	if quoted := truncateToTokens(text, quotedMessageTokens); quoted != text {
+		text = quoted + "…"
+	}
+	return fmt.Sprintf("Сообщение от %s, на которое отвечает пользователь:\n«%s»\n\n%s", author, text, query)
+}
+
+// Преобразует историю в сообщения для API, отбрасывая самые старые
+// сообщения, пока история не уложится в бюджет токенов
+func conversationMessages(history []conversationNode, budget int) []llmMessage {
+	start := len(history)
+	used := 0
+	for start > 0 {
+		cost := estimateTokens(history[start-1].Content)
+		if used+cost > budget {
+			break
+		}
+		used += cost
+		start--
+	}
+
+	var messages []llmMessage
+	for _, node := range history[start:] {
+		messages = append(messages, llmMessage{Role: node.Role, Content: node.Content})
+	}
+	return messages
+}
+
+// Сохраняет вопрос пользователя и ответ бота как звенья цепочки.
+// Длинный ответ занимает несколько сообщений: звено сохраняется для каждого,
+// чтобы продолжить диалог можно было ответом на любое из них.
+func saveConversationTurn(chatID int64, question *tgbotapi.Message, query string, answerIDs []int, answer string) {
+	parent := 0
+	if question.ReplyToMessage != nil {
+		if _, ok := loadConversationNode(chatID, question.ReplyToMessage.MessageID); ok {
+			parent = question.ReplyToMessage.MessageID
+		}
+	}
+	userNode := conversationNode{Role: roleUser, Content: query, Parent: parent, Time: time.Now()}
+	nodes := map[int]conversationNode{question.MessageID: userNode}
+	saveAnswerNodes(chatID, question.MessageID, answerIDs, answer, nodes, question.MessageID)
+}
+
+// Сохраняет продолжение ответа, оборвавшегося по лимиту токенов
+func saveContinuation(chatID int64, previousID int, answerIDs []int, answer string) {
+	saveAnswerNodes(chatID, previousID, answerIDs, answer, nil)
+}
+
+// Сохраняет ответ бота вместе со звеньями nodes, индекс дней и скользящее
+// окно чата одной записью в хранилище
+func saveAnswerNodes(chatID int64, parent int, answerIDs []int, answer string, nodes map[int]conversationNode, windowIDs ...int) {
+	if nodes == nil {
+		nodes = make(map[int]conversationNode)
+	}
+	now := time.Now()
+	botNode := conversationNode{Role: roleAssistant, Content: answer, Parent: parent, Time: now}
+	for _, answerID := range answerIDs {
+		nodes[answerID] = botNode
+	}
+	if len(nodes) == 0 {
+		return
+	}
+
+	chatHistoryMutex.Lock()
+	defer chatHistoryMutex.Unlock()
+
+	conversations := make(map[string]interface{}, len(nodes))
+	dayKey := conversationDayKey(now, chatID)
+	var dayIDs []int
+	db.get(conversationDaysBucket, dayKey, &dayIDs)
+	for messageID, node := range nodes {
+		conversations[conversationKey(chatID, messageID)] = node
+		dayIDs = append(dayIDs, messageID)
+	}
+	batch := map[string]map[string]interface{}{
+		conversationBucket:     conversations,
+		conversationDaysBucket: {dayKey: dayIDs},
+	}
+
+	// Скользящее окно чата хранит ID последних сообщений диалогов
+	if len(answerIDs) > 0 {
+		key := strconv.FormatInt(chatID, 10)
+		var messageIDs []int
+		db.get(chatHistoryBucket, key, &messageIDs)
+		messageIDs = append(messageIDs, windowIDs...)
+		messageIDs = append(messageIDs, answerIDs[len(answerIDs)-1])
+		if limit := 2 * maxHistoryWindow; len(messageIDs) > limit {
+			messageIDs = messageIDs[len(messageIDs)-limit:]
+		}
+		batch[chatHistoryBucket] = map[string]interface{}{key: messageIDs}
+	}
+	if err := db.putBatch(batch); err != nil {
+		log.Printf("Ошибка при сохранении диалога: %v", err)
+	}
+}
+
+// Строит индекс дней для диалогов, сохраненных до его появления
+func indexConversationsLocked() {
+	if len(db.keys(conversationDaysBucket)) > 0 {
+		return
+	}
+	days := make(map[string]interface{})
+	for _, key := range db.keys(conversationBucket) {
+		chat, message, _ := strings.Cut(key, ":")
+		chatID, chatErr := strconv.ParseInt(chat, 10, 64)
+		messageID, messageErr := strconv.Atoi(message)
+		var node conversationNode
+		if chatErr != nil || messageErr != nil || !db.get(conversationBucket, key, &node) {
+			continue
+		}
+		dayKey := conversationDayKey(node.Time, chatID)
+		dayIDs, _ := days[dayKey].([]int)
+		days[dayKey] = append(dayIDs, messageID)
+	}
+	if err := db.putAll(conversationDaysBucket, days); err != nil {
+		log.Printf("Ошибка при построении индекса диалогов: %v", err)
+	}
+}
+
+// Удаляет сообщения диалогов старше ttl. Устаревшие сообщения находятся
+// по индексу дней, сами звенья диалогов при этом не читаются.
+func pruneConversations(ttl time.Duration) {
+	chatHistoryMutex.Lock()
+	defer chatHistoryMutex.Unlock()
+
+	indexConversationsLocked()
+	cutoff := time.Now().Add(-ttl)
+	var expiredDays, expired []string
+	expiredIDs := make(map[int64]map[int]bool)
+	for _, key := range db.keys(conversationDaysBucket) {
+		// День удаляется целиком, когда устарел его конец
+		day, chatID, ok := parseConversationDayKey(key)
+		if !ok || !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		var messageIDs []int
+		db.get(conversationDaysBucket, key, &messageIDs)
+		if expiredIDs[chatID] == nil {
+			expiredIDs[chatID] = make(map[int]bool)
+		}
+		for _, messageID := range messageIDs {
+			expired = append(expired, conversationKey(chatID, messageID))
+			expiredIDs[chatID][messageID] = true
+		}
+		expiredDays = append(expiredDays, key)
+	}
+	if len(expiredDays) == 0 {
+		return
+	}
+	if err := db.remove(conversationBucket, expired...); err != nil {
+		log.Printf("Ошибка при удалении старых диалогов: %v", err)
+		return
+	}
+	if err := db.remove(conversationDaysBucket, expiredDays...); err != nil {
+		log.Printf("Ошибка при удалении старых диалогов: %v", err)
+	}
+
+	// Из скользящих окон убираются только удаленные сообщения
+	windows := make(map[string]interface{})
+	for chatID, removed := range expiredIDs {
+		key := strconv.FormatInt(chatID, 10)
+		var messageIDs, kept []int
+		if !db.get(chatHistoryBucket, key, &messageIDs) {
+			continue
+		}
+		for _, messageID := range messageIDs {
+			if !removed[messageID] {
+				kept = append(kept, messageID)
+			}
+		}
+		if len(kept) != len(messageIDs) {
+			windows[key] = kept
+		}
+	}
+	if err := db.putAll(chatHistoryBucket, windows); err != nil {
+		log.Printf("Ошибка при сохранении истории чата: %v", err)
+	}
+}
+
+// Периодически очищает устаревшие диалоги
+func pruneConversationsPeriodically() {
+	for {
+		if config.GPT.HistoryTTL > 0 {
+			pruneConversations(config.GPT.HistoryTTL)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Отображает размер окна истории для меню настроек
+func formatHistoryWindow(size int) string {
+	if size == 0 {
+		return "выкл"
+	}
+	return strconv.Itoa(size)
+}
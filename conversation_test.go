@@ -0,0 +1,95 @@
+// conversation_test.go
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Подменяет хранилище на время теста
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	saved := db
+	db = newMemoryStore()
+	t.Cleanup(func() { db = saved })
+}
+
+func TestSaveConversationTurn(t *testing.T) {
+	useMemoryStore(t)
+	const chatID = -100
+	saveConversationTurn(chatID, &tgbotapi.Message{MessageID: 10}, "вопрос", []int{11, 12}, "ответ")
+
+	chain := loadReplyChain(chatID, 12)
+	if len(chain) != 2 || chain[0].Content != "вопрос" || chain[1].Content != "ответ" {
+		t.Fatalf("цепочка ответов: %+v", chain)
+	}
+	if window := loadChatWindow(chatID, 10); len(window) != 2 {
+		t.Errorf("в окне чата %d сообщений вместо 2", len(window))
+	}
+	var dayIDs []int
+	if !db.get(conversationDaysBucket, conversationDayKey(time.Now(), chatID), &dayIDs) || len(dayIDs) != 3 {
+		t.Errorf("индекс дня: %v", dayIDs)
+	}
+
+	saveContinuation(chatID, 12, []int{13}, "продолжение")
+	if chain := loadReplyChain(chatID, 13); len(chain) != 3 {
+		t.Errorf("продолжение не связано с ответом: %+v", chain)
+	}
+}
+
+func TestPruneConversations(t *testing.T) {
+	useMemoryStore(t)
+	const chatID = 5
+	saveConversationTurn(chatID, &tgbotapi.Message{MessageID: 1}, "вопрос", []int{2}, "ответ")
+
+	// Свежие диалоги не удаляются
+	pruneConversations(time.Hour)
+	if len(db.keys(conversationBucket)) != 2 {
+		t.Fatalf("удалены свежие сообщения: %v", db.keys(conversationBucket))
+	}
+
+	pruneConversations(-48 * time.Hour)
+	if keys := db.keys(conversationBucket); len(keys) != 0 {
+		t.Errorf("устаревшие сообщения не удалены: %v", keys)
+	}
+	if keys := db.keys(conversationDaysBucket); len(keys) != 0 {
+		t.Errorf("индекс дней не очищен: %v", keys)
+	}
+	var messageIDs []int
+	db.get(chatHistoryBucket, "5", &messageIDs)
+	if len(messageIDs) != 0 {
+		t.Errorf("в окне чата остались удаленные сообщения: %v", messageIDs)
+	}
+}
+
+func TestPruneConversationsIndexesOldData(t *testing.T) {
+	useMemoryStore(t)
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	err := db.putAll(conversationBucket, map[string]interface{}{
+		conversationKey(7, 1): conversationNode{Role: roleUser, Content: "старый", Time: old},
+		conversationKey(7, 2): conversationNode{Role: roleUser, Content: "новый", Time: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruneConversations(7 * 24 * time.Hour)
+	if keys := db.keys(conversationBucket); !reflect.DeepEqual(keys, []string{conversationKey(7, 2)}) {
+		t.Errorf("после очистки остались %v", keys)
+	}
+}
+
+func TestParseConversationDayKey(t *testing.T) {
+	now := time.Date(2024, 6, 1, 23, 30, 0, 0, time.UTC)
+	day, chatID, ok := parseConversationDayKey(conversationDayKey(now, -1001))
+	if !ok || chatID != -1001 || !day.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("разбор ключа: %v %d %v", day, chatID, ok)
+	}
+	if _, _, ok := parseConversationDayKey("1:2"); ok {
+		t.Errorf("ключ без даты разобран")
+	}
+}
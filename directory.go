@@ -0,0 +1,305 @@
+// directory.go
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Раздел хранилища с username и именами пользователей
+const userDirectoryBucket = "user_directory"
+
+// Известные данные о пользователе Telegram
+type userIdentity struct {
+	UserID      int64
+	Username    string
+	DisplayName string
+	LastSeen    time.Time
+}
+
+// Каталог участников чатов.
+// Username и отображаемое имя хранятся один раз на пользователя, поэтому
+// переименование сразу отражается во всех чатах, а время последней
+// активности ведется отдельно для каждого чата.
+// Username в Telegram уникален, поэтому индекс usernames хранит для каждого
+// только последнего замеченного владельца: если username перешел к другому
+// пользователю, у прежнего он стирается.
+// Username и имена сохраняются в хранилище и загружаются при запуске,
+// участники чатов — нет: их подтверждает getChatMember.
+type identityDirectory struct {
+	mu        sync.Mutex
+	users     map[int64]*userIdentity
+	chats     map[int64]map[int64]time.Time
+	usernames map[string]int64 // username в нижнем регистре → userID
+}
+
+var directory = newIdentityDirectory()
+
+// Сохраненные данные пользователя; время активности не хранится,
+// чтобы не писать в хранилище на каждое сообщение
+type storedIdentity struct {
+	Username    string `json:"username,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+func newIdentityDirectory() *identityDirectory {
+	return &identityDirectory{
+		users:     make(map[int64]*userIdentity),
+		chats:     make(map[int64]map[int64]time.Time),
+		usernames: make(map[string]int64),
+	}
+}
+
+// Запоминает пользователя как участника чата
+func (d *identityDirectory) observe(chatID int64, user *tgbotapi.User) {
+	if user == nil {
+		return
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	identity, ok := d.users[user.ID]
+	if !ok {
+		identity = &userIdentity{UserID: user.ID}
+		d.users[user.ID] = identity
+	}
+	name := displayName(user)
+	if !ok || identity.Username != user.UserName || identity.DisplayName != name {
+		changed := []*userIdentity{identity}
+		if previous := d.setUsernameLocked(identity, user.UserName); previous != nil {
+			changed = append(changed, previous)
+		}
+		identity.DisplayName = name
+		// Пишем под блокировкой, чтобы изменения попадали в хранилище по порядку
+		saveIdentities(changed)
+	}
+	identity.LastSeen = now
+
+	members, ok := d.chats[chatID]
+	if !ok {
+		members = make(map[int64]time.Time)
+		d.chats[chatID] = members
+	}
+	members[user.ID] = now
+}
+
+// Обновляет username пользователя и индекс usernames.
+// Возвращает прежнего владельца username, если он его потерял.
+func (d *identityDirectory) setUsernameLocked(identity *userIdentity, username string) *userIdentity {
+	if old := strings.ToLower(identity.Username); old != "" && d.usernames[old] == identity.UserID {
+		delete(d.usernames, old)
+	}
+	identity.Username = username
+	if username == "" {
+		return nil
+	}
+	key := strings.ToLower(username)
+	var lost *userIdentity
+	if previous, ok := d.usernames[key]; ok && previous != identity.UserID {
+		// Username освободился и занят другим пользователем
+		lost = d.users[previous]
+		lost.Username = ""
+	}
+	d.usernames[key] = identity.UserID
+	return lost
+}
+
+// Загружает сохраненных пользователей и восстанавливает индекс usernames
+func (d *identityDirectory) load() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range db.keys(userDirectoryBucket) {
+		userID, err := strconv.ParseInt(key, 10, 64)
+		var stored storedIdentity
+		if err != nil || !db.get(userDirectoryBucket, key, &stored) {
+			continue
+		}
+		identity := &userIdentity{UserID: userID, DisplayName: stored.DisplayName}
+		d.users[userID] = identity
+		d.setUsernameLocked(identity, stored.Username)
+	}
+}
+
+// Сохраняет изменившихся пользователей одной записью
+func saveIdentities(identities []*userIdentity) {
+	values := make(map[string]interface{}, len(identities))
+	for _, identity := range identities {
+		values[strconv.FormatInt(identity.UserID, 10)] = storedIdentity{Username: identity.Username, DisplayName: identity.DisplayName}
+	}
+	if err := db.putAll(userDirectoryBucket, values); err != nil {
+		log.Printf("Ошибка при сохранении каталога пользователей: %v", err)
+	}
+}
+
+// Удаляет пользователя из участников чата
+func (d *identityDirectory) forget(chatID, userID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.chats[chatID], userID)
+}
+
+// Возвращает данные пользователя, если он уже встречался боту
+func (d *identityDirectory) lookup(userID int64) (userIdentity, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	identity, ok := d.users[userID]
+	if !ok {
+		return userIdentity{}, false
+	}
+	return *identity, true
+}
+
+// Возвращает время последней активности пользователя в чате
+func (d *identityDirectory) lastSeen(chatID, userID int64) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen, ok := d.chats[chatID][userID]
+	return seen, ok
+}
+
+// Ищет пользователя по username без учета регистра.
+// Возвращает также, известен ли он как участник чата.
+func (d *identityDirectory) findUsername(chatID int64, username string) (int64, bool, bool) {
+	username = strings.TrimPrefix(username, "@")
+	if username == "" {
+		return 0, false, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	userID, ok := d.usernames[strings.ToLower(username)]
+	if !ok {
+		return 0, false, false
+	}
+	_, inChat := d.chats[chatID][userID]
+	return userID, true, inChat
+}
+
+// Ищет участников чата по отображаемому имени без учета регистра:
+// по имени целиком или по первому слову, например «Вася» для «Вася Пупкин».
+// Возвращает всех подходящих, упорядоченных по userID.
+func (d *identityDirectory) findByName(chatID int64, name string) []int64 {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var found []int64
+	for userID := range d.chats[chatID] {
+		displayName := d.users[userID].DisplayName
+		firstName, _, _ := strings.Cut(displayName, " ")
+		if strings.EqualFold(displayName, name) || strings.EqualFold(firstName, name) {
+			found = append(found, userID)
+		}
+	}
+	slices.Sort(found)
+	return found
+}
+
+// Находит userID по username в заданном чате.
+// Пользователь, известный только по другим чатам, проверяется через getChatMember:
+// он должен состоять в чате и по-прежнему носить этот username.
+func (d *identityDirectory) resolveUsername(bot *tgbotapi.BotAPI, chatID int64, username string) (int64, bool) {
+	userID, found, inChat := d.findUsername(chatID, username)
+	if !found {
+		return 0, false
+	}
+	if inChat {
+		return userID, true
+	}
+	identity, ok := d.fetchMember(bot, chatID, userID)
+	if !ok || !strings.EqualFold(identity.Username, strings.TrimPrefix(username, "@")) {
+		return 0, false
+	}
+	return userID, true
+}
+
+// Запрашивает участника чата у Telegram и обновляет каталог.
+// Вышедший или исключенный пользователь удаляется из участников чата.
+func (d *identityDirectory) fetchMember(bot *tgbotapi.BotAPI, chatID, userID int64) (userIdentity, bool) {
+	if bot == nil {
+		return userIdentity{}, false
+	}
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID},
+	})
+	if err != nil {
+		return userIdentity{}, false
+	}
+	if member.User == nil || member.HasLeft() || member.WasKicked() {
+		d.forget(chatID, userID)
+		return userIdentity{}, false
+	}
+	d.observe(chatID, member.User)
+	return d.lookup(userID)
+}
+
+// Возвращает HTML-упоминание пользователя для сообщений с ParseMode HTML.
+// Пользователи без username отображаются ссылкой tg://user?id, а не выдуманным @Имя.
+func (d *identityDirectory) mention(bot *tgbotapi.BotAPI, chatID, userID int64) string {
+	identity, ok := d.lookup(userID)
+	if !ok {
+		identity, ok = d.fetchMember(bot, chatID, userID)
+	}
+	if ok && identity.Username != "" {
+		return "@" + html.EscapeString(identity.Username)
+	}
+	name := identity.DisplayName
+	if name == "" {
+		name = fmt.Sprintf("%d", userID)
+	}
+	return fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, userID, html.EscapeString(name))
+}
+
+// Возвращает HTML-упоминания списка пользователей через запятую
+func (d *identityDirectory) mentions(bot *tgbotapi.BotAPI, chatID int64, userIDs []int64) string {
+	var mentions []string
+	for _, userID := range userIDs {
+		mentions = append(mentions, d.mention(bot, chatID, userID))
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// Отображаемое имя пользователя: имя и фамилия
+func displayName(user *tgbotapi.User) string {
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// Запоминает всех пользователей, упомянутых в сообщении
+func observeMessageUsers(message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	directory.observe(chatID, message.From)
+	if message.ReplyToMessage != nil {
+		directory.observe(chatID, message.ReplyToMessage.From)
+	}
+	for i := range message.NewChatMembers {
+		directory.observe(chatID, &message.NewChatMembers[i])
+	}
+	for _, m := range parseMentions(message.Text, message.Entities) {
+		if m.User != nil {
+			directory.observe(chatID, m.User)
+		}
+	}
+	if message.LeftChatMember != nil {
+		directory.forget(chatID, message.LeftChatMember.ID)
+	}
+}
@@ -0,0 +1,107 @@
+// directory_test.go
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Бот, который на getChatMember отвечает member
+func newMemberBot(t *testing.T, member string) *tgbotapi.BotAPI {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/getChatMember") {
+			fmt.Fprintf(w, `{"ok":true,"result":%s}`, member)
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"salty","username":"salty_bot"}}`))
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tgbotapi.NewBotAPIWithClient("test", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func TestFindUsernameTakesLatestOwner(t *testing.T) {
+	d := newIdentityDirectory()
+	d.observe(1, &tgbotapi.User{ID: 10, UserName: "vasya", FirstName: "Вася"})
+	d.observe(2, &tgbotapi.User{ID: 20, UserName: "Vasya", FirstName: "Другой"})
+
+	userID, found, inChat := d.findUsername(1, "@VASYA")
+	if !found || userID != 20 || inChat {
+		t.Errorf("найден %d (found %v, inChat %v) вместо 20 вне чата", userID, found, inChat)
+	}
+	if identity, _ := d.lookup(10); identity.Username != "" {
+		t.Errorf("у прежнего владельца остался username %q", identity.Username)
+	}
+
+	d.observe(2, &tgbotapi.User{ID: 20, UserName: "petya"})
+	if _, found, _ := d.findUsername(1, "vasya"); found {
+		t.Errorf("старый username после переименования все еще находится")
+	}
+}
+
+func TestResolveUsernameRevalidates(t *testing.T) {
+	d := newIdentityDirectory()
+	d.observe(2, &tgbotapi.User{ID: 10, UserName: "vasya"})
+
+	// Пользователь успел сменить username: по старому его находить нельзя
+	bot := newMemberBot(t, `{"status":"member","user":{"id":10,"first_name":"Вася","username":"petya"}}`)
+	if userID, ok := d.resolveUsername(bot, 1, "vasya"); ok {
+		t.Errorf("найден %d по устаревшему username", userID)
+	}
+	if userID, ok := d.resolveUsername(bot, 1, "petya"); !ok || userID != 10 {
+		t.Errorf("по новому username найден %d, %v", userID, ok)
+	}
+}
+
+func TestFetchMemberForgetsLeftUser(t *testing.T) {
+	d := newIdentityDirectory()
+	d.observe(1, &tgbotapi.User{ID: 10, UserName: "vasya"})
+
+	bot := newMemberBot(t, `{"status":"left","user":{"id":10,"first_name":"Вася","username":"vasya"}}`)
+	if _, ok := d.fetchMember(bot, 1, 10); ok {
+		t.Errorf("вышедший пользователь считается участником")
+	}
+	if _, ok := d.lastSeen(1, 10); ok {
+		t.Errorf("вышедший пользователь остался в участниках чата")
+	}
+}
+
+func TestDirectoryPersistsUsernames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	saved := db
+	t.Cleanup(func() { db = saved })
+	db = openTestStore(t, path)
+
+	d := newIdentityDirectory()
+	d.observe(1, &tgbotapi.User{ID: 10, UserName: "vasya", FirstName: "Вася"})
+	d.observe(1, &tgbotapi.User{ID: 20, UserName: "petya", FirstName: "Петя"})
+	// Username перешел к другому пользователю: прежний владелец сохраняется без него
+	d.observe(2, &tgbotapi.User{ID: 30, UserName: "Vasya", FirstName: "Другой"})
+
+	// После перезапуска индекс восстанавливается из файла
+	db = openTestStore(t, path)
+	d = newIdentityDirectory()
+	d.load()
+
+	for username, want := range map[string]int64{"vasya": 30, "@PETYA": 20} {
+		userID, found, inChat := d.findUsername(1, username)
+		if !found || userID != want || inChat {
+			t.Errorf("%s: найден %d (found %v, inChat %v) вместо %d вне чата", username, userID, found, inChat, want)
+		}
+	}
+	if identity, ok := d.lookup(10); !ok || identity.Username != "" || identity.DisplayName != "Вася" {
+		t.Errorf("прежний владелец после загрузки: %+v", identity)
+	}
+}
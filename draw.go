@@ -0,0 +1,234 @@
+// draw.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Предельная длина подписи к фото в Telegram
+const photoCaptionLimit = 1024
+
+// Включена проверка запросов картинок, но модерация не настроена
+var errModerationUnavailable = errors.New("модерация запросов картинок не настроена")
+
+// Ключ счетчика картинок пользователя за сегодня: image:<id>:<день>.
+// Счетчик хранится вместе со счетчиками токенов и удаляется вместе с ними.
+func imageQuotaKey(userID int64) string {
+	day, _ := usagePeriods(time.Now())
+	return usageKey("image", userID, day)
+}
+
+// Сколько картинок пользователь еще может нарисовать сегодня; -1 — без ограничения
+func imagesLeft(key string) int {
+	limit := config.Images.UserDaily
+	if limit <= 0 {
+		return -1
+	}
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	var used int
+	db.get(usageBucket, key, &used)
+	if left := limit - used - usageReserved[key]; left > 0 {
+		return left
+	}
+	return 0
+}
+
+// Резервирует картинку в дневной квоте пользователя на время генерации
+func reserveImage(key string) bool {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	var used int
+	db.get(usageBucket, key, &used)
+	if limit := config.Images.UserDaily; limit > 0 && used+usageReserved[key] >= limit {
+		return false
+	}
+	usageReserved[key]++
+	return true
+}
+
+// Снимает резерв и, если картинка получена, засчитывает ее
+func releaseImage(key string, generated bool) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	if usageReserved[key]--; usageReserved[key] <= 0 {
+		delete(usageReserved, key)
+	}
+	if !generated {
+		return
+	}
+	var used int
+	db.get(usageBucket, key, &used)
+	if err := db.put(usageBucket, key, used+1); err != nil {
+		log.Printf("Ошибка при сохранении счетчика картинок: %v", err)
+	}
+}
+
+// Сообщение об исчерпанном дневном лимите картинок
+func imageQuotaMessage() string {
+	now := time.Now()
+	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	return fmt.Sprintf("Ваш дневной лимит картинок (%d) исчерпан. Он обновится через %s.",
+		config.Images.UserDaily, formatUntil(nextDay.Sub(now)))
+}
+
+// Проверяет текст модерацией, если она включена в [images].
+// Без настроенной модерации рисовать с этой настройкой нельзя.
+func moderatePrompt(ctx context.Context, text string) error {
+	if !config.Images.Moderation {
+		return nil
+	}
+	if moderator == nil {
+		return errModerationUnavailable
+	}
+	result, err := moderator.Moderate(ctx, text, nil)
+	if err != nil {
+		return err
+	}
+	if result.Flagged {
+		return fmt.Errorf("%w: %s", errContentFlagged, strings.Join(result.Categories, ", "))
+	}
+	return nil
+}
+
+// Текст ошибки генерации картинки для пользователя
+func drawErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, errContentFlagged):
+		return "Такое рисовать не буду: запрос не прошел модерацию."
+	case errors.Is(err, errModerationUnavailable):
+		return "Рисование недоступно: запросы должны проходить модерацию, а она не настроена."
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Картинка рисовалась слишком долго. Попробуйте еще раз."
+	}
+	return gptErrorMessage(err)
+}
+
+// Обрезает подпись до лимита Telegram
+func photoCaption(text string) string {
+	runes := []rune(text)
+	if len(runes) <= photoCaptionLimit {
+		return text
+	}
+	return string(runes[:photoCaptionLimit-1]) + "…"
+}
+
+// Рисует картинку и отправляет ее в чат. Выполняется в очереди запросов.
+func drawImage(ctx context.Context, bot *tgbotapi.BotAPI, message *tgbotapi.Message, prompt string) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	reply := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyToMessageID = message.MessageID
+		bot.Send(msg)
+	}
+
+	key := imageQuotaKey(userID)
+	if !reserveImage(key) {
+		reply(imageQuotaMessage())
+		return
+	}
+	generated := false
+	defer func() { releaseImage(key, generated) }()
+	if !reserveBudget(config.Images.Price) {
+		reply(drawErrorMessage(errBudgetExhausted))
+		return
+	}
+	defer releaseBudget(config.Images.Price)
+
+	started := time.Now()
+	if err := moderatePrompt(ctx, prompt); err != nil {
+		log.Printf("Запрос картинки от пользователя %d отклонен: %v", userID, err)
+		auditImageRequest(started, userID, chatID, prompt, imageResult{}, 0, err)
+		reply(drawErrorMessage(err))
+		return
+	}
+
+	bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatUploadPhoto))
+	if config.Images.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Images.Timeout)
+		defer cancel()
+	}
+	result, err := imageGenerator.GenerateImage(ctx, imageRequest{
+		Model:   config.Images.Model,
+		Prompt:  prompt,
+		Size:    config.Images.Size,
+		Quality: config.Images.Quality,
+	})
+	if err != nil {
+		log.Printf("Ошибка при генерации картинки: %v", err)
+		auditImageRequest(started, userID, chatID, prompt, result, 0, err)
+		reply(drawErrorMessage(err))
+		return
+	}
+	generated = true
+	recordImageUsage(userID, chatID, config.Images.Price)
+	auditImageRequest(started, userID, chatID, prompt, result, config.Images.Price, nil)
+	log.Printf("Картинка для пользователя %d в чате %d готова за %v", userID, chatID, time.Since(started).Round(time.Millisecond))
+
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: "image.png", Bytes: result.Data})
+	photo.ReplyToMessageID = message.MessageID
+	photo.Caption = photoCaption(prompt)
+	if _, err := bot.Send(photo); err != nil {
+		log.Printf("Ошибка при отправке картинки: %v", err)
+		reply("Не удалось отправить картинку.")
+	}
+}
+
+// Обработка команды /draw: генерация картинки по описанию
+func handleDrawCommand(ctx *commandContext) {
+	message := ctx.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	if imageGenerator == nil || !config.Images.Enabled {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Генерация картинок не настроена."))
+		return
+	}
+	if config.Images.Moderation && moderator == nil {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, drawErrorMessage(errModerationUnavailable)))
+		return
+	}
+	prompt := strings.TrimSpace(ctx.RawArgs)
+	if prompt == "" {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Опишите картинку после команды: /draw кот в скафандре"))
+		return
+	}
+
+	if !checkRateLimit(ctx.Bot, message, gptRateLimits(userID, chatID, getChatSettings(chatID))...) {
+		return
+	}
+	if budgetExhausted() {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, gptErrorMessage(errBudgetExhausted)))
+		return
+	}
+	if imagesLeft(imageQuotaKey(userID)) == 0 {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, imageQuotaMessage()))
+		return
+	}
+
+	submitGPTJob(ctx.Bot, chatID, userID, message.MessageID, func(jobCtx context.Context) {
+		drawImage(jobCtx, ctx.Bot, message, prompt)
+	})
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "draw",
+		Usage:       "описание",
+		Description: "Нарисовать картинку по описанию",
+		Feature:     "gpt",
+		Handler:     handleDrawCommand,
+	})
+}
@@ -0,0 +1,38 @@
+// draw_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestModeratePromptWithoutModerator(t *testing.T) {
+	savedModerator, savedEnabled := moderator, config.Images.Moderation
+	t.Cleanup(func() { moderator, config.Images.Moderation = savedModerator, savedEnabled })
+
+	moderator = nil
+	config.Images.Moderation = true
+	if err := moderatePrompt(context.Background(), "кот"); !errors.Is(err, errModerationUnavailable) {
+		t.Errorf("без модерации запрос пропущен: %v", err)
+	}
+
+	config.Images.Moderation = false
+	if err := moderatePrompt(context.Background(), "кот"); err != nil {
+		t.Errorf("при выключенной проверке: %v", err)
+	}
+
+	config.Images.Moderation = true
+	keywords, err := newKeywordModerator([]string{"запрещ"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderator = keywords
+	if err := moderatePrompt(context.Background(), "Запрещенка"); !errors.Is(err, errContentFlagged) {
+		t.Errorf("шаблон не сработал: %v", err)
+	}
+	if err := moderatePrompt(context.Background(), "кот"); err != nil {
+		t.Errorf("безобидный запрос отклонен: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// entities.go
+
+package main
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Упоминание пользователя в тексте сообщения.
+// Для сущности "mention" заполнено поле Username, для "text_mention" — User.
+type mention struct {
+	Username string
+	User     *tgbotapi.User
+	Text     string
+	Offset   int
+	Length   int
+}
+
+// Проверяет, указывает ли упоминание на заданного пользователя
+func (m mention) refersTo(user tgbotapi.User) bool {
+	if m.User != nil {
+		return m.User.ID == user.ID
+	}
+	return user.UserName != "" && strings.EqualFold(m.Username, user.UserName)
+}
+
+// Возвращает фрагмент текста сущности.
+// Смещения в Telegram задаются в кодовых единицах UTF-16, а не в байтах.
+func entityText(text string, offset, length int) string {
+	units := utf16.Encode([]rune(text))
+	if offset < 0 || length < 0 || offset+length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[offset : offset+length]))
+}
+
+// Удаляет из текста фрагмент, заданный смещением и длиной в UTF-16
+func cutEntityText(text string, offset, length int) string {
+	units := utf16.Encode([]rune(text))
+	if offset < 0 || length < 0 || offset+length > len(units) {
+		return text
+	}
+	rest := append(units[:offset:offset], units[offset+length:]...)
+	return string(utf16.Decode(rest))
+}
+
+// Возвращает текст сообщения сразу после команды в его начале,
+// например «! вопрос» для «/ask! вопрос». Без команды возвращает пустую строку.
+func afterCommand(message *tgbotapi.Message) string {
+	for _, entity := range message.Entities {
+		if entity.Type == "bot_command" && entity.Offset == 0 {
+			return cutEntityText(message.Text, 0, entity.Length)
+		}
+	}
+	return ""
+}
+
+// Извлекает упоминания пользователей из текста и его сущностей
+func parseMentions(text string, entities []tgbotapi.MessageEntity) []mention {
+	var mentions []mention
+	for _, entity := range entities {
+		switch entity.Type {
+		case "mention":
+			fragment := entityText(text, entity.Offset, entity.Length)
+			if fragment == "" {
+				continue
+			}
+			mentions = append(mentions, mention{
+				Username: strings.TrimPrefix(fragment, "@"),
+				Text:     fragment,
+				Offset:   entity.Offset,
+				Length:   entity.Length,
+			})
+		case "text_mention":
+			if entity.User == nil {
+				continue
+			}
+			mentions = append(mentions, mention{
+				User:   entity.User,
+				Text:   entityText(text, entity.Offset, entity.Length),
+				Offset: entity.Offset,
+				Length: entity.Length,
+			})
+		}
+	}
+	return mentions
+}
@@ -0,0 +1,108 @@
+// entities_test.go
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestAfterCommand(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		entities []tgbotapi.MessageEntity
+		want     string
+	}{
+		{"/ask! 😀 вопрос", []tgbotapi.MessageEntity{{Type: "bot_command", Length: 4}}, "! 😀 вопрос"},
+		{"/ask@salty_bot! да", []tgbotapi.MessageEntity{{Type: "bot_command", Length: 14}}, "! да"},
+		{"/ask", []tgbotapi.MessageEntity{{Type: "bot_command", Length: 4}}, ""},
+		{"привет /ask!", []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 7, Length: 4}}, ""},
+		{"/ask!", nil, ""},
+	} {
+		message := &tgbotapi.Message{Text: tc.text, Entities: tc.entities}
+		if got := afterCommand(message); got != tc.want {
+			t.Errorf("afterCommand(%q) = %q вместо %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestEntityTextUTF16(t *testing.T) {
+	// «😀» занимает две кодовые единицы UTF-16, кириллица — по одной
+	text := "Привет 😀 @vasya!"
+	for _, tc := range []struct {
+		offset, length int
+		text, cut      string
+	}{
+		{10, 6, "@vasya", "Привет 😀 !"},
+		{7, 2, "😀", "Привет  @vasya!"},
+		{0, 6, "Привет", " 😀 @vasya!"},
+		{10, 8, "", text},
+		{-1, 2, "", text},
+		{3, -1, "", text},
+	} {
+		if got := entityText(text, tc.offset, tc.length); got != tc.text {
+			t.Errorf("entityText(%d, %d) = %q вместо %q", tc.offset, tc.length, got, tc.text)
+		}
+		if got := cutEntityText(text, tc.offset, tc.length); got != tc.cut {
+			t.Errorf("cutEntityText(%d, %d) = %q вместо %q", tc.offset, tc.length, got, tc.cut)
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	petya := &tgbotapi.User{ID: 7, FirstName: "Петя"}
+	text := "😀 Вызываю @vasya и Петя"
+	got := parseMentions(text, []tgbotapi.MessageEntity{
+		{Type: "bold", Offset: 0, Length: 2},
+		{Type: "mention", Offset: 11, Length: 6},
+		{Type: "text_mention", Offset: 20, Length: 4, User: petya},
+		// Без пользователя и за пределами текста — пропускаются
+		{Type: "text_mention", Offset: 20, Length: 4},
+		{Type: "mention", Offset: 30, Length: 6},
+	})
+	want := []mention{
+		{Username: "vasya", Text: "@vasya", Offset: 11, Length: 6},
+		{User: petya, Text: "Петя", Offset: 20, Length: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMentions = %+v вместо %+v", got, want)
+	}
+}
+
+func TestMentionRefersTo(t *testing.T) {
+	vasya := tgbotapi.User{ID: 5, UserName: "Vasya"}
+	noUsername := tgbotapi.User{ID: 6}
+	for _, tc := range []struct {
+		mention mention
+		user    tgbotapi.User
+		want    bool
+	}{
+		{mention{Username: "vasya"}, vasya, true},
+		{mention{Username: "petya"}, vasya, false},
+		{mention{Username: ""}, noUsername, false},
+		{mention{User: &tgbotapi.User{ID: 5}}, vasya, true},
+		{mention{User: &tgbotapi.User{ID: 6}, Username: "vasya"}, vasya, false},
+	} {
+		if got := tc.mention.refersTo(tc.user); got != tc.want {
+			t.Errorf("%+v.refersTo(%d) = %v", tc.mention, tc.user.ID, got)
+		}
+	}
+}
+
+func TestGameChallengeReplyWithoutAuthor(t *testing.T) {
+	bot, telegram := newRecordingBot(t)
+	message := &tgbotapi.Message{
+		MessageID:      2,
+		From:           &tgbotapi.User{ID: 10},
+		Chat:           &tgbotapi.Chat{ID: 1, Type: "supergroup"},
+		ReplyToMessage: &tgbotapi.Message{MessageID: 1, SenderChat: &tgbotapi.Chat{ID: -100, Type: "channel"}},
+	}
+	handleDuelInitiation(bot, message)
+	handleRouletteInitiation(bot, message)
+	sent := telegram.called("sendMessage")
+	if len(sent) != 2 || sent[0].Params["text"] != replyWithoutAuthorText || sent[1].Params["text"] != replyWithoutAuthorText {
+		t.Errorf("ответы на вызов автора без пользователя: %+v", sent)
+	}
+}
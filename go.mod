@@ -3,6 +3,7 @@ module salty_ai_project
 go 1.23.2
 
 require (
-	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1 // indirect
-	github.com/sashabaranov/go-openai v1.35.6 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/sashabaranov/go-openai v1.35.6
 )
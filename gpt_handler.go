@@ -4,168 +4,380 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	openai "github.com/sashabaranov/go-openai"
 )
 
-// Инициализация клиента OpenAI
-var openaiClient *openai.Client
-
-// Карты для ограничения частоты запросов
-var userRequestTimes = make(map[int64]time.Time)
-var requestInterval = time.Minute
-
-// Переменные для отслеживания использования токенов
-var totalTokensUsed = 0
-var tokenUsageLimit = 100000 // Установите лимит токенов
-var tokenUsageMutex sync.Mutex
-
-func init() {
-	// Инициализация клиента OpenAI
-	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-	if openaiAPIKey == "" {
-		log.Fatal("Переменная окружения OPENAI_API_KEY не установлена")
-	}
-	openaiClient = openai.NewClient(openaiAPIKey)
-
-	// Запускаем ежедневный сброс использования токенов
-	go resetTokenUsageDaily()
-}
-
 // Обработка сообщений, адресованных боту (GPT)
 func handleGPT(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
-	chatID := message.Chat.ID
-	userID := message.From.ID
 	var userQuery string
 
-	// Проверка ограничения частоты запросов
-	if lastRequestTime, ok := userRequestTimes[userID]; ok {
-		if time.Since(lastRequestTime) < requestInterval {
-			remainingTime := requestInterval - time.Since(lastRequestTime)
-			response := fmt.Sprintf("Пожалуйста, подождите %v перед следующим запросом.", remainingTime.Round(time.Second))
-			msg := tgbotapi.NewMessage(chatID, response)
-			bot.Send(msg)
-			return
-		}
+	// Команды, в том числе /ask, обрабатывает реестр команд
+	if llm == nil || message.IsCommand() || !getChatSettings(message.Chat.ID).GPTEnabled {
+		return
 	}
 
-	// Проверяем, упомянут ли бот или является ли сообщение ответом на сообщение бота
-	isReplyToBot := message.ReplyToMessage != nil && message.ReplyToMessage.From.ID == bot.Self.ID
-	mentionsBot := false
-	for _, entity := range message.Entities {
-		if entity.Type == "mention" {
-			mentionedUser := message.Text[entity.Offset : entity.Offset+entity.Length]
-			if mentionedUser == "@"+bot.Self.UserName {
-				mentionsBot = true
-				break
-			}
+	// Проверяем, упомянут ли бот или является ли сообщение ответом на сообщение бота.
+	// У фото текст и упоминания находятся в подписи.
+	text, entities := messageText(message)
+	isReplyToBot := repliesToBot(bot, message)
+	var botMention *mention
+	for _, m := range parseMentions(text, entities) {
+		if m.refersTo(bot.Self) {
+			botMention = &m
+			break
 		}
 	}
+	mentionsBot := botMention != nil
 
 	if isReplyToBot || mentionsBot {
 		// Извлекаем запрос пользователя
 		if mentionsBot {
 			// Удаляем упоминание бота из текста
-			userQuery = strings.ReplaceAll(message.Text, "@"+bot.Self.UserName, "")
+			userQuery = cutEntityText(text, botMention.Offset, botMention.Length)
 			userQuery = strings.TrimSpace(userQuery)
 		} else if isReplyToBot {
-			userQuery = message.Text
+			userQuery = text
 		}
 
+		// Без текста вопроса спрашиваем о фото или о сообщении, на которое ответили
+		if userQuery == "" && len(questionPhoto(message)) > 0 && config.Vision.Enabled {
+			userQuery = defaultImageQuestion
+		}
+		if _, _, ok := quotedMessage(bot, message); userQuery == "" && ok {
+			userQuery = defaultQuoteQuestion
+		}
 		if userQuery == "" {
 			response := "Пожалуйста, введите вопрос после упоминания бота."
-			msg := tgbotapi.NewMessage(chatID, response)
+			msg := tgbotapi.NewMessage(message.Chat.ID, response)
 			bot.Send(msg)
 			return
 		}
 
-		// Обновляем время последнего запроса
-		userRequestTimes[userID] = time.Now()
+		requestGPT(bot, message, userQuery, false)
+	}
+}
+
+// Отвечает ли сообщение на сообщение бота. У ответов на сообщения
+// каналов и некоторых служебных сообщений автора нет.
+func repliesToBot(bot *tgbotapi.BotAPI, message *tgbotapi.Message) bool {
+	reply := message.ReplyToMessage
+	return reply != nil && reply.From != nil && reply.From.ID == bot.Self.ID
+}
+
+// Проверяет ограничения и ставит вопрос пользователя в очередь к модели.
+// smart — умный режим: ответ сильной модели, см. routeModel.
+func requestGPT(bot *tgbotapi.BotAPI, message *tgbotapi.Message, userQuery string, smart bool) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	settings := getChatSettings(chatID)
+
+	// Проверяем ограничения частоты запросов пользователя и чата
+	if !checkRateLimit(bot, message, gptRateLimits(userID, chatID, settings)...) {
+		return
+	}
+
+	// Проверяем квоты токенов пользователя, чата и бота
+	if !checkQuota(bot, chatID, userID) {
+		return
+	}
+
+	// Запрос к модели выполняется в очереди
+	submitGPTJob(bot, chatID, userID, message.MessageID, func(ctx context.Context) {
+		answerGPT(ctx, bot, message, userQuery, settings, smart)
+	})
+}
 
-		// Проверяем, достигнут ли лимит использования токенов
-		tokenUsageMutex.Lock()
-		if totalTokensUsed >= tokenUsageLimit {
-			tokenUsageMutex.Unlock()
-			response := "Достигнут лимит использования токенов. Попробуйте позже."
-			msg := tgbotapi.NewMessage(chatID, response)
+// Запрашивает ответ модели на вопрос пользователя и отправляет его в чат
+func answerGPT(ctx context.Context, bot *tgbotapi.BotAPI, message *tgbotapi.Message, userQuery string, settings chatSettings, smart bool) {
+	chatID := message.Chat.ID
+
+	// Сообщение, на которое ответил пользователь, входит в вопрос
+	userQuery = withQuotedMessage(bot, message, userQuery)
+
+	// Фото из вопроса или из сообщения, на которое ответили, отправляется модели со зрением
+	question := llmMessage{Role: roleUser, Content: userQuery}
+	savedQuery := userQuery
+	if config.Vision.Enabled {
+		image, err := loadQuestionImage(ctx, bot, message)
+		if err != nil {
+			log.Printf("Ошибка при загрузке фото: %v", err)
+			msg := tgbotapi.NewMessage(chatID, imageErrorMessage(err))
+			msg.ReplyToMessageID = message.MessageID
 			bot.Send(msg)
 			return
 		}
-		tokenUsageMutex.Unlock()
+		if image != nil {
+			question.Images = []llmImage{*image}
+			savedQuery = imageQuestionText(userQuery)
+		}
+	}
 
-		// Отправляем "typing action"
-		typingMsg := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
-		bot.Send(typingMsg)
+	// Модерация проверяет вопрос в том виде, в каком его получит модель:
+	// вместе с цитатой и фото. Заблокированный вопрос не расходует квоты.
+	if err := moderateGPTText(ctx, chatID, message.From, settings, "question", question.Content, question.Images); err != nil {
+		msg := tgbotapi.NewMessage(chatID, moderationBlockedMessage("question", err))
+		msg.ReplyToMessageID = message.MessageID
+		bot.Send(msg)
+		return
+	}
+
+	// Собираем историю диалога
+	history := buildConversationHistory(bot, message, settings)
+	messages := conversationMessages(history, config.GPT.ContextTokens)
+	messages = append(messages, question)
 
-		// Отправляем запрос в OpenAI API
-		responseText, err := getGPTResponse(userQuery)
+	// Если провайдер умеет отдавать ответ по частям, показываем его по мере генерации.
+	// Ответ, который проверяет модерация, показывается только целиком после проверки.
+	if _, ok := llm.(llmStreamer); ok && config.GPT.Stream && !answersModerated(settings) {
+		reply, err := startStreamingReply(bot, chatID, message.MessageID, config.GPT.StreamInterval)
+		if err != nil {
+			log.Printf("Ошибка при отправке ответа GPT: %v", err)
+			return
+		}
+		resp, err := answerWithTools(ctx, bot, message, settings, smart, messages, reply)
 		if err != nil {
 			log.Printf("Ошибка при получении ответа от GPT: %v", err)
-			response := "Извините, произошла ошибка при обработке вашего запроса."
-			msg := tgbotapi.NewMessage(chatID, response)
-			bot.Send(msg)
+			reply.finish(gptErrorMessage(err))
 			return
 		}
+		sentIDs := deliverGPTAnswer(bot, chatID, message.MessageID, reply, resp)
+		saveConversationTurn(chatID, message, savedQuery, sentIDs, resp.Content)
+		return
+	}
+
+	// Отправляем "typing action"
+	typingMsg := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
+	bot.Send(typingMsg)
 
-		// Отправляем ответ обратно в чат
-		msg := tgbotapi.NewMessage(chatID, responseText)
+	resp, err := answerWithTools(ctx, bot, message, settings, smart, messages, nil)
+	if err != nil {
+		log.Printf("Ошибка при получении ответа от GPT: %v", err)
+		msg := tgbotapi.NewMessage(chatID, gptErrorMessage(err))
 		bot.Send(msg)
+		return
 	}
+	if err := moderateGPTText(ctx, chatID, message.From, settings, "answer", resp.Content, nil); err != nil {
+		msg := tgbotapi.NewMessage(chatID, moderationBlockedMessage("answer", err))
+		msg.ReplyToMessageID = message.MessageID
+		bot.Send(msg)
+		return
+	}
+
+	// Отправляем ответ обратно в чат и запоминаем его для продолжения диалога
+	sentIDs := deliverGPTAnswer(bot, chatID, message.MessageID, nil, resp)
+	saveConversationTurn(chatID, message, savedQuery, sentIDs, resp.Content)
 }
 
-// Функция для получения ответа от OpenAI GPT
-func getGPTResponse(prompt string) (string, error) {
-	ctx := context.Background()
-
-	resp, err := openaiClient.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model:     openai.GPT3Dot5Turbo,
-		MaxTokens: 150, // Ограничение длины ответа
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
-	})
-	if err != nil {
-		// Проверяем тип ошибки
-		if apiErr, ok := err.(*openai.APIError); ok {
-			switch apiErr.HTTPStatusCode {
-			case 429:
-				return "", fmt.Errorf("Превышена квота использования API. Пожалуйста, проверьте настройки оплаты в вашем аккаунте OpenAI.")
-			case 401:
-				return "", fmt.Errorf("Недействительный API-ключ OpenAI.")
-			default:
-				return "", fmt.Errorf("Ошибка API OpenAI: %v", apiErr.Message)
+// Отправляет ответ модели: переводит Markdown в HTML, делит длинный текст
+// на несколько сообщений и добавляет кнопку "Продолжить", если ответ
+// оборвался по лимиту токенов. Если передан reply, первая часть заменяет
+// сообщение-заглушку. Возвращает ID отправленных сообщений.
+func deliverGPTAnswer(bot *tgbotapi.BotAPI, chatID int64, replyTo int, reply *streamingReply, resp llmResponse) []int {
+	chunks := splitMarkdown(resp.Content, markdownChunkLimit)
+	if len(chunks) == 0 {
+		chunks = []string{"Модель вернула пустой ответ."}
+	}
+
+	var sentIDs []int
+	for i, chunk := range chunks {
+		var markup *tgbotapi.InlineKeyboardMarkup
+		if i == len(chunks)-1 && resp.FinishReason == "length" {
+			keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Продолжить", "gpt_continue"),
+			))
+			markup = &keyboard
+		}
+
+		if i == 0 && reply != nil {
+			if err := reply.finishFormatted(chunk, markup); err != nil {
+				log.Printf("Ошибка при отправке ответа GPT: %v", err)
 			}
+			sentIDs = append(sentIDs, reply.messageID)
+			continue
 		}
-		return "", err
+
+		messageID, err := sendMarkdownMessage(bot, chatID, replyTo, chunk, markup)
+		if err != nil {
+			log.Printf("Ошибка при отправке ответа GPT: %v", err)
+			break
+		}
+		sentIDs = append(sentIDs, messageID)
 	}
+	return sentIDs
+}
 
-	// Обновляем общее количество использованных токенов
-	tokenUsageMutex.Lock()
-	totalTokensUsed += resp.Usage.TotalTokens
-	tokenUsageMutex.Unlock()
+// Отправляет часть ответа в разметке HTML.
+// Если Telegram не принял разметку, текст отправляется как есть.
+func sendMarkdownMessage(bot *tgbotapi.BotAPI, chatID int64, replyTo int, markdown string, markup *tgbotapi.InlineKeyboardMarkup) (int, error) {
+	msg := newHTMLMessage(chatID, renderMarkdownHTML(markdown))
+	msg.ReplyToMessageID = replyTo
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	sent, err := bot.Send(msg)
+	if err == nil {
+		return sent.MessageID, nil
+	}
 
-	return resp.Choices[0].Message.Content, nil
+	msg = tgbotapi.NewMessage(chatID, markdown)
+	msg.ReplyToMessageID = replyTo
+	if markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	sent, err = bot.Send(msg)
+	return sent.MessageID, err
 }
 
-// Функция сброса использования токенов ежедневно
-func resetTokenUsageDaily() {
-	for {
-		now := time.Now()
-		nextReset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-		durationUntilReset := nextReset.Sub(now)
-		time.Sleep(durationUntilReset)
-		tokenUsageMutex.Lock()
-		totalTokensUsed = 0
-		tokenUsageMutex.Unlock()
+// Обработка кнопки "Продолжить" под ответом, оборвавшимся по лимиту токенов
+func handleContinueCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+	chatID := callback.Message.Chat.ID
+	messageID := callback.Message.MessageID
+	if !featureEnabled(chatID, "gpt") {
+		return
+	}
+
+	chain := loadReplyChain(chatID, messageID)
+	if len(chain) == 0 {
+		bot.Request(tgbotapi.NewCallbackWithAlert(callback.ID, "Не удалось найти этот диалог."))
+		return
+	}
+	settings := getChatSettings(chatID)
+	if result := limiter.take(time.Now(), gptRateLimits(callback.From.ID, chatID, settings)...); !result.Allowed {
+		bot.Request(tgbotapi.NewCallbackWithAlert(callback.ID, rateLimitMessage(result.Wait)))
+		return
+	}
+	if q, exceeded := exceededQuota(callback.From.ID, chatID); exceeded {
+		bot.Request(tgbotapi.NewCallbackWithAlert(callback.ID, quotaExceededMessage(q)))
+		return
+	}
+	bot.Request(tgbotapi.NewCallback(callback.ID, ""))
+
+	// Убираем кнопку, чтобы ответ не продолжили дважды
+	bot.Request(tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	}))
+
+	submitGPTJob(bot, chatID, callback.From.ID, messageID, func(ctx context.Context) {
+		typingMsg := tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping)
+		bot.Send(typingMsg)
+
+		messages := conversationMessages(chain, config.GPT.ContextTokens)
+		messages = append(messages, llmMessage{Role: roleUser, Content: "Продолжи ответ с того места, где он оборвался, без повторов."})
+		resp, err := getGPTResponse(ctx, callback.From.ID, chatID, false, messages, systemPrompt(settings), nil, nil)
+		if err != nil {
+			log.Printf("Ошибка при получении ответа от GPT: %v", err)
+			bot.Send(tgbotapi.NewMessage(chatID, gptErrorMessage(err)))
+			return
+		}
+		if err := moderateGPTText(ctx, chatID, callback.From, settings, "answer", resp.Content, nil); err != nil {
+			bot.Send(tgbotapi.NewMessage(chatID, moderationBlockedMessage("answer", err)))
+			return
+		}
+		sentIDs := deliverGPTAnswer(bot, chatID, messageID, nil, resp)
+		saveContinuation(chatID, messageID, sentIDs, resp.Content)
+	})
+}
+
+func init() {
+	commands.registerCallback("gpt_continue", handleContinueCallback)
+}
+
+// Функция для получения ответа от языковой модели.
+// Если передан onDelta и провайдер поддерживает потоковую генерацию,
+// фрагменты ответа передаются в onDelta по мере поступления.
+// Израсходованные токены записываются на пользователя и чат.
+// Модель выбирает routeModel; smart просит сильную модель.
+// tools — инструменты бота, которые модель может вызвать вместо ответа.
+func getGPTResponse(ctx context.Context, userID, chatID int64, smart bool, conversation []llmMessage, system string, tools []llmTool, onDelta func(delta string)) (llmResponse, error) {
+	messages := []llmMessage{}
+	if system != "" {
+		messages = append(messages, llmMessage{Role: roleSystem, Content: system})
+	}
+	messages = append(messages, conversation...)
+
+	// Оцениваем запрос до отправки: длинный вопрос отклоняем или обрезаем,
+	// а токены запроса и ответа резервируем в квотах
+	toolTokens := estimateToolTokens(tools)
+	limit := config.GPT.MaxPromptTokens
+	if limit > 0 {
+		limit = max(limit-toolTokens, 1)
+	}
+	messages, err := fitPrompt(messages, limit, config.GPT.OversizedPrompt)
+	if err != nil {
+		return llmResponse{}, err
+	}
+	promptTokens := estimatePromptTokens(messages) + toolTokens
+	route := routeModel(userID, chatID, promptTokens, smart, hasImages(messages))
+	// Резерв бюджета считается по цене выбранной модели: запасная дешевле ее
+	reservation, maxTokens, err := reserveUsage(userID, chatID, route.Model, promptTokens, config.GPT.MaxTokens)
+	if err != nil {
+		return llmResponse{}, err
+	}
+	req := llmRequest{
+		Model:     route.Model,
+		MaxTokens: maxTokens, // Ограничение длины ответа
+		Messages:  messages,
+		Tools:     tools,
+	}
+
+	started := time.Now()
+	resp, received, err := callLLM(ctx, req, onDelta)
+	if err != nil && route.Fallback != "" && !received && ctx.Err() == nil {
+		// Сильная модель не ответила: отвечаем дешевой
+		log.Printf("Модель %s не ответила (%v), запрос передан %s", req.Model, err, route.Fallback)
+		auditGPTRequest(started, userID, chatID, req, resp, 0, route.Reason, err)
+		req.Model = route.Fallback
+		route.Reason += ",fallback"
+		started = time.Now()
+		resp, _, err = callLLM(ctx, req, onDelta)
+	}
+	if err != nil {
+		reservation.release()
+		auditGPTRequest(started, userID, chatID, req, resp, 0, route.Reason, err)
+		return llmResponse{}, err
+	}
+
+	// Сверяем резерв с фактическим расходом
+	if resp.Usage.TotalTokens == 0 {
+		resp.Usage.PromptTokens = promptTokens
+		resp.Usage.CompletionTokens = heuristicTokens(resp.Content) + toolCallTokens(resp.ToolCalls)
+		resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	}
+	model := resp.Model
+	if model == "" {
+		model = req.Model
+	}
+	cost := requestCost(model, resp.Usage)
+	reservation.commit(userID, chatID, resp.Usage, cost)
+	auditGPTRequest(started, userID, chatID, req, resp, cost, route.Reason, nil)
+
+	return resp, nil
+}
+
+// Отправляет запрос провайдеру, по возможности в потоковом режиме.
+// received сообщает, успел ли пользователь увидеть часть ответа.
+func callLLM(ctx context.Context, req llmRequest, onDelta func(delta string)) (resp llmResponse, received bool, err error) {
+	streamer, canStream := llm.(llmStreamer)
+	if onDelta == nil || !canStream {
+		resp, err = llm.ChatCompletion(ctx, req)
+		return resp, false, err
+	}
+
+	resp, err = streamer.ChatCompletionStream(ctx, req, func(delta string) {
+		received = true
+		onDelta(delta)
+	})
+	// Обычным запросом повторяем, только если сервер не умеет отдавать поток
+	// или поток оборвала сеть, например прокси. Ошибки ключа, квоты или
+	// самого запроса повторились бы и без потока.
+	if err != nil && !received && (errors.Is(err, errStreamUnsupported) || isTransportError(err)) {
+		log.Printf("Потоковый запрос к %s не удался, повторяем без потока: %v", llm.Name(), err)
+		resp, err = llm.ChatCompletion(ctx, req)
 	}
+	return resp, received, err
 }
@@ -0,0 +1,404 @@
+// gpt_queue.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Как часто проверять очередь на просроченные запросы
+const gptQueueExpireInterval = 5 * time.Second
+
+// Очередь переполнена
+var errQueueFull = errors.New("очередь запросов переполнена")
+
+// Сообщение о запросе, отмененном после maxWait
+const queueExpiredText = "Запрос отменен: слишком долгое ожидание. Попробуйте позже."
+
+// Запрос к модели, ожидающий своей очереди
+type gptJob struct {
+	id       int64
+	chatID   int64
+	userID   int64
+	replyTo  int
+	enqueued time.Time
+	run      func(ctx context.Context)
+
+	noticeID int // сообщение о месте в очереди; 0 — не отправлялось или еще отправляется
+	position int // последнее показанное место в очереди; 0 — сообщения нет
+	started  bool
+	done     bool // запрос отменен или истек
+}
+
+// Очередь запросов к модели: ограничивает число одновременных запросов
+// и по очереди обслуживает чаты, чтобы один шумный чат не занял всех.
+//
+// Отменить ожидающий запрос удалением вопроса нельзя: Bot API не присылает
+// ботам обновлений об удаленных сообщениях. Вместо этого сообщение о месте
+// в очереди несет кнопку «Отменить», а запрос отменяется сам после maxWait.
+type gptQueue struct {
+	mu         sync.Mutex
+	wake       *sync.Cond
+	workers    int
+	maxPending int
+	maxPerChat int
+	maxWait    time.Duration
+	timeout    time.Duration // предельное время выполнения запроса
+
+	nextID  int64
+	running int
+	pending int
+	chats   map[int64][]*gptJob // ожидающие запросы по чатам
+	order   []int64             // чаты с ожидающими запросами в порядке обслуживания
+	jobs    map[int64]*gptJob
+}
+
+// Очередь, в которую handleGPT передает запросы; nil — очередь не запущена
+// и запросы к модели отклоняются
+var gptRequests *gptQueue
+
+// Создает очередь и запускает обработчики согласно настройкам [queue]
+func startGPTQueue(bot *tgbotapi.BotAPI, cfg *Config) *gptQueue {
+	q := &gptQueue{
+		workers:    cfg.Queue.Workers,
+		maxPending: cfg.Queue.MaxPending,
+		maxPerChat: cfg.Queue.MaxPerChat,
+		maxWait:    cfg.Queue.MaxWait,
+		timeout:    cfg.Queue.JobTimeout,
+		chats:      make(map[int64][]*gptJob),
+		jobs:       make(map[int64]*gptJob),
+	}
+	if q.workers <= 0 {
+		q.workers = 1
+	}
+	q.wake = sync.NewCond(&q.mu)
+	for i := 0; i < q.workers; i++ {
+		go q.work(bot)
+	}
+	if q.maxWait > 0 {
+		go q.expirePeriodically(bot)
+	}
+	return q
+}
+
+// Ставит запрос в очередь. Если свободного обработчика нет,
+// сообщает пользователю место в очереди и предлагает отменить запрос.
+func (q *gptQueue) enqueue(bot *tgbotapi.BotAPI, chatID, userID int64, replyTo int, run func(ctx context.Context)) error {
+	q.mu.Lock()
+	if q.maxPending > 0 && q.pending >= q.maxPending {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	if q.maxPerChat > 0 && len(q.chats[chatID]) >= q.maxPerChat {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+
+	q.nextID++
+	job := &gptJob{id: q.nextID, chatID: chatID, userID: userID, replyTo: replyTo, enqueued: time.Now(), run: run}
+	q.jobs[job.id] = job
+	if len(q.chats[chatID]) == 0 {
+		q.order = append(q.order, chatID)
+	}
+	q.chats[chatID] = append(q.chats[chatID], job)
+	q.pending++
+	position := q.positionLocked(job)
+	waits := position > q.workers-q.running
+	if waits {
+		job.position = position
+	}
+	q.wake.Signal()
+	q.mu.Unlock()
+
+	if !waits {
+		return nil
+	}
+
+	msg := tgbotapi.NewMessage(chatID, queuePositionText(position))
+	msg.ReplyToMessageID = replyTo
+	msg.ReplyMarkup = queueCancelMarkup(job.id)
+	sent, err := bot.Send(msg)
+
+	// Пока сообщение отправлялось, запрос мог начаться или истечь.
+	// Обработчик и expire не видели noticeID, поэтому сообщение убирается здесь.
+	q.mu.Lock()
+	if err == nil {
+		job.noticeID = sent.MessageID
+	} else {
+		job.position = 0
+	}
+	started, expired := job.started, job.done
+	q.mu.Unlock()
+	switch {
+	case err != nil && expired:
+		reply := tgbotapi.NewMessage(chatID, queueExpiredText)
+		reply.ReplyToMessageID = replyTo
+		bot.Send(reply)
+	case err != nil:
+	case started:
+		bot.Request(tgbotapi.NewDeleteMessage(chatID, sent.MessageID))
+	case expired:
+		bot.Send(tgbotapi.NewEditMessageText(chatID, sent.MessageID, queueExpiredText))
+	}
+	return nil
+}
+
+// Место запроса в очереди с учетом поочередного обслуживания чатов
+func (q *gptQueue) positionLocked(job *gptJob) int {
+	index := 0
+	for i, queued := range q.chats[job.chatID] {
+		if queued == job {
+			index = i
+			break
+		}
+	}
+
+	// Чаты выше по очереди успеют выполнить на один запрос больше
+	ahead := index
+	before := true
+	for _, chatID := range q.order {
+		if chatID == job.chatID {
+			before = false
+			continue
+		}
+		turns := index
+		if before {
+			turns++
+		}
+		if n := len(q.chats[chatID]); n < turns {
+			turns = n
+		}
+		ahead += turns
+	}
+	return ahead + 1
+}
+
+// Забирает следующий запрос, переходя к следующему чату по кругу
+func (q *gptQueue) nextLocked() *gptJob {
+	for q.pending == 0 {
+		q.wake.Wait()
+	}
+	chatID := q.order[0]
+	q.order = q.order[1:]
+	job := q.chats[chatID][0]
+	q.chats[chatID] = q.chats[chatID][1:]
+	if len(q.chats[chatID]) > 0 {
+		q.order = append(q.order, chatID)
+	} else {
+		delete(q.chats, chatID)
+	}
+	q.pending--
+	return job
+}
+
+// Убирает ожидающий запрос из очереди
+func (q *gptQueue) removeLocked(job *gptJob) {
+	jobs := q.chats[job.chatID]
+	for i, queued := range jobs {
+		if queued != job {
+			continue
+		}
+		q.chats[job.chatID] = append(jobs[:i:i], jobs[i+1:]...)
+		q.pending--
+		break
+	}
+	if len(q.chats[job.chatID]) == 0 {
+		delete(q.chats, job.chatID)
+		for i, chatID := range q.order {
+			if chatID == job.chatID {
+				q.order = append(q.order[:i:i], q.order[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(q.jobs, job.id)
+	job.done = true
+}
+
+// Забирает следующий запрос, удаляет его сообщение о месте в очереди
+// и обновляет места остальных
+func (q *gptQueue) start(bot *tgbotapi.BotAPI) *gptJob {
+	q.mu.Lock()
+	job := q.nextLocked()
+	job.started = true
+	delete(q.jobs, job.id)
+	q.running++
+	noticeID := job.noticeID
+	moved := q.movedLocked()
+	q.mu.Unlock()
+
+	if noticeID != 0 {
+		bot.Request(tgbotapi.NewDeleteMessage(job.chatID, noticeID))
+	}
+	q.updateNotices(bot, moved)
+	return job
+}
+
+// Обработчик: выполняет запросы по одному
+func (q *gptQueue) work(bot *tgbotapi.BotAPI) {
+	for {
+		job := q.start(bot)
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if q.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		}
+		q.runJob(ctx, job)
+		cancel()
+
+		q.mu.Lock()
+		q.running--
+		q.mu.Unlock()
+	}
+}
+
+// Выполняет запрос, не давая панике остановить обработчик
+func (q *gptQueue) runJob(ctx context.Context, job *gptJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Ошибка при выполнении запроса GPT в чате %d: %v", job.chatID, r)
+		}
+	}()
+	job.run(ctx)
+}
+
+// Запросы, место которых в очереди изменилось
+func (q *gptQueue) movedLocked() []*gptJob {
+	var moved []*gptJob
+	for _, jobs := range q.chats {
+		for _, job := range jobs {
+			position := q.positionLocked(job)
+			if job.noticeID != 0 && position != job.position {
+				job.position = position
+				moved = append(moved, job)
+			}
+		}
+	}
+	return moved
+}
+
+// Обновляет сообщения о месте в очереди
+func (q *gptQueue) updateNotices(bot *tgbotapi.BotAPI, jobs []*gptJob) {
+	for _, job := range jobs {
+		q.mu.Lock()
+		position, noticeID, active := job.position, job.noticeID, !job.started && !job.done
+		q.mu.Unlock()
+		if !active {
+			continue
+		}
+		edit := tgbotapi.NewEditMessageTextAndMarkup(job.chatID, noticeID, queuePositionText(position), queueCancelMarkup(job.id))
+		bot.Send(edit)
+	}
+}
+
+// Отменяет ожидающий запрос по кнопке «Отменить» от его автора.
+// Кнопка заменяет отмену удалением вопроса, о котором бот не узнает.
+func (q *gptQueue) cancel(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, jobID int64) {
+	q.mu.Lock()
+	job, ok := q.jobs[jobID]
+	if !ok {
+		q.mu.Unlock()
+		bot.Request(tgbotapi.NewCallback(callback.ID, "Запрос уже выполняется или отменен."))
+		return
+	}
+	if job.userID != callback.From.ID {
+		q.mu.Unlock()
+		bot.Request(tgbotapi.NewCallback(callback.ID, "Отменить запрос может только его автор."))
+		return
+	}
+	q.removeLocked(job)
+	moved := q.movedLocked()
+	q.mu.Unlock()
+
+	bot.Request(tgbotapi.NewCallback(callback.ID, "Запрос отменен."))
+	bot.Request(tgbotapi.NewDeleteMessage(job.chatID, callback.Message.MessageID))
+	q.updateNotices(bot, moved)
+}
+
+// Отменяет запросы, которые ждут дольше maxWait
+func (q *gptQueue) expire(bot *tgbotapi.BotAPI, now time.Time) {
+	q.mu.Lock()
+	var expired []*gptJob
+	for _, job := range q.jobs {
+		if now.Sub(job.enqueued) > q.maxWait {
+			expired = append(expired, job)
+		}
+	}
+	noticeIDs := make([]int, len(expired))
+	noticeSending := make([]bool, len(expired))
+	for i, job := range expired {
+		q.removeLocked(job)
+		noticeIDs[i] = job.noticeID
+		noticeSending[i] = job.noticeID == 0 && job.position > 0
+	}
+	var moved []*gptJob
+	if len(expired) > 0 {
+		moved = q.movedLocked()
+	}
+	q.mu.Unlock()
+
+	for i, job := range expired {
+		if noticeIDs[i] != 0 {
+			bot.Send(tgbotapi.NewEditMessageText(job.chatID, noticeIDs[i], queueExpiredText))
+			continue
+		}
+		if noticeSending[i] {
+			// Сообщение о месте еще отправляется: enqueue заменит его текст
+			continue
+		}
+		msg := tgbotapi.NewMessage(job.chatID, queueExpiredText)
+		msg.ReplyToMessageID = job.replyTo
+		bot.Send(msg)
+	}
+	q.updateNotices(bot, moved)
+}
+
+func (q *gptQueue) expirePeriodically(bot *tgbotapi.BotAPI) {
+	for {
+		time.Sleep(gptQueueExpireInterval)
+		q.expire(bot, time.Now())
+	}
+}
+
+func queuePositionText(position int) string {
+	return fmt.Sprintf("Вы #%d в очереди, ответ скоро будет.", position)
+}
+
+func queueCancelMarkup(jobID int64) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Отменить", fmt.Sprintf("gpt_cancel|%d", jobID)),
+	))
+}
+
+// Выполняет запрос к модели через очередь. Без очереди запрос отклоняется:
+// выполненный сразу, он остановил бы цикл обновлений с играми и командами.
+func submitGPTJob(bot *tgbotapi.BotAPI, chatID, userID int64, replyTo int, run func(ctx context.Context)) {
+	if gptRequests == nil {
+		log.Printf("Запрос к модели в чате %d отклонен: очередь запросов не запущена", chatID)
+		msg := tgbotapi.NewMessage(chatID, "Запросы к модели сейчас недоступны.")
+		msg.ReplyToMessageID = replyTo
+		bot.Send(msg)
+		return
+	}
+	if err := gptRequests.enqueue(bot, chatID, userID, replyTo, run); err != nil {
+		msg := tgbotapi.NewMessage(chatID, "Слишком много запросов, бот не успевает. Попробуйте чуть позже.")
+		msg.ReplyToMessageID = replyTo
+		bot.Send(msg)
+	}
+}
+
+func init() {
+	commands.registerCallback("gpt_cancel", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var jobID int64
+		if gptRequests == nil || !parseCallbackArgs(args, &jobID) {
+			return
+		}
+		gptRequests.cancel(bot, callback, jobID)
+	})
+}
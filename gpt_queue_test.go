@@ -0,0 +1,241 @@
+// gpt_queue_test.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Запрос бота к Telegram: метод и параметры
+type telegramCall struct {
+	Method string
+	Params map[string]string
+}
+
+// Поддельный Telegram, который запоминает запросы бота.
+// На любой метод отвечает новым сообщением со следующим message_id.
+type recordingTelegram struct {
+	mu     sync.Mutex
+	calls  []telegramCall
+	nextID int
+	hook   func(call telegramCall) // вызывается до ответа на запрос
+}
+
+func newRecordingBot(t *testing.T) (*tgbotapi.BotAPI, *recordingTelegram) {
+	t.Helper()
+	telegram := &recordingTelegram{nextID: 100}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		call := telegramCall{Method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], Params: map[string]string{}}
+		for key := range r.Form {
+			call.Params[key] = r.Form.Get(key)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if call.Method == "getMe" {
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"salty","username":"salty_bot"}}`))
+			return
+		}
+		telegram.mu.Lock()
+		telegram.nextID++
+		id := telegram.nextID
+		telegram.calls = append(telegram.calls, call)
+		hook := telegram.hook
+		telegram.mu.Unlock()
+		if hook != nil {
+			hook(call)
+		}
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":%s},"text":%q}}`, id, call.Params["chat_id"], call.Params["text"])
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tgbotapi.NewBotAPIWithClient("test", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, telegram
+}
+
+// Запросы с заданным методом
+func (tg *recordingTelegram) called(method string) []telegramCall {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	var calls []telegramCall
+	for _, call := range tg.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Очередь без запущенных обработчиков: запросы забирает сам тест через start
+func newTestQueue(workers int) *gptQueue {
+	q := &gptQueue{
+		workers: workers,
+		maxWait: time.Minute,
+		chats:   make(map[int64][]*gptJob),
+		jobs:    make(map[int64]*gptJob),
+	}
+	q.wake = sync.NewCond(&q.mu)
+	return q
+}
+
+func noopJob(ctx context.Context) {}
+
+func TestGPTQueueServesChatsInTurn(t *testing.T) {
+	bot, _ := newRecordingBot(t)
+	q := newTestQueue(1)
+	for _, chatID := range []int64{1, 1, 1, 2} {
+		if err := q.enqueue(bot, chatID, 10, 0, noopJob); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var order []int64
+	for i := 0; i < 4; i++ {
+		order = append(order, q.start(bot).chatID)
+	}
+	if fmt.Sprint(order) != "[1 2 1 1]" {
+		t.Errorf("чаты обслужены в порядке %v вместо [1 2 1 1]", order)
+	}
+}
+
+func TestGPTQueueMaxPerChat(t *testing.T) {
+	bot, _ := newRecordingBot(t)
+	q := newTestQueue(1)
+	q.maxPerChat = 2
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	if err := q.enqueue(bot, 1, 10, 0, noopJob); err != errQueueFull {
+		t.Errorf("третий запрос чата: %v вместо errQueueFull", err)
+	}
+	if err := q.enqueue(bot, 2, 10, 0, noopJob); err != nil {
+		t.Errorf("запрос другого чата отклонен: %v", err)
+	}
+}
+
+func TestGPTQueueUpdatesPositions(t *testing.T) {
+	bot, telegram := newRecordingBot(t)
+	q := newTestQueue(1)
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	q.enqueue(bot, 2, 20, 0, noopJob)
+
+	notices := telegram.called("sendMessage")
+	if len(notices) != 2 || !strings.Contains(notices[0].Params["text"], "#2") || !strings.Contains(notices[1].Params["text"], "#2") {
+		t.Fatalf("сообщения о месте в очереди: %+v", notices)
+	}
+
+	// Первый запрос начался: запрос второго чата теперь первый,
+	// а место второго запроса первого чата не изменилось
+	q.start(bot)
+	edits := telegram.called("editMessageText")
+	if len(edits) != 1 || edits[0].Params["chat_id"] != "2" || !strings.Contains(edits[0].Params["text"], "#1") {
+		t.Fatalf("обновленные сообщения: %+v", edits)
+	}
+
+	q.start(bot)
+	if deletes := telegram.called("deleteMessage"); len(deletes) != 1 || deletes[0].Params["chat_id"] != "2" {
+		t.Errorf("сообщение начавшегося запроса не удалено: %+v", deletes)
+	}
+}
+
+func TestGPTQueueCancel(t *testing.T) {
+	bot, telegram := newRecordingBot(t)
+	q := newTestQueue(1)
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	q.enqueue(bot, 1, 10, 0, noopJob)
+	notice := telegram.called("sendMessage")[0]
+	noticeID := 0
+	fmt.Sscan(notice.Params["message_id"], &noticeID)
+
+	var jobID int64
+	for id := range q.jobs {
+		if q.jobs[id].position > 0 {
+			jobID = id
+		}
+	}
+	callback := func(userID int64) *tgbotapi.CallbackQuery {
+		return &tgbotapi.CallbackQuery{ID: "1", From: &tgbotapi.User{ID: userID}, Message: &tgbotapi.Message{MessageID: 101, Chat: &tgbotapi.Chat{ID: 1}}}
+	}
+
+	q.cancel(bot, callback(99), jobID)
+	if q.pending != 2 {
+		t.Fatalf("запрос отменен не автором")
+	}
+	q.cancel(bot, callback(10), jobID)
+	if q.pending != 1 || q.jobs[jobID] != nil {
+		t.Fatalf("запрос не отменен: в очереди %d", q.pending)
+	}
+	if deletes := telegram.called("deleteMessage"); len(deletes) != 1 || deletes[0].Params["message_id"] != "101" {
+		t.Errorf("сообщение о месте не удалено: %+v", deletes)
+	}
+	answers := telegram.called("answerCallbackQuery")
+	if len(answers) != 2 || !strings.Contains(answers[0].Params["text"], "автор") {
+		t.Errorf("ответы на кнопку: %+v", answers)
+	}
+}
+
+func TestGPTQueueExpire(t *testing.T) {
+	bot, telegram := newRecordingBot(t)
+	q := newTestQueue(1)
+	q.enqueue(bot, 1, 10, 5, noopJob) // без сообщения: обработчик свободен
+	q.enqueue(bot, 1, 10, 6, noopJob)
+
+	q.expire(bot, time.Now().Add(2*time.Minute))
+	if q.pending != 0 || len(q.jobs) != 0 {
+		t.Fatalf("в очереди осталось %d запросов", q.pending)
+	}
+	edits := telegram.called("editMessageText")
+	if len(edits) != 1 || edits[0].Params["text"] != queueExpiredText || edits[0].Params["message_id"] != "101" {
+		t.Errorf("сообщение о месте не заменено: %+v", edits)
+	}
+	sent := telegram.called("sendMessage")
+	if len(sent) != 2 || sent[1].Params["text"] != queueExpiredText || sent[1].Params["reply_to_message_id"] != "5" {
+		t.Errorf("об отмене запроса без сообщения не сообщено: %+v", sent)
+	}
+}
+
+func TestGPTQueueNoticeRace(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		finish func(q *gptQueue, bot *tgbotapi.BotAPI)
+		method string
+	}{
+		{"start", func(q *gptQueue, bot *tgbotapi.BotAPI) { q.start(bot) }, "deleteMessage"},
+		{"expire", func(q *gptQueue, bot *tgbotapi.BotAPI) { q.expire(bot, time.Now().Add(2*time.Minute)) }, "editMessageText"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bot, telegram := newRecordingBot(t)
+			q := newTestQueue(1)
+			q.enqueue(bot, 1, 10, 0, noopJob)
+			q.start(bot)
+
+			// Запрос начинается или истекает, пока отправляется сообщение о месте
+			var hooked atomic.Bool
+			telegram.hook = func(call telegramCall) {
+				if call.Method == "sendMessage" && hooked.CompareAndSwap(false, true) {
+					tc.finish(q, bot)
+				}
+			}
+			q.enqueue(bot, 1, 10, 0, noopJob)
+
+			calls := telegram.called(tc.method)
+			if len(calls) != 1 || calls[0].Params["message_id"] != "101" {
+				t.Errorf("сообщение о месте осталось в чате: %+v", telegram.calls)
+			}
+			if tc.name == "expire" && (calls[0].Params["text"] != queueExpiredText || len(telegram.called("sendMessage")) != 1) {
+				t.Errorf("отмена по времени не заменила сообщение о месте: %+v", telegram.calls)
+			}
+		})
+	}
+}
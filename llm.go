@@ -0,0 +1,792 @@
+// llm.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Роли сообщений диалога
+const (
+	roleSystem    = "system"
+	roleUser      = "user"
+	roleAssistant = "assistant"
+	roleTool      = "tool" // результат вызова инструмента
+)
+
+// Сообщение диалога, передаваемое провайдеру
+type llmMessage struct {
+	Role       string
+	Content    string
+	Images     []llmImage    // изображения к вопросу для моделей со зрением
+	ToolCalls  []llmToolCall // инструменты, вызванные моделью в ответе
+	ToolCallID string        // для roleTool: на какой вызов это результат
+}
+
+// Инструмент бота, который модель может вызвать
+type llmTool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage // JSON Schema аргументов
+}
+
+// Вызов инструмента моделью
+type llmToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // аргументы в JSON
+}
+
+// Изображение в запросе
+type llmImage struct {
+	MIMEType string
+	Data     []byte
+	Width    int
+	Height   int
+	Detail   string // low, high или auto
+}
+
+// Запрос на генерацию ответа
+type llmRequest struct {
+	Model     string
+	MaxTokens int
+	Messages  []llmMessage
+	Tools     []llmTool // инструменты, доступные модели; пусто — без инструментов
+}
+
+// Использованные токены
+type llmUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Ответ провайдера
+type llmResponse struct {
+	Content      string
+	ToolCalls    []llmToolCall // модель просит выполнить инструменты вместо ответа
+	FinishReason string
+	Model        string
+	Usage        llmUsage
+}
+
+// Ответ без вариантов: сервер вернул пустой список choices
+var errEmptyResponse = errors.New("модель вернула пустой ответ")
+
+// Сервер отклонил потоковый запрос или ответил не потоком
+var errStreamUnsupported = errors.New("сервер не поддерживает потоковый режим")
+
+// Ошибка провайдера с признаком, есть ли смысл повторить запрос
+type llmError struct {
+	Message   string
+	Status    int  // HTTP-статус, если известен
+	Retryable bool // временная ошибка: лимит запросов, сбой сервера или сети
+	Err       error
+}
+
+func (e *llmError) Error() string {
+	return e.Message
+}
+
+func (e *llmError) Unwrap() error {
+	return e.Err
+}
+
+// Провайдер языковой модели
+type llmProvider interface {
+	// Имя провайдера для логов
+	Name() string
+	// Генерирует ответ на диалог и сообщает израсходованные токены
+	ChatCompletion(ctx context.Context, req llmRequest) (llmResponse, error)
+}
+
+// Провайдер, умеющий отдавать ответ по мере генерации.
+// onDelta вызывается для каждого нового фрагмента текста.
+type llmStreamer interface {
+	ChatCompletionStream(ctx context.Context, req llmRequest, onDelta func(delta string)) (llmResponse, error)
+}
+
+// Запрос на генерацию картинки
+type imageRequest struct {
+	Model   string
+	Prompt  string
+	Size    string
+	Quality string
+}
+
+// Сгенерированная картинка
+type imageResult struct {
+	Data          []byte
+	RevisedPrompt string // промпт, уточненный моделью, если она его меняла
+}
+
+// Провайдер, умеющий рисовать картинки
+type llmImageGenerator interface {
+	GenerateImage(ctx context.Context, req imageRequest) (imageResult, error)
+}
+
+// Результат проверки текста модерацией
+type moderationResult struct {
+	Flagged    bool
+	Categories []string           // нарушенные категории
+	Scores     map[string]float64 // вероятность каждой категории от 0 до 1
+}
+
+// Провайдер, проверяющий текст на недопустимое содержание
+type llmModerator interface {
+	// Проверяет текст вместе с приложенными изображениями
+	Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error)
+}
+
+// Модель модерации, которая проверяет и текст, и изображения
+const omniModerationModel = "omni-moderation-latest"
+
+// Запрос отклонен модерацией
+var errContentFlagged = errors.New("запрос не прошел модерацию")
+
+// Текущий провайдер; nil — функции GPT отключены
+var llm llmProvider
+
+// Генерация картинок, если провайдер ее поддерживает
+var imageGenerator llmImageGenerator
+
+// Создает провайдера по конфигурации.
+// Возвращает nil без ошибки, если провайдер не настроен.
+func newLLMProvider(cfg *Config) (llmProvider, error) {
+	apiKey := cfg.LLM.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+
+	switch cfg.LLM.Provider {
+	case "":
+		// Без явного выбора используем OpenAI, если задан ключ
+		if apiKey == "" {
+			return nil, nil
+		}
+		return &openAIPlatformProvider{newOpenAIProvider("openai", apiKey, openai.DefaultConfig(apiKey))}, nil
+	case "none":
+		return nil, nil
+	case "openai":
+		if apiKey == "" {
+			return nil, errors.New("для провайдера openai нужен OPENAI_API_KEY или [llm] api_key")
+		}
+		return &openAIPlatformProvider{newOpenAIProvider("openai", apiKey, openai.DefaultConfig(apiKey))}, nil
+	case "openai_compatible":
+		// Ollama, llama.cpp server, vLLM и другие серверы с API как у OpenAI.
+		// Картинок и модерации у них обычно нет, поэтому провайдер только отвечает.
+		if cfg.LLM.BaseURL == "" {
+			return nil, errors.New("для провайдера openai_compatible нужен [llm] base_url")
+		}
+		clientConfig := openai.DefaultConfig(apiKey)
+		clientConfig.BaseURL = cfg.LLM.BaseURL
+		return newOpenAIProvider("openai_compatible", apiKey, clientConfig), nil
+	case "mock":
+		return newMockProvider(cfg.LLM.MockResponses...), nil
+	}
+	return nil, fmt.Errorf("неизвестный провайдер %q", cfg.LLM.Provider)
+}
+
+// Модерация провайдера LLM. У OpenAI она есть всегда, а совместимый сервер
+// проверяется, только если [moderation] provider = "openai" выбран явно.
+func providerModeration(cfg *Config, provider llmProvider) llmModerator {
+	if compatible, ok := provider.(*openAIProvider); ok && cfg.Moderation.Provider == "openai" {
+		return openAIModerator{compatible}
+	}
+	moderator, _ := provider.(llmModerator)
+	return moderator
+}
+
+// Провайдер на основе клиента OpenAI: ответы модели, в том числе потоком.
+// Сам по себе используется для OpenAI-совместимых серверов.
+type openAIProvider struct {
+	name    string
+	client  *openai.Client
+	apiKey  string
+	baseURL string // для запросов, которые клиент не поддерживает
+}
+
+func newOpenAIProvider(name, apiKey string, clientConfig openai.ClientConfig) *openAIProvider {
+	return &openAIProvider{
+		name:    name,
+		client:  openai.NewClientWithConfig(clientConfig),
+		apiKey:  apiKey,
+		baseURL: strings.TrimRight(clientConfig.BaseURL, "/"),
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+// Преобразует запрос в формат клиента OpenAI
+func (p *openAIProvider) request(req llmRequest) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+	for _, message := range req.Messages {
+		if len(message.Images) == 0 {
+			converted := openai.ChatCompletionMessage{
+				Role:       message.Role,
+				Content:    message.Content,
+				ToolCallID: message.ToolCallID,
+			}
+			for _, call := range message.ToolCalls {
+				converted.ToolCalls = append(converted.ToolCalls, openai.ToolCall{
+					ID:       call.ID,
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+				})
+			}
+			messages = append(messages, converted)
+			continue
+		}
+
+		// Изображения передаются как data URL рядом с текстом вопроса
+		parts := []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: message.Content}}
+		for _, image := range message.Images {
+			parts = append(parts, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{
+					URL:    "data:" + image.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(image.Data),
+					Detail: openai.ImageURLDetail(image.Detail),
+				},
+			})
+		}
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:         message.Role,
+			MultiContent: parts,
+		})
+	}
+	var tools []openai.Tool
+	for _, tool := range req.Tools {
+		tools = append(tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return openai.ChatCompletionRequest{
+		Model:     req.Model,
+		MaxTokens: req.MaxTokens,
+		Messages:  messages,
+		Tools:     tools,
+	}
+}
+
+// Вызовы инструментов из ответа OpenAI
+func toolCallsFromOpenAI(calls []openai.ToolCall) []llmToolCall {
+	var result []llmToolCall
+	for _, call := range calls {
+		result = append(result, llmToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return result
+}
+
+// Переводит ошибки API в понятные сообщения и отмечает временные
+func openAIError(err error) error {
+	// Проверяем тип ошибки
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.HTTPStatusCode == 429 && (apiErr.Code == "insufficient_quota" || apiErr.Type == "insufficient_quota"):
+			return &llmError{Message: "Превышена квота использования API. Пожалуйста, проверьте настройки оплаты в вашем аккаунте OpenAI.", Status: 429, Err: err}
+		case apiErr.HTTPStatusCode == 429:
+			return &llmError{Message: "Превышен лимит частоты запросов к API OpenAI.", Status: 429, Retryable: true, Err: err}
+		case apiErr.HTTPStatusCode == 401:
+			return &llmError{Message: "Недействительный API-ключ OpenAI.", Status: 401, Err: err}
+		default:
+			return &llmError{
+				Message:   fmt.Sprintf("Ошибка API OpenAI: %v", apiErr.Message),
+				Status:    apiErr.HTTPStatusCode,
+				Retryable: apiErr.HTTPStatusCode >= 500,
+				Err:       err,
+			}
+		}
+	}
+
+	// Ответ без тела ошибки в формате OpenAI, например от прокси
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		status := requestErr.HTTPStatusCode
+		return &llmError{
+			Message:   fmt.Sprintf("Ошибка запроса к API: статус %d", status),
+			Status:    status,
+			Retryable: status == 429 || status >= 500 || status == 0,
+			Err:       err,
+		}
+	}
+
+	// Обрыв соединения и таймауты
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return &llmError{Message: fmt.Sprintf("Сетевая ошибка при запросе к API: %v", err), Retryable: true, Err: err}
+	}
+	return err
+}
+
+func (p *openAIProvider) ChatCompletion(ctx context.Context, req llmRequest) (llmResponse, error) {
+	resp, err := p.client.CreateChatCompletion(ctx, p.request(req))
+	if err != nil {
+		return llmResponse{}, openAIError(err)
+	}
+	if len(resp.Choices) == 0 {
+		return llmResponse{}, errEmptyResponse
+	}
+
+	return llmResponse{
+		Content:      resp.Choices[0].Message.Content,
+		ToolCalls:    toolCallsFromOpenAI(resp.Choices[0].Message.ToolCalls),
+		FinishReason: string(resp.Choices[0].FinishReason),
+		Model:        resp.Model,
+		Usage: llmUsage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+func (p *openAIProvider) ChatCompletionStream(ctx context.Context, req llmRequest, onDelta func(delta string)) (llmResponse, error) {
+	request := p.request(req)
+	request.Stream = true
+	request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		if streamRejected(err) {
+			return llmResponse{}, fmt.Errorf("%w: %v", errStreamUnsupported, err)
+		}
+		return llmResponse{}, openAIError(err)
+	}
+	defer stream.Close()
+
+	var result llmResponse
+	var content strings.Builder
+	var toolCalls []openai.ToolCall // вызовы инструментов приходят по частям
+	chunks := 0
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			if chunks == 0 {
+				// Сервер не понял stream и прислал обычный ответ
+				return llmResponse{}, errStreamUnsupported
+			}
+			break
+		}
+		var syntaxErr *json.SyntaxError
+		if chunks == 0 && (errors.Is(err, openai.ErrTooManyEmptyStreamMessages) || errors.As(err, &syntaxErr)) {
+			return llmResponse{}, fmt.Errorf("%w: %v", errStreamUnsupported, err)
+		}
+		if err != nil {
+			return llmResponse{}, openAIError(err)
+		}
+		chunks++
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = llmUsage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+				TotalTokens:      chunk.Usage.TotalTokens,
+			}
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			result.FinishReason = string(reason)
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			content.WriteString(delta)
+			onDelta(delta)
+		}
+		for _, part := range chunk.Choices[0].Delta.ToolCalls {
+			// Без индекса новый вызов узнается по ID, остальное дописывается к последнему
+			index := len(toolCalls)
+			if part.Index != nil {
+				index = *part.Index
+			} else if part.ID == "" && index > 0 {
+				index--
+			}
+			if index < 0 {
+				continue
+			}
+			for index >= len(toolCalls) {
+				toolCalls = append(toolCalls, openai.ToolCall{})
+			}
+			call := &toolCalls[index]
+			if part.ID != "" {
+				call.ID = part.ID
+			}
+			call.Function.Name += part.Function.Name
+			call.Function.Arguments += part.Function.Arguments
+		}
+	}
+
+	result.Content = content.String()
+	result.ToolCalls = toolCallsFromOpenAI(toolCalls)
+	if result.Usage.TotalTokens == 0 {
+		// Не все совместимые серверы возвращают usage в потоке
+		result.Usage.PromptTokens = estimatePromptTokens(req.Messages) + estimateToolTokens(req.Tools)
+		result.Usage.CompletionTokens = estimateTokens(result.Content) + toolCallTokens(result.ToolCalls)
+		result.Usage.TotalTokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	}
+	return result, nil
+}
+
+// Отклонил ли сервер сам потоковый режим, а не запрос: метод не
+// поддерживается или ошибка прямо говорит о stream
+func streamRejected(err error) bool {
+	status, message := 0, ""
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status, message = apiErr.HTTPStatusCode, apiErr.Message
+	case errors.As(err, &requestErr):
+		status, message = requestErr.HTTPStatusCode, requestErr.Error()
+	default:
+		return false
+	}
+	switch status {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return true
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return strings.Contains(strings.ToLower(message), "stream")
+	}
+	return false
+}
+
+// Сетевой сбой без ответа сервера: обрыв соединения, но не таймаут
+func isTransportError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Провайдер настоящего OpenAI: кроме ответов рисует картинки
+// и проверяет текст модерацией
+type openAIPlatformProvider struct {
+	*openAIProvider
+}
+
+func (p *openAIPlatformProvider) GenerateImage(ctx context.Context, req imageRequest) (imageResult, error) {
+	resp, err := p.client.CreateImage(ctx, openai.ImageRequest{
+		Prompt:         req.Prompt,
+		Model:          req.Model,
+		N:              1,
+		Size:           req.Size,
+		Quality:        req.Quality,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	})
+	if err != nil {
+		var apiErr *openai.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == "content_policy_violation" {
+			return imageResult{}, fmt.Errorf("%w: %s", errContentFlagged, apiErr.Message)
+		}
+		return imageResult{}, openAIError(err)
+	}
+	if len(resp.Data) == 0 {
+		return imageResult{}, errEmptyResponse
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Data[0].B64JSON)
+	if err != nil {
+		return imageResult{}, fmt.Errorf("не удалось декодировать картинку: %w", err)
+	}
+	return imageResult{Data: data, RevisedPrompt: resp.Data[0].RevisedPrompt}, nil
+}
+
+// Один результат модерации: категории и вероятности по названиям из API
+type moderationAPIResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+func (p *openAIPlatformProvider) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	return openAIModerator{p.openAIProvider}.Moderate(ctx, text, images)
+}
+
+// Модерация через /moderations сервера с API OpenAI
+type openAIModerator struct {
+	*openAIProvider
+}
+
+func (p openAIModerator) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	if len(images) > 0 {
+		// Клиент передает в модерацию только текст, изображения отправляем сами
+		results, err := p.moderateMultimodal(ctx, text, images)
+		if err != nil {
+			return moderationResult{}, err
+		}
+		return mergeModerationResults(results), nil
+	}
+
+	resp, err := p.client.Moderations(ctx, openai.ModerationRequest{Input: text})
+	if err != nil {
+		return moderationResult{}, openAIError(err)
+	}
+	var results []moderationAPIResult
+	for _, r := range resp.Results {
+		// Названия категорий берутся из JSON-тегов ответа, например self-harm/intent
+		converted := moderationAPIResult{Flagged: r.Flagged}
+		if raw, err := json.Marshal(r.Categories); err == nil {
+			json.Unmarshal(raw, &converted.Categories)
+		}
+		if raw, err := json.Marshal(r.CategoryScores); err == nil {
+			json.Unmarshal(raw, &converted.CategoryScores)
+		}
+		results = append(results, converted)
+	}
+	return mergeModerationResults(results), nil
+}
+
+// Проверяет текст с изображениями моделью omni-moderation
+func (p openAIModerator) moderateMultimodal(ctx context.Context, text string, images []llmImage) ([]moderationAPIResult, error) {
+	type imageURL struct {
+		URL string `json:"url"`
+	}
+	type inputPart struct {
+		Type     string    `json:"type"`
+		Text     string    `json:"text,omitempty"`
+		ImageURL *imageURL `json:"image_url,omitempty"`
+	}
+	var input []inputPart
+	if text != "" {
+		input = append(input, inputPart{Type: "text", Text: text})
+	}
+	for _, image := range images {
+		input = append(input, inputPart{
+			Type:     "image_url",
+			ImageURL: &imageURL{URL: "data:" + image.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(image.Data)},
+		})
+	}
+	body, err := json.Marshal(map[string]any{"model": omniModerationModel, "input": input})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/moderations", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, &llmError{Message: fmt.Sprintf("Сетевая ошибка при запросе к API: %v", err), Retryable: true, Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &llmError{
+			Message:   fmt.Sprintf("Ошибка запроса к API модерации: статус %d", resp.StatusCode),
+			Status:    resp.StatusCode,
+			Retryable: resp.StatusCode == 429 || resp.StatusCode >= 500,
+		}
+	}
+	var decoded struct {
+		Results []moderationAPIResult `json:"results"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("не удалось разобрать ответ модерации: %w", err)
+	}
+	return decoded.Results, nil
+}
+
+// Сводит результаты модерации по частям запроса в один
+func mergeModerationResults(results []moderationAPIResult) moderationResult {
+	result := moderationResult{Scores: make(map[string]float64)}
+	for _, r := range results {
+		result.Flagged = result.Flagged || r.Flagged
+		for name, flagged := range r.Categories {
+			if flagged && !slices.Contains(result.Categories, name) {
+				result.Categories = append(result.Categories, name)
+			}
+		}
+		for name, score := range r.CategoryScores {
+			result.Scores[name] = max(result.Scores[name], score)
+		}
+	}
+	sort.Strings(result.Categories)
+	return result
+}
+
+// Сколько последних запросов помнит mockProvider
+const maxMockRequests = 100
+
+// Провайдер с заранее заданными ответами для тестов и отладки.
+// Сначала по порядку выдаются ответы, добавленные через script, затем
+// ответы responses по кругу. Последние запросы сохраняются в Requests.
+type mockProvider struct {
+	mu        sync.Mutex
+	responses []string
+	next      int
+	scripted  []mockReply
+	Requests  []llmRequest
+}
+
+// Подготовленный ответ mockProvider: текст, вызовы инструментов или ошибка
+type mockReply struct {
+	Content      string
+	ToolCalls    []llmToolCall
+	FinishReason string // пусто — stop или tool_calls
+	Err          error
+}
+
+// Добавляет ответы, которые провайдер выдаст перед ответами по кругу
+func (p *mockProvider) script(replies ...mockReply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scripted = append(p.scripted, replies...)
+}
+
+// Копия сохраненных запросов
+func (p *mockProvider) requests() []llmRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return slices.Clone(p.Requests)
+}
+
+func newMockProvider(responses ...string) *mockProvider {
+	if len(responses) == 0 {
+		responses = []string{"Это тестовый ответ."}
+	}
+	return &mockProvider{responses: responses}
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+func (p *mockProvider) ChatCompletion(ctx context.Context, req llmRequest) (llmResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return llmResponse{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.respondLocked(req)
+}
+
+// Выдает очередной ответ по словам, имитируя потоковую генерацию
+func (p *mockProvider) ChatCompletionStream(ctx context.Context, req llmRequest, onDelta func(delta string)) (llmResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return llmResponse{}, err
+	}
+
+	p.mu.Lock()
+	resp, err := p.respondLocked(req)
+	p.mu.Unlock()
+	if err != nil {
+		return llmResponse{}, err
+	}
+
+	for i, word := range strings.SplitAfter(resp.Content, " ") {
+		if i > 0 {
+			if err := ctx.Err(); err != nil {
+				return llmResponse{}, err
+			}
+		}
+		onDelta(word)
+	}
+	return resp, nil
+}
+
+// Запоминает запрос и возвращает следующий ответ
+func (p *mockProvider) respondLocked(req llmRequest) (llmResponse, error) {
+	if len(p.Requests) >= maxMockRequests {
+		p.Requests = slices.Delete(p.Requests, 0, len(p.Requests)-maxMockRequests+1)
+	}
+	p.Requests = append(p.Requests, req)
+
+	var reply mockReply
+	if len(p.scripted) > 0 {
+		reply = p.scripted[0]
+		p.scripted = p.scripted[1:]
+	} else {
+		reply.Content = p.responses[p.next%len(p.responses)]
+		p.next++
+	}
+	if reply.Err != nil {
+		return llmResponse{}, reply.Err
+	}
+	finishReason := reply.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+		if len(reply.ToolCalls) > 0 {
+			finishReason = "tool_calls"
+		}
+	}
+
+	promptTokens := 0
+	for _, message := range req.Messages {
+		promptTokens += estimateTokens(message.Content)
+	}
+	completionTokens := estimateTokens(reply.Content) + toolCallTokens(reply.ToolCalls)
+	return llmResponse{
+		Content:      reply.Content,
+		ToolCalls:    reply.ToolCalls,
+		FinishReason: finishReason,
+		Model:        req.Model,
+		Usage: llmUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	}, nil
+}
+
+// Рисует градиент вместо картинки, чтобы /draw можно было проверить без API
+func (p *mockProvider) GenerateImage(ctx context.Context, req imageRequest) (imageResult, error) {
+	if err := ctx.Err(); err != nil {
+		return imageResult{}, err
+	}
+	const size = 256
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(len(req.Prompt)), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return imageResult{}, err
+	}
+	return imageResult{Data: buf.Bytes()}, nil
+}
+
+// Пропускает любой текст
+func (p *mockProvider) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	return moderationResult{}, ctx.Err()
+}
@@ -0,0 +1,252 @@
+// llm_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Бот, отправляющий запросы к API Telegram на тестовый сервер.
+// Сервер отвечает успехом на любой метод.
+func newTestBot(t *testing.T) *tgbotapi.BotAPI {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"salty","username":"salty_bot","message_id":1,"chat":{"id":1}}}`))
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tgbotapi.NewBotAPIWithClient("test", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+// Подменяет провайдера и конфигурацию на время теста
+func useMockProvider(t *testing.T, responses ...string) *mockProvider {
+	t.Helper()
+	useMemoryStore(t)
+	savedLLM, savedConfig := llm, *config
+	mock := newMockProvider(responses...)
+	llm = mock
+	t.Cleanup(func() {
+		llm = savedLLM
+		*config = savedConfig
+	})
+	return mock
+}
+
+func TestNewLLMProviderCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		provider   string
+		images     bool
+		moderation bool
+	}{
+		{"openai", true, true},
+		{"openai_compatible", false, false},
+		{"mock", true, true},
+	} {
+		cfg := defaultConfig()
+		cfg.LLM.Provider = tc.provider
+		cfg.LLM.APIKey = "sk-test"
+		cfg.LLM.BaseURL = "http://localhost:11434/v1"
+		provider, err := newLLMProvider(cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.provider, err)
+		}
+		if _, ok := provider.(llmImageGenerator); ok != tc.images {
+			t.Errorf("%s: генерация картинок %v, ожидалось %v", tc.provider, ok, tc.images)
+		}
+		if moderator := providerModeration(cfg, provider); (moderator != nil) != tc.moderation {
+			t.Errorf("%s: модерация %v, ожидалось %v", tc.provider, moderator != nil, tc.moderation)
+		}
+	}
+
+	// Модерацию совместимого сервера можно включить явно
+	cfg := defaultConfig()
+	cfg.LLM.Provider = "openai_compatible"
+	cfg.LLM.BaseURL = "http://localhost:11434/v1"
+	cfg.Moderation.Provider = "openai"
+	provider, err := newLLMProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if providerModeration(cfg, provider) == nil {
+		t.Errorf("явно выбранная модерация совместимого сервера не подключена")
+	}
+}
+
+func TestMockProviderScript(t *testing.T) {
+	mock := newMockProvider("первый", "второй")
+	failure := &llmError{Message: "сбой", Status: 500, Retryable: true}
+	mock.script(
+		mockReply{Err: failure},
+		mockReply{ToolCalls: []llmToolCall{{ID: "1", Name: "get_stats", Arguments: "{}"}}},
+	)
+	ctx := context.Background()
+
+	if _, err := mock.ChatCompletion(ctx, llmRequest{}); !errors.Is(err, failure) {
+		t.Fatalf("ожидалась подготовленная ошибка, получено %v", err)
+	}
+	resp, err := mock.ChatCompletion(ctx, llmRequest{})
+	if err != nil || len(resp.ToolCalls) != 1 || resp.FinishReason != "tool_calls" {
+		t.Fatalf("ожидался вызов инструмента: %+v, %v", resp, err)
+	}
+	for _, want := range []string{"первый", "второй", "первый"} {
+		if resp, _ := mock.ChatCompletion(ctx, llmRequest{}); resp.Content != want || resp.FinishReason != "stop" {
+			t.Errorf("ответ %q (%s), ожидался %q", resp.Content, resp.FinishReason, want)
+		}
+	}
+
+	mock.script(mockReply{Err: failure})
+	deltas := 0
+	if _, err := mock.ChatCompletionStream(ctx, llmRequest{}, func(string) { deltas++ }); !errors.Is(err, failure) || deltas != 0 {
+		t.Errorf("поток: ошибка %v, фрагментов %d", err, deltas)
+	}
+	var streamed strings.Builder
+	resp, err = mock.ChatCompletionStream(ctx, llmRequest{}, func(delta string) { streamed.WriteString(delta) })
+	if err != nil || streamed.String() != resp.Content {
+		t.Errorf("поток собран в %q, ответ %q, ошибка %v", streamed.String(), resp.Content, err)
+	}
+}
+
+func TestMockProviderRequestsBounded(t *testing.T) {
+	mock := newMockProvider()
+	for i := 0; i < maxMockRequests+10; i++ {
+		mock.ChatCompletion(context.Background(), llmRequest{Model: strings.Repeat("m", i)})
+	}
+	requests := mock.requests()
+	if len(requests) != maxMockRequests {
+		t.Fatalf("сохранено %d запросов вместо %d", len(requests), maxMockRequests)
+	}
+	if last := requests[len(requests)-1]; len(last.Model) != maxMockRequests+9 {
+		t.Errorf("последним сохранен не последний запрос")
+	}
+}
+
+func TestGetGPTResponseRecordsUsage(t *testing.T) {
+	mock := useMockProvider(t, "ответ")
+	config.Routing.StrongModel = ""
+	mock.script(mockReply{Err: &llmError{Message: "неверный ключ", Status: 401}})
+
+	conversation := []llmMessage{{Role: roleUser, Content: "вопрос"}}
+	if _, err := getGPTResponse(context.Background(), 1, 2, false, conversation, "system", nil, nil); err == nil {
+		t.Fatal("ошибка провайдера потеряна")
+	}
+	if len(usageReserved) != 0 {
+		t.Errorf("резерв не снят после ошибки: %v", usageReserved)
+	}
+	if record := todayUsage(1); record.Requests != 0 {
+		t.Errorf("неудачный запрос учтен: %+v", record)
+	}
+
+	resp, err := getGPTResponse(context.Background(), 1, 2, false, conversation, "system", nil, nil)
+	if err != nil || resp.Content != "ответ" {
+		t.Fatalf("ответ %q, ошибка %v", resp.Content, err)
+	}
+	if record := todayUsage(1); record.Requests != 1 || record.total() == 0 {
+		t.Errorf("расход не учтен: %+v", record)
+	}
+	if len(usageReserved) != 0 {
+		t.Errorf("резерв не снят после ответа: %v", usageReserved)
+	}
+	requests := mock.requests()
+	if got := requests[len(requests)-1].Messages; len(got) != 2 || got[0].Role != roleSystem {
+		t.Errorf("системный промпт не передан: %+v", got)
+	}
+}
+
+func TestAnswerWithToolsRunsToolRound(t *testing.T) {
+	mock := useMockProvider(t, "итог")
+	config.Routing.StrongModel = ""
+	config.Tools.Enabled = true
+	config.Tools.MaxRounds = 3
+	mock.script(mockReply{ToolCalls: []llmToolCall{{ID: "call_1", Name: "no_such_tool", Arguments: "{}"}}})
+
+	message := &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 2}}
+	messages := []llmMessage{{Role: roleUser, Content: "вопрос"}}
+	resp, err := answerWithTools(context.Background(), newTestBot(t), message, getChatSettings(2), false, messages, nil)
+	if err != nil || resp.Content != "итог" {
+		t.Fatalf("ответ %q, ошибка %v", resp.Content, err)
+	}
+
+	requests := mock.requests()
+	if len(requests) != 2 {
+		t.Fatalf("запросов к модели %d вместо 2", len(requests))
+	}
+	if len(requests[0].Tools) == 0 {
+		t.Errorf("инструменты не предложены модели")
+	}
+	second := requests[1].Messages
+	last := second[len(second)-1]
+	if last.Role != roleTool || last.ToolCallID != "call_1" || !strings.Contains(last.Content, "недоступен") {
+		t.Errorf("результат инструмента не передан модели: %+v", last)
+	}
+	if call := second[len(second)-2]; len(call.ToolCalls) != 1 {
+		t.Errorf("вызов инструмента не сохранен в истории: %+v", call)
+	}
+	if record := todayUsage(1); record.Requests != 2 {
+		t.Errorf("учтено %d запросов вместо 2", record.Requests)
+	}
+}
+
+func TestCallLLMStreamFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		fallback bool
+	}{
+		{"поток не поддерживается", fmt.Errorf("%w: статус 501", errStreamUnsupported), true},
+		{"обрыв соединения", &llmError{Message: "сеть", Retryable: true, Err: io.ErrUnexpectedEOF}, true},
+		{"неверный ключ", &llmError{Message: "ключ", Status: 401}, false},
+		{"неверный запрос", &llmError{Message: "запрос", Status: 400}, false},
+		{"сбой сервера", &llmError{Message: "сервер", Status: 500, Retryable: true}, false},
+		{"таймаут", &llmError{Message: "таймаут", Retryable: true, Err: context.DeadlineExceeded}, false},
+		{"размыкатель", errCircuitOpen, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := useMockProvider(t, "ответ")
+			mock.script(mockReply{Err: tc.err})
+			resp, received, err := callLLM(context.Background(), llmRequest{}, func(string) {})
+			requests := len(mock.requests())
+			if tc.fallback {
+				if err != nil || resp.Content != "ответ" || requests != 2 {
+					t.Errorf("ожидался повтор без потока: ответ %q, ошибка %v, запросов %d", resp.Content, err, requests)
+				}
+			} else if err == nil || requests != 1 {
+				t.Errorf("запрос повторен без потока: ошибка %v, запросов %d", err, requests)
+			}
+			if received {
+				t.Errorf("received без единого фрагмента")
+			}
+		})
+	}
+}
+
+func TestStreamRejected(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&openai.APIError{HTTPStatusCode: 400, Message: "stream is not supported"}, true},
+		{&openai.APIError{HTTPStatusCode: 501, Message: "not implemented"}, true},
+		{&openai.APIError{HTTPStatusCode: 400, Message: "max_tokens is too large"}, false},
+		{&openai.APIError{HTTPStatusCode: 401, Message: "invalid stream key"}, false},
+		{&openai.RequestError{HTTPStatusCode: 405, Err: errors.New("method not allowed")}, true},
+		{io.ErrUnexpectedEOF, false},
+	} {
+		if got := streamRejected(tc.err); got != tc.want {
+			t.Errorf("streamRejected(%v) = %v, ожидалось %v", tc.err, got, tc.want)
+		}
+	}
+}
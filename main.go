@@ -3,21 +3,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"html"
 	"log"
-	"math/rand"
 	"os"
 	"sort"
-	"strings"
+	"strconv"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-// Карты для хранения соответствий между userID и username
-var usernameToUserID = make(map[string]int64)
-var userIDToUsername = make(map[int64]string)
-
 // Структуры для дуэлей
 var duelRequests = make(map[int64]int64)      // Хранение userID инициатора и оппонента
 var duelParticipants = make(map[int][2]int64) // Хранение пар userID
@@ -34,13 +31,97 @@ type UserStat struct {
 type RussianRouletteGame struct {
 	Participants []int64
 	CurrentIndex int
-	Chambers     [6]bool
+	Chambers     [revolverChambers]bool
 	MessageID    int
 }
 
 var russianRouletteGames = make(map[int]*RussianRouletteGame)
 
 func main() {
+	// Режим воспроизведения игр по зерну, не требующий подключения к Telegram
+	replaySeed := flag.Int64("replay-seed", 0, "смоделировать игры с заданным зерном и вывести распределения")
+	replayGames := flag.Int("replay-games", 10000, "количество моделируемых игр")
+	replayPlayers := flag.Int("replay-players", 3, "количество участников русской рулетки")
+	configPath := flag.String("config", "config.toml", "путь к файлу конфигурации")
+	flag.Parse()
+
+	// Зерно 0 тоже допустимо, поэтому режим включается самим флагом, а не его значением
+	replay := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "replay-seed" {
+			replay = true
+		}
+	})
+	if replay {
+		if *replayGames <= 0 {
+			log.Fatalf("Количество игр -replay-games должно быть положительным")
+		}
+		if *replayPlayers < 2 {
+			log.Fatalf("Для русской рулетки -replay-players нужно не меньше двух участников")
+		}
+		fmt.Print(replayGamesReport(*replaySeed, *replayGames, *replayPlayers))
+		return
+	}
+
+	// Зерно можно зафиксировать через GAME_SEED, чтобы воспроизвести партии
+	seed := time.Now().UnixNano()
+	if value := os.Getenv("GAME_SEED"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatalf("Некорректное значение GAME_SEED: %v", err)
+		}
+		seed = parsed
+	}
+	setGameSeed(seed)
+	log.Printf("Зерно генератора игр: %d", gameSeed)
+
+	// Загружаем конфигурацию и данные чатов
+	if path := os.Getenv("SALTY_CONFIG"); path != "" {
+		*configPath = path
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Ошибка в конфигурации: %v", err)
+	}
+	config = cfg
+	store, err := openStore(config.Storage.Path)
+	if err != nil {
+		log.Fatalf("Не удалось открыть хранилище %s: %v", config.Storage.Path, err)
+	}
+	db = store
+	directory.load()
+	go pruneConversationsPeriodically()
+	go pruneUsagePeriodically()
+	go pruneChatBuffersPeriodically()
+
+	// Подключаем языковую модель; без нее бот работает только с играми
+	provider, err := newLLMProvider(config)
+	if err != nil {
+		log.Fatalf("Ошибка настройки провайдера LLM: %v", err)
+	}
+	if provider != nil {
+		imageGenerator, _ = provider.(llmImageGenerator)
+		if moderator, err = newModerationStage(config, providerModeration(config, provider)); err != nil {
+			log.Fatalf("Ошибка настройки модерации: %v", err)
+		}
+		provider = newResilientProvider(provider, config)
+		if auditLogger, err = openAuditLog(config); err != nil {
+			log.Fatalf("Не удалось открыть журнал запросов: %v", err)
+		}
+	}
+	llm = provider
+	if llm == nil {
+		log.Printf("Провайдер LLM не настроен, функции GPT отключены")
+	} else {
+		log.Printf("Провайдер LLM: %s", llm.Name())
+	}
+	if speech, err = newSpeechProvider(config); err != nil {
+		log.Fatalf("Ошибка настройки распознавания речи: %v", err)
+	}
+	if speech != nil {
+		log.Printf("Распознавание речи: %s", speech.Name())
+	}
+
 	// Получаем токен из переменной окружения
 	token := os.Getenv("TELEGRAM_BOT_TOKEN")
 	if token == "" {
@@ -56,33 +137,43 @@ func main() {
 	bot.Debug = false // Отключаем режим отладки для продакшена
 	log.Printf("Авторизован как %s", bot.Self.UserName)
 
+	// Запросы к модели выполняются в фоне, чтобы не задерживать игры и команды
+	if llm != nil || speech != nil {
+		gptRequests = startGPTQueue(bot, config)
+		go sendBudgetAlerts(bot)
+	}
+
+	// Публикуем список команд в меню Telegram
+	if err := commands.publish(bot); err != nil {
+		log.Printf("Не удалось опубликовать список команд: %v", err)
+	}
+
 	// Создаем канал для получения обновлений от Telegram
 	updateConfig := tgbotapi.NewUpdate(0)
 	updateConfig.Timeout = 60
 	updates := bot.GetUpdatesChan(updateConfig)
 
-	rand.Seed(time.Now().UnixNano())
-	for update := range updates {
-		var userID int64
-		var username string
-
-		if update.Message != nil {
-			userID = update.Message.From.ID
-			username = update.Message.From.UserName
-			if username == "" {
-				username = update.Message.From.FirstName
-			}
-		} else if update.CallbackQuery != nil {
-			userID = update.CallbackQuery.From.ID
-			username = update.CallbackQuery.From.UserName
-			if username == "" {
-				username = update.CallbackQuery.From.FirstName
+	for {
+		// Инструменты модели работают с играми здесь же, между обновлениями,
+		// поэтому состояние игр по-прежнему меняет только этот цикл
+		var update tgbotapi.Update
+		select {
+		case action := <-gameActions:
+			action()
+			continue
+		case received, ok := <-updates:
+			if !ok {
+				return
 			}
+			update = received
 		}
 
-		if username != "" {
-			usernameToUserID[username] = userID
-			userIDToUsername[userID] = username
+		// Обновляем каталог участников чатов
+		if update.Message != nil {
+			observeMessageUsers(update.Message)
+			bufferChatMessage(update.Message)
+		} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+			directory.observe(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.From)
 		}
 
 		// Пропускаем все обновления, которые не содержат сообщений и обратных вызовов
@@ -91,142 +182,146 @@ func main() {
 		}
 
 		if update.Message != nil {
-			// Обработка сообщений GPT
-			handleGPT(bot, update.Message)
-
-			// Обработка команд
-			if update.Message.IsCommand() {
-				switch update.Message.Command() {
-				case "stats":
-					handleStatsCommand(bot, update.Message)
-				}
-				continue
+			// Голосовые сообщения боту расшифровываются, остальные обращения получает GPT
+			if !handleVoice(bot, update.Message) {
+				handleGPT(bot, update.Message)
 			}
 
-			// Обработка сообщений для инициации дуэли или русской рулетки
-			loweredText := strings.ToLower(update.Message.Text)
-			if strings.Contains(loweredText, "дуэль") {
-				handleDuelInitiation(bot, update.Message)
-				continue
-			} else if strings.Contains(loweredText, "рулетка") {
-				handleRouletteInitiation(bot, update.Message)
-				continue
-			}
+			// Обработка команд и ключевых слов
+			commands.dispatch(bot, update.Message)
+			continue
 		}
 
 		// Обработка нажатий на кнопки
-		if update.CallbackQuery != nil {
-			callback := update.CallbackQuery
-			data := callback.Data
-			callbackUserID := callback.From.ID
-			chatID := callback.Message.Chat.ID
-
-			switch {
-			case strings.HasPrefix(data, "accept_duel"):
-				var initiatorID int64
-				var messageID int
-				fmt.Sscanf(data, "accept_duel|%d|%d", &initiatorID, &messageID)
-				handleAcceptDuel(bot, chatID, initiatorID, messageID, callbackUserID)
-			case strings.HasPrefix(data, "reject_duel"):
-				var initiatorID int64
-				fmt.Sscanf(data, "reject_duel|%d", &initiatorID)
-				handleRejectDuel(bot, chatID, callback.From.UserName, initiatorID)
-			case strings.HasPrefix(data, "shoot"):
-				var messageID int
-				fmt.Sscanf(data, "shoot|%d", &messageID)
-				handleShoot(bot, chatID, messageID, callbackUserID)
-			case strings.HasPrefix(data, "accept_roulette"):
-				var initiatorID int64
-				var messageID int
-				fmt.Sscanf(data, "accept_roulette|%d|%d", &initiatorID, &messageID)
-				handleAcceptRoulette(bot, chatID, initiatorID, messageID, callbackUserID)
-			case strings.HasPrefix(data, "reject_roulette"):
-				var initiatorID int64
-				fmt.Sscanf(data, "reject_roulette|%d", &initiatorID)
-				handleRejectRoulette(bot, chatID, callback.From.UserName, initiatorID)
-			case strings.HasPrefix(data, "pull_trigger"):
-				var messageID int
-				fmt.Sscanf(data, "pull_trigger|%d", &messageID)
-				handlePullTrigger(bot, callback, messageID)
+		commands.dispatchCallback(bot, update.CallbackQuery)
+	}
+}
+
+// Регистрация игровых команд и кнопок
+func init() {
+	commands.register(&botCommand{
+		Name:        "duel",
+		Feature:     "games",
+		Usage:       "@пользователь",
+		Description: "Вызвать пользователя на дуэль (или ответьте на его сообщение)",
+		Handler: func(ctx *commandContext) {
+			if checkRateLimit(ctx.Bot, ctx.Message, gameRateLimits(ctx.Message.From.ID, ctx.Message.Chat.ID)...) {
+				handleDuelInitiation(ctx.Bot, ctx.Message)
+			}
+		},
+	})
+	commands.register(&botCommand{
+		Name:        "roulette",
+		Feature:     "games",
+		Usage:       "@пользователь …",
+		Description: "Сыграть в русскую рулетку с одним или несколькими пользователями",
+		Handler: func(ctx *commandContext) {
+			if checkRateLimit(ctx.Bot, ctx.Message, gameRateLimits(ctx.Message.From.ID, ctx.Message.Chat.ID)...) {
+				handleRouletteInitiation(ctx.Bot, ctx.Message)
 			}
+		},
+	})
+	commands.register(&botCommand{
+		Name:        "stats",
+		Aliases:     []string{"top"},
+		Description: "Турнирная таблица",
+		Feature:     "games",
+		Handler: func(ctx *commandContext) {
+			handleStatsCommand(ctx.Bot, ctx.Message)
+		},
+	})
+
+	commands.registerCallback("accept_duel", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var initiatorID int64
+		var messageID int
+		if !parseCallbackArgs(args, &initiatorID, &messageID) {
+			return
 		}
-	}
+		handleAcceptDuel(bot, callback.Message.Chat.ID, initiatorID, messageID, callback.From.ID)
+	})
+	commands.registerCallback("reject_duel", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var initiatorID int64
+		if !parseCallbackArgs(args, &initiatorID) {
+			return
+		}
+		handleRejectDuel(bot, callback.Message.Chat.ID, callback.From.ID, initiatorID)
+	})
+	commands.registerCallback("shoot", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var messageID int
+		if !parseCallbackArgs(args, &messageID) {
+			return
+		}
+		handleShoot(bot, callback.Message.Chat.ID, messageID, callback.From.ID)
+	})
+	commands.registerCallback("accept_roulette", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var initiatorID int64
+		var messageID int
+		if !parseCallbackArgs(args, &initiatorID, &messageID) {
+			return
+		}
+		handleAcceptRoulette(bot, callback.Message.Chat.ID, initiatorID, messageID, callback.From.ID)
+	})
+	commands.registerCallback("reject_roulette", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var initiatorID int64
+		if !parseCallbackArgs(args, &initiatorID) {
+			return
+		}
+		handleRejectRoulette(bot, callback.Message.Chat.ID, callback.From.ID, initiatorID)
+	})
+	commands.registerCallback("pull_trigger", func(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+		var messageID int
+		if !parseCallbackArgs(args, &messageID) {
+			return
+		}
+		handlePullTrigger(bot, callback, messageID)
+	})
 }
 
+// Ответ на сообщение без автора-пользователя, например на пост канала
+const replyWithoutAuthorText = "Вызвать можно только пользователя: у этого сообщения нет автора."
+
 // Обработка инициации дуэли
 func handleDuelInitiation(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	chatID := message.Chat.ID
 	messageID := message.MessageID
-	initiatorID := message.From.ID
-	userFirstName := message.From.FirstName
 
 	// Обработка ответа на сообщение
 	if message.ReplyToMessage != nil {
-		opponentID := message.ReplyToMessage.From.ID
-		opponentUsername := message.ReplyToMessage.From.UserName
-		if opponentUsername == "" {
-			opponentUsername = message.ReplyToMessage.From.FirstName
-		}
-
-		if opponentID == bot.Self.ID {
-			response := "Вы не можете вызвать бота на дуэль!"
-			msg := tgbotapi.NewMessage(chatID, response)
-			bot.Send(msg)
+		opponent := message.ReplyToMessage.From
+		if opponent == nil {
+			bot.Send(tgbotapi.NewMessage(chatID, replyWithoutAuthorText))
 			return
 		}
-
-		if opponentID == initiatorID {
-			response := "Вы не можете вызвать на дуэль самого себя!"
-			msg := tgbotapi.NewMessage(chatID, response)
-			bot.Send(msg)
-			return
+		if refusal := challengeToDuel(bot, chatID, messageID, message.From, opponent.ID); refusal != "" {
+			bot.Send(tgbotapi.NewMessage(chatID, refusal))
 		}
-
-		// Отправляем запрос на дуэль
-		response := fmt.Sprintf("%s вызывает @%s на дуэль! @%s, вы принимаете дуэль?", userFirstName, opponentUsername, opponentUsername)
-		msg := tgbotapi.NewMessage(chatID, response)
-		acceptButton := tgbotapi.NewInlineKeyboardButtonData("Принять", fmt.Sprintf("accept_duel|%d|%d", initiatorID, messageID))
-		rejectButton := tgbotapi.NewInlineKeyboardButtonData("Отказаться", fmt.Sprintf("reject_duel|%d", initiatorID))
-		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(acceptButton, rejectButton))
-		bot.Send(msg)
-		duelRequests[initiatorID] = opponentID
 		return
 	}
 
 	// Обработка упоминаний
-	if len(message.Entities) > 0 {
-		for _, entity := range message.Entities {
-			if entity.Type == "mention" {
-				mentionedUser := message.Text[entity.Offset : entity.Offset+entity.Length]
-				if mentionedUser != "@"+bot.Self.UserName {
-					opponentUsername := strings.TrimPrefix(mentionedUser, "@")
-					opponentUserID, ok := getUserIDByUsername(opponentUsername)
-					if !ok {
-						response := fmt.Sprintf("Не могу найти пользователя %s.", mentionedUser)
-						msg := tgbotapi.NewMessage(chatID, response)
-						bot.Send(msg)
-						continue
-					}
-
-					if opponentUserID == initiatorID {
-						response := "Вы не можете вызвать на дуэль самого себя!"
-						msg := tgbotapi.NewMessage(chatID, response)
-						bot.Send(msg)
-						return
-					}
-
-					// Отправляем запрос на дуэль
-					response := fmt.Sprintf("%s вызывает %s на дуэль! %s, вы принимаете дуэль?", userFirstName, mentionedUser, mentionedUser)
-					msg := tgbotapi.NewMessage(chatID, response)
-					acceptButton := tgbotapi.NewInlineKeyboardButtonData("Принять", fmt.Sprintf("accept_duel|%d|%d", initiatorID, messageID))
-					rejectButton := tgbotapi.NewInlineKeyboardButtonData("Отказаться", fmt.Sprintf("reject_duel|%d", initiatorID))
-					msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(acceptButton, rejectButton))
-					bot.Send(msg)
-					duelRequests[initiatorID] = opponentUserID
-					return
-				}
+	for _, m := range parseMentions(message.Text, message.Entities) {
+		if m.refersTo(bot.Self) {
+			continue
+		}
+
+		var opponentUserID int64
+		if m.User != nil {
+			opponentUserID = m.User.ID
+		} else {
+			userID, ok := directory.resolveUsername(bot, chatID, m.Username)
+			if !ok {
+				response := fmt.Sprintf("Не могу найти пользователя %s.", m.Text)
+				msg := tgbotapi.NewMessage(chatID, response)
+				bot.Send(msg)
+				continue
 			}
+			opponentUserID = userID
 		}
+
+		if refusal := challengeToDuel(bot, chatID, messageID, message.From, opponentUserID); refusal != "" {
+			bot.Send(tgbotapi.NewMessage(chatID, refusal))
+		}
+		return
 	}
 
 	// Если просто написано "дуэль"
@@ -235,14 +330,36 @@ func handleDuelInitiation(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	bot.Send(msg)
 }
 
+// Отправляет вызов на дуэль от initiator пользователю opponentID.
+// Если вызов невозможен, ничего не отправляет и возвращает причину для пользователя.
+func challengeToDuel(bot *tgbotapi.BotAPI, chatID int64, messageID int, initiator *tgbotapi.User, opponentID int64) string {
+	if opponentID == bot.Self.ID {
+		return "Вы не можете вызвать бота на дуэль!"
+	}
+	if opponentID == initiator.ID {
+		return "Вы не можете вызвать на дуэль самого себя!"
+	}
+
+	// Отправляем запрос на дуэль
+	opponent := directory.mention(bot, chatID, opponentID)
+	response := fmt.Sprintf("%s вызывает %s на дуэль! %s, вы принимаете дуэль?", html.EscapeString(initiator.FirstName), opponent, opponent)
+	msg := newHTMLMessage(chatID, response)
+	acceptButton := tgbotapi.NewInlineKeyboardButtonData("Принять", fmt.Sprintf("accept_duel|%d|%d", initiator.ID, messageID))
+	rejectButton := tgbotapi.NewInlineKeyboardButtonData("Отказаться", fmt.Sprintf("reject_duel|%d", initiator.ID))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(acceptButton, rejectButton))
+	bot.Send(msg)
+	duelRequests[initiator.ID] = opponentID
+	return ""
+}
+
 // Обработка принятия дуэли
 func handleAcceptDuel(bot *tgbotapi.BotAPI, chatID int64, initiatorID int64, messageID int, callbackUserID int64) {
 	if opponentID, ok := duelRequests[initiatorID]; ok && callbackUserID == opponentID {
-		response := fmt.Sprintf("Дуэль началась между @%s и @%s!", getUsernameByID(initiatorID), getUsernameByID(opponentID))
-		msg := tgbotapi.NewMessage(chatID, response)
+		response := fmt.Sprintf("Дуэль началась между %s и %s!", directory.mention(bot, chatID, initiatorID), directory.mention(bot, chatID, opponentID))
+		msg := newHTMLMessage(chatID, response)
 		bot.Send(msg)
 		duelParticipants[messageID] = [2]int64{initiatorID, opponentID}
-		currentTurn[messageID] = rand.Intn(2) // Случайно выбираем, кто стреляет первым
+		currentTurn[messageID] = pickFirstShooter(gameRandom, 2) // Случайно выбираем, кто стреляет первым
 		promptNextTurn(bot, chatID, messageID)
 		// Удаляем запрос на дуэль
 		delete(duelRequests, initiatorID)
@@ -250,9 +367,9 @@ func handleAcceptDuel(bot *tgbotapi.BotAPI, chatID int64, initiatorID int64, mes
 }
 
 // Обработка отказа от дуэли
-func handleRejectDuel(bot *tgbotapi.BotAPI, chatID int64, username string, initiatorID int64) {
-	response := fmt.Sprintf("@%s отклонил дуэль.", username)
-	msg := tgbotapi.NewMessage(chatID, response)
+func handleRejectDuel(bot *tgbotapi.BotAPI, chatID int64, userID int64, initiatorID int64) {
+	response := fmt.Sprintf("%s отклонил дуэль.", directory.mention(bot, chatID, userID))
+	msg := newHTMLMessage(chatID, response)
 	bot.Send(msg)
 	delete(duelRequests, initiatorID)
 }
@@ -262,18 +379,14 @@ func handleRouletteInitiation(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	chatID := message.Chat.ID
 	messageID := message.MessageID
 	initiatorID := message.From.ID
-	initiatorUsername := message.From.UserName
-	if initiatorUsername == "" {
-		initiatorUsername = message.From.FirstName
-	}
 
 	// Обработка ответа на сообщение
 	if message.ReplyToMessage != nil {
-		opponentID := message.ReplyToMessage.From.ID
-		opponentUsername := message.ReplyToMessage.From.UserName
-		if opponentUsername == "" {
-			opponentUsername = message.ReplyToMessage.From.FirstName
+		if message.ReplyToMessage.From == nil {
+			bot.Send(tgbotapi.NewMessage(chatID, replyWithoutAuthorText))
+			return
 		}
+		opponentID := message.ReplyToMessage.From.ID
 
 		if opponentID == bot.Self.ID {
 			response := "Вы не можете сыграть с ботом в русскую рулетку!"
@@ -290,8 +403,9 @@ func handleRouletteInitiation(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 		}
 
 		// Отправляем запрос на игру
-		response := fmt.Sprintf("%s предлагает @%s сыграть в русскую рулетку! @%s, вы принимаете вызов?", initiatorUsername, opponentUsername, opponentUsername)
-		msg := tgbotapi.NewMessage(chatID, response)
+		opponent := directory.mention(bot, chatID, opponentID)
+		response := fmt.Sprintf("%s предлагает %s сыграть в русскую рулетку! %s, вы принимаете вызов?", directory.mention(bot, chatID, initiatorID), opponent, opponent)
+		msg := newHTMLMessage(chatID, response)
 		acceptButton := tgbotapi.NewInlineKeyboardButtonData("Принять", fmt.Sprintf("accept_roulette|%d|%d", initiatorID, messageID))
 		rejectButton := tgbotapi.NewInlineKeyboardButtonData("Отказаться", fmt.Sprintf("reject_roulette|%d", initiatorID))
 		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(acceptButton, rejectButton))
@@ -303,13 +417,16 @@ func handleRouletteInitiation(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	// Обработка упоминаний
 	if len(message.Entities) > 0 {
 		participants := []int64{initiatorID}
-		for _, entity := range message.Entities {
-			if entity.Type == "mention" {
-				mentionedUsername := strings.TrimPrefix(message.Text[entity.Offset:entity.Offset+entity.Length], "@")
-				mentionedUserID, ok := getUserIDByUsername(mentionedUsername)
-				if ok && mentionedUserID != initiatorID {
-					participants = append(participants, mentionedUserID)
-				}
+		for _, m := range parseMentions(message.Text, message.Entities) {
+			var mentionedUserID int64
+			var ok bool
+			if m.User != nil {
+				mentionedUserID, ok = m.User.ID, !m.User.IsBot
+			} else {
+				mentionedUserID, ok = directory.resolveUsername(bot, chatID, m.Username)
+			}
+			if ok && mentionedUserID != initiatorID && mentionedUserID != bot.Self.ID {
+				participants = append(participants, mentionedUserID)
 			}
 		}
 
@@ -335,9 +452,9 @@ func handleAcceptRoulette(bot *tgbotapi.BotAPI, chatID int64, initiatorID int64,
 }
 
 // Обработка отказа от русской рулетки
-func handleRejectRoulette(bot *tgbotapi.BotAPI, chatID int64, username string, initiatorID int64) {
-	response := fmt.Sprintf("@%s отклонил игру в русскую рулетку.", username)
-	msg := tgbotapi.NewMessage(chatID, response)
+func handleRejectRoulette(bot *tgbotapi.BotAPI, chatID int64, userID int64, initiatorID int64) {
+	response := fmt.Sprintf("%s отклонил игру в русскую рулетку.", directory.mention(bot, chatID, userID))
+	msg := newHTMLMessage(chatID, response)
 	bot.Send(msg)
 	delete(duelRequests, initiatorID)
 }
@@ -354,20 +471,19 @@ func startRouletteGame(bot *tgbotapi.BotAPI, chatID int64, messageID int, partic
 	// Создаем игру
 	game := &RussianRouletteGame{
 		Participants: participants,
-		CurrentIndex: rand.Intn(len(participants)),
+		CurrentIndex: pickFirstShooter(gameRandom, len(participants)),
 		MessageID:    messageID,
 	}
 
 	// Заряжаем револьвер
-	bulletPosition := rand.Intn(6)
-	game.Chambers[bulletPosition] = true
+	game.Chambers = loadRevolver(gameRandom)
 
 	// Сохраняем игру
 	russianRouletteGames[messageID] = game
 
 	// Уведомляем участников
-	response := fmt.Sprintf("Игра в русскую рулетку началась между %s!", getUsernamesByIDs(participants))
-	msg := tgbotapi.NewMessage(chatID, response)
+	response := fmt.Sprintf("Игра в русскую рулетку началась между %s!", directory.mentions(bot, chatID, participants))
+	msg := newHTMLMessage(chatID, response)
 	bot.Send(msg)
 
 	// Запрашиваем ход первого игрока
@@ -382,8 +498,8 @@ func promptNextRouletteTurn(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
 	}
 
 	shooterID := game.Participants[game.CurrentIndex]
-	response := fmt.Sprintf("Сейчас очередь @%s. Нажмите 'Спустить курок', чтобы сделать ход.", getUsernameByID(shooterID))
-	msg := tgbotapi.NewMessage(chatID, response)
+	response := fmt.Sprintf("Сейчас очередь %s. Нажмите 'Спустить курок', чтобы сделать ход.", directory.mention(bot, chatID, shooterID))
+	msg := newHTMLMessage(chatID, response)
 	pullTriggerButton := tgbotapi.NewInlineKeyboardButtonData("Спустить курок", fmt.Sprintf("pull_trigger|%d", messageID))
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(pullTriggerButton))
 	bot.Send(msg)
@@ -400,18 +516,18 @@ func handlePullTrigger(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, m
 
 	if callback.From.ID != shooterID {
 		// Не тот игрок
-		response := fmt.Sprintf("Сейчас не ваша очередь, @%s!", getUsernameByID(callback.From.ID))
-		msg := tgbotapi.NewMessage(callback.Message.Chat.ID, response)
+		response := fmt.Sprintf("Сейчас не ваша очередь, %s!", directory.mention(bot, callback.Message.Chat.ID, callback.From.ID))
+		msg := newHTMLMessage(callback.Message.Chat.ID, response)
 		bot.Send(msg)
 		return
 	}
 
 	// Проверяем, есть ли пуля в текущей каморе
-	chamberIndex := rand.Intn(6)
+	chamberIndex := spinChamber(gameRandom)
 	if game.Chambers[chamberIndex] {
 		// Игрок проиграл
-		response := fmt.Sprintf("Бах! @%s проиграл в русскую рулетку!", getUsernameByID(shooterID))
-		msg := tgbotapi.NewMessage(callback.Message.Chat.ID, response)
+		response := fmt.Sprintf("Бах! %s проиграл в русскую рулетку!", directory.mention(bot, callback.Message.Chat.ID, shooterID))
+		msg := newHTMLMessage(callback.Message.Chat.ID, response)
 		bot.Send(msg)
 
 		// Обновляем статистику
@@ -426,8 +542,8 @@ func handlePullTrigger(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, m
 		// Проверяем, остался ли победитель
 		if len(game.Participants) == 1 {
 			winnerID := game.Participants[0]
-			response := fmt.Sprintf("@%s победил в русской рулетке!", getUsernameByID(winnerID))
-			msg := tgbotapi.NewMessage(callback.Message.Chat.ID, response)
+			response := fmt.Sprintf("%s победил в русской рулетке!", directory.mention(bot, callback.Message.Chat.ID, winnerID))
+			msg := newHTMLMessage(callback.Message.Chat.ID, response)
 			bot.Send(msg)
 
 			// Обновляем статистику победителя
@@ -453,8 +569,8 @@ func handlePullTrigger(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, m
 		}
 	} else {
 		// Игрок выжил
-		response := fmt.Sprintf("Щелчок! @%s повезло, игра продолжается.", getUsernameByID(shooterID))
-		msg := tgbotapi.NewMessage(callback.Message.Chat.ID, response)
+		response := fmt.Sprintf("Щелчок! %s повезло, игра продолжается.", directory.mention(bot, callback.Message.Chat.ID, shooterID))
+		msg := newHTMLMessage(callback.Message.Chat.ID, response)
 		bot.Send(msg)
 
 		// Переходим к следующему игроку
@@ -469,9 +585,8 @@ func promptNextTurn(bot *tgbotapi.BotAPI, chatID int64, messageID int) {
 	participants := duelParticipants[messageID]
 	turn := currentTurn[messageID]
 	shooterID := participants[turn]
-	shooterUsername := getUsernameByID(shooterID)
-	response := fmt.Sprintf("@%s, ваша очередь стрелять!", shooterUsername)
-	msg := tgbotapi.NewMessage(chatID, response)
+	response := fmt.Sprintf("%s, ваша очередь стрелять!", directory.mention(bot, chatID, shooterID))
+	msg := newHTMLMessage(chatID, response)
 	shootButton := tgbotapi.NewInlineKeyboardButtonData("Выстрелить", fmt.Sprintf("shoot|%d", messageID))
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(shootButton))
 	bot.Send(msg)
@@ -489,14 +604,14 @@ func handleShoot(bot *tgbotapi.BotAPI, chatID int64, messageID int, shooterID in
 
 	// Проверяем, что стреляет правильный игрок
 	if shooterID != expectedShooterID {
-		response := fmt.Sprintf("@%s, сейчас не ваша очередь!", getUsernameByID(shooterID))
-		msg := tgbotapi.NewMessage(chatID, response)
+		response := fmt.Sprintf("%s, сейчас не ваша очередь!", directory.mention(bot, chatID, shooterID))
+		msg := newHTMLMessage(chatID, response)
 		bot.Send(msg)
 		return
 	}
 
 	// Случайное решение, выстрел успешен или нет
-	if rand.Intn(2) == 0 {
+	if duelShotHits(gameRandom) {
 		opponentID := participants[1-turn]
 
 		// Обновляем статистику победителя
@@ -511,8 +626,8 @@ func handleShoot(bot *tgbotapi.BotAPI, chatID int64, messageID int, shooterID in
 		}
 		userStats[opponentID].Losses++
 
-		response := fmt.Sprintf("@%s победил в дуэли!", getUsernameByID(shooterID))
-		msg := tgbotapi.NewMessage(chatID, response)
+		response := fmt.Sprintf("%s победил в дуэли!", directory.mention(bot, chatID, shooterID))
+		msg := newHTMLMessage(chatID, response)
 		bot.Send(msg)
 		delete(duelParticipants, messageID)
 		delete(currentTurn, messageID)
@@ -523,28 +638,11 @@ func handleShoot(bot *tgbotapi.BotAPI, chatID int64, messageID int, shooterID in
 	}
 }
 
-// Получение userID по username
-func getUserIDByUsername(username string) (int64, bool) {
-	userID, ok := usernameToUserID[username]
-	return userID, ok
-}
-
-// Получение username по userID
-func getUsernameByID(userID int64) string {
-	username, ok := userIDToUsername[userID]
-	if ok {
-		return username
-	}
-	return fmt.Sprintf("%d", userID)
-}
-
-// Получение списка usernames по списку userIDs
-func getUsernamesByIDs(userIDs []int64) string {
-	var usernames []string
-	for _, userID := range userIDs {
-		usernames = append(usernames, "@"+getUsernameByID(userID))
-	}
-	return strings.Join(usernames, ", ")
+// Создает сообщение с разметкой HTML
+func newHTMLMessage(chatID int64, text string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = tgbotapi.ModeHTML
+	return msg
 }
 
 // Функция для вывода общей статистики в виде турнирной таблицы
@@ -561,16 +659,16 @@ func handleStatsCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 
 	// Создаем срез для сортировки
 	type StatEntry struct {
-		Username string
-		Wins     int
-		Losses   int
+		Mention string
+		Wins    int
+		Losses  int
 	}
 	var stats []StatEntry
 	for userID, stat := range userStats {
 		stats = append(stats, StatEntry{
-			Username: getUsernameByID(userID),
-			Wins:     stat.Wins,
-			Losses:   stat.Losses,
+			Mention: directory.mention(bot, chatID, userID),
+			Wins:    stat.Wins,
+			Losses:  stat.Losses,
 		})
 	}
 
@@ -582,9 +680,9 @@ func handleStatsCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
 	// Формируем сообщение со статистикой
 	response := "Турнирная таблица:\n"
 	for i, entry := range stats {
-		response += fmt.Sprintf("%d. @%s - Побед: %d, Поражений: %d\n", i+1, entry.Username, entry.Wins, entry.Losses)
+		response += fmt.Sprintf("%d. %s - Побед: %d, Поражений: %d\n", i+1, entry.Mention, entry.Wins, entry.Losses)
 	}
 
-	msg := tgbotapi.NewMessage(chatID, response)
+	msg := newHTMLMessage(chatID, response)
 	bot.Send(msg)
 }
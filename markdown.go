@@ -0,0 +1,258 @@
+// markdown.go
+
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Ограничение длины одной части ответа в исходной разметке.
+// Видимый текст после разбора разметки не длиннее исходного,
+// поэтому часть гарантированно укладывается в лимит Telegram.
+const markdownChunkLimit = telegramMessageLimit - 96
+
+// Правила форматирования строк вне блоков кода.
+// Применяются к уже экранированному тексту, поэтому символы <, > и & в них не встречаются.
+var (
+	markdownInlineCode = regexp.MustCompile("`([^`\n]+)`")
+	markdownBold       = regexp.MustCompile(`\*\*([^*\n]+)\*\*|__([^_\n]+)__`)
+	markdownItalic     = regexp.MustCompile(`(^|[^\p{L}\p{N}*_])(?:\*([^*\s][^*\n]*?)\*|_([^_\s][^_\n]*?)_)($|[^\p{L}\p{N}*_])`)
+	markdownStrike     = regexp.MustCompile(`~~([^~\n]+)~~`)
+	markdownLink       = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^)\s]+)\)`)
+	markdownHeading    = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	markdownBullet     = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	markdownQuote      = regexp.MustCompile(`^&gt;\s?(.*)$`)
+	markdownFence      = regexp.MustCompile("^\\s*```\\s*([\\w+#.-]*)\\s*$")
+	markdownTag        = regexp.MustCompile(`</?(\w+)[^>]*>`)
+)
+
+// Преобразует Markdown из ответа модели в HTML, который понимает Telegram:
+// блоки и фрагменты кода, жирный, курсив, зачеркнутый текст, ссылки,
+// заголовки, списки и цитаты. Весь остальной текст экранируется.
+func renderMarkdownHTML(markdown string) string {
+	var out strings.Builder
+	lines := strings.Split(markdown, "\n")
+	inCode := false
+	for i, line := range lines {
+		if match := markdownFence.FindStringSubmatch(line); match != nil {
+			if !inCode {
+				if match[1] != "" {
+					out.WriteString(`<pre><code class="language-` + html.EscapeString(match[1]) + `">`)
+				} else {
+					out.WriteString("<pre><code>")
+				}
+			} else {
+				out.WriteString("</code></pre>")
+			}
+			inCode = !inCode
+			if !inCode && i+1 < len(lines) {
+				out.WriteString("\n")
+			}
+			continue
+		}
+
+		if inCode {
+			out.WriteString(html.EscapeString(line))
+		} else {
+			out.WriteString(renderMarkdownLine(line))
+		}
+		if i+1 < len(lines) {
+			out.WriteString("\n")
+		}
+	}
+	if inCode {
+		// Модель не закрыла блок кода
+		out.WriteString("</code></pre>")
+	}
+	return out.String()
+}
+
+// Форматирует одну строку текста вне блока кода
+func renderMarkdownLine(line string) string {
+	line = html.EscapeString(line)
+
+	if match := markdownHeading.FindStringSubmatch(line); match != nil {
+		return "<b>" + renderMarkdownInline(match[1]) + "</b>"
+	}
+	if match := markdownQuote.FindStringSubmatch(line); match != nil {
+		return "<blockquote>" + renderMarkdownInline(match[1]) + "</blockquote>"
+	}
+	line = markdownBullet.ReplaceAllString(line, "$1• ")
+	return renderMarkdownInline(line)
+}
+
+// Форматирует выделения внутри строки, не трогая фрагменты кода
+func renderMarkdownInline(line string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range markdownInlineCode.FindAllStringSubmatchIndex(line, -1) {
+		out.WriteString(renderMarkdownEmphasis(line[last:loc[0]]))
+		out.WriteString("<code>" + line[loc[2]:loc[3]] + "</code>")
+		last = loc[1]
+	}
+	out.WriteString(renderMarkdownEmphasis(line[last:]))
+	return out.String()
+}
+
+// Форматирует выделения вне фрагментов кода. Адреса ссылок вырезаются
+// до разбора выделений: символы * и _ в них не должны становиться курсивом.
+func renderMarkdownEmphasis(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range markdownLink.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(renderMarkdownStyles(text[last:loc[0]]))
+		out.WriteString(`<a href="` + text[loc[4]:loc[5]] + `">` + renderMarkdownStyles(text[loc[2]:loc[3]]) + "</a>")
+		last = loc[1]
+	}
+	out.WriteString(renderMarkdownStyles(text[last:]))
+	return out.String()
+}
+
+// Жирный, зачеркнутый текст и курсив
+func renderMarkdownStyles(text string) string {
+	text = markdownBold.ReplaceAllStringFunc(text, func(match string) string {
+		return "<b>" + match[2:len(match)-2] + "</b>"
+	})
+	// Выделение, пересекающее уже размеченное, например **a _b** c_,
+	// остается как есть: такой HTML Telegram не принимает
+	text = markdownStrike.ReplaceAllStringFunc(text, func(match string) string {
+		inner := match[2 : len(match)-2]
+		if !tagsBalanced(inner) {
+			return match
+		}
+		return "<s>" + inner + "</s>"
+	})
+	// Второй проход нужен для соседних выделений: граница между ними
+	// поглощается первым совпадением
+	for i := 0; i < 2; i++ {
+		text = markdownItalic.ReplaceAllStringFunc(text, func(match string) string {
+			parts := markdownItalic.FindStringSubmatch(match)
+			inner := parts[2] + parts[3]
+			if !tagsBalanced(inner) {
+				return match
+			}
+			return parts[1] + "<i>" + inner + "</i>" + parts[4]
+		})
+	}
+	return text
+}
+
+// Проверяет, что каждый тег во фрагменте закрыт внутри него же
+// и теги не пересекаются
+func tagsBalanced(text string) bool {
+	var open []string
+	for _, tag := range markdownTag.FindAllStringSubmatch(text, -1) {
+		if tag[0][1] != '/' {
+			open = append(open, tag[1])
+			continue
+		}
+		if len(open) == 0 || open[len(open)-1] != tag[1] {
+			return false
+		}
+		open = open[:len(open)-1]
+	}
+	return len(open) == 0
+}
+
+// Делит ответ на части не длиннее limit символов.
+// Разрывы делаются между абзацами или строками, длинные строки делятся
+// по предложениям и словам. Блок кода, попавший на границу, закрывается
+// в одной части и открывается заново в следующей.
+func splitMarkdown(markdown string, limit int) []string {
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+	fence := "" // открывающая строка блока кода, внутри которого мы находимся
+	// Смещения в current начала открывающей строки блока и его содержимого
+	fenceStart, bodyStart := 0, 0
+
+	flush := func() {
+		text := current.String()
+		switch {
+		case fence != "" && current.Len() == bodyStart:
+			// В части только открывающая строка: блок целиком переходит в следующую
+			text = text[:fenceStart]
+		case fence != "":
+			text = strings.TrimRight(text, "\n") + "\n```"
+		}
+		if strings.TrimSpace(text) != "" {
+			chunks = append(chunks, strings.TrimRight(text, "\n"))
+		}
+		current.Reset()
+		currentLen = 0
+		if fence != "" {
+			current.WriteString(fence + "\n")
+			currentLen = utf8.RuneCountInString(fence) + 1
+			fenceStart, bodyStart = 0, current.Len()
+		}
+	}
+
+	// Запас на закрытие блока кода в конце части
+	reserve := len("\n```")
+	for _, line := range strings.Split(markdown, "\n") {
+		if fence != "" && markdownFence.MatchString(line) {
+			// Закрывающая строка занимает место, отложенное под закрытие блока,
+			// поэтому всегда помещается в текущую часть. Перенесенная в следующую,
+			// она дала бы там пустой блок кода.
+			current.WriteString("```\n")
+			currentLen += reserve
+			fence = ""
+			continue
+		}
+		for _, piece := range splitLongLine(line, limit-reserve-utf8.RuneCountInString(fence)-1) {
+			pieceLen := utf8.RuneCountInString(piece) + 1
+			if currentLen+pieceLen+reserve > limit {
+				flush()
+			}
+			current.WriteString(piece + "\n")
+			currentLen += pieceLen
+		}
+		if markdownFence.MatchString(line) {
+			fence = strings.TrimSpace(line)
+			bodyStart = current.Len()
+			fenceStart = bodyStart - len(line) - 1
+		}
+	}
+	fence = ""
+	flush()
+	return chunks
+}
+
+// Делит строку длиннее limit по концам предложений, затем по пробелам
+func splitLongLine(line string, limit int) []string {
+	if limit <= 0 || utf8.RuneCountInString(line) <= limit {
+		return []string{line}
+	}
+	var pieces []string
+	runes := []rune(line)
+	for len(runes) > limit {
+		cut := lastBreak(runes[:limit], ". ", "! ", "? ", "; ")
+		if cut <= limit/2 {
+			cut = lastBreak(runes[:limit], " ")
+		}
+		if cut <= 0 {
+			cut = limit
+		}
+		pieces = append(pieces, strings.TrimRight(string(runes[:cut]), " "))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+	}
+	return append(pieces, string(runes))
+}
+
+// Возвращает позицию сразу после последнего найденного разделителя
+func lastBreak(runes []rune, separators ...string) int {
+	text := string(runes)
+	best := -1
+	for _, separator := range separators {
+		if i := strings.LastIndex(text, separator); i >= 0 {
+			position := utf8.RuneCountInString(text[:i]) + utf8.RuneCountInString(separator)
+			if position > best {
+				best = position
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,115 @@
+// markdown_test.go
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	for _, tc := range []struct {
+		markdown string
+		want     string
+	}{
+		{"**жирный** и *курсив*", "<b>жирный</b> и <i>курсив</i>"},
+		{"snake_case_name", "snake_case_name"},
+		{"`a_b_c` и _да_", "<code>a_b_c</code> и <i>да</i>"},
+		{"[документация](https://example.com/_private_/a*b*)", `<a href="https://example.com/_private_/a*b*">документация</a>`},
+		{"[*подпись*](https://example.com/x_y_) и _курсив_", `<a href="https://example.com/x_y_"><i>подпись</i></a> и <i>курсив</i>`},
+		{"```go\nx := a_b_\n```", "<pre><code class=\"language-go\">x := a_b_\n</code></pre>"},
+		{"> цитата с <тегом>", "<blockquote>цитата с &lt;тегом&gt;</blockquote>"},
+		// Пересекающиеся выделения не должны давать неверно вложенные теги
+		{"**a _b** c_", "<b>a _b</b> c_"},
+		{"_a **b_ c**", "_a <b>b_ c</b>"},
+		{"~~a **b~~ c**", "~~a <b>b~~ c</b>"},
+		{"_a **b** c_", "<i>a <b>b</b> c</i>"},
+	} {
+		if got := renderMarkdownHTML(tc.markdown); got != tc.want {
+			t.Errorf("renderMarkdownHTML(%q) = %q вместо %q", tc.markdown, got, tc.want)
+		}
+	}
+}
+
+// Проверяет, что части не длиннее limit и блоки кода в каждой закрыты
+func checkChunks(t *testing.T, chunks []string, limit int) {
+	t.Helper()
+	for i, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > limit {
+			t.Errorf("часть %d длиной %d больше %d", i, n, limit)
+		}
+		if html := renderMarkdownHTML(chunk); utf8.RuneCountInString(html) > telegramMessageLimit {
+			t.Errorf("часть %d после разметки длиннее лимита Telegram", i)
+		}
+		fences := 0
+		for _, line := range strings.Split(chunk, "\n") {
+			if markdownFence.MatchString(line) {
+				fences++
+			}
+		}
+		if fences%2 != 0 {
+			t.Errorf("в части %d не закрыт блок кода:\n%s", i, chunk)
+		}
+		if strings.Contains(chunk, "```go\n```") {
+			t.Errorf("в части %d пустой блок кода", i)
+		}
+	}
+}
+
+func TestSplitMarkdownTelegramLimit(t *testing.T) {
+	paragraph := strings.Repeat("Слово ", 150)
+	markdown := strings.Repeat(paragraph+"\n\n", 10)
+	chunks := splitMarkdown(markdown, markdownChunkLimit)
+	if len(chunks) < 2 {
+		t.Fatalf("текст из %d символов не разделен", utf8.RuneCountInString(markdown))
+	}
+	checkChunks(t, chunks, markdownChunkLimit)
+	if got := strings.Join(strings.Fields(strings.Join(chunks, " ")), " "); got != strings.Join(strings.Fields(markdown), " ") {
+		t.Errorf("при делении потерян текст")
+	}
+}
+
+func TestSplitMarkdownReopensFence(t *testing.T) {
+	markdown := "Код:\n```go\n" + strings.Repeat("x := 1\n", 20) + "```\nКонец."
+	chunks := splitMarkdown(markdown, 60)
+	checkChunks(t, chunks, 60)
+	if len(chunks) < 3 {
+		t.Fatalf("блок кода не разделен: %q", chunks)
+	}
+	for _, chunk := range chunks[1 : len(chunks)-1] {
+		if !strings.HasPrefix(chunk, "```go\n") {
+			t.Errorf("часть внутри блока не открывает его заново: %q", chunk)
+		}
+	}
+}
+
+func TestSplitMarkdownClosingFenceAtBoundary(t *testing.T) {
+	// Закрывающая строка попадает ровно на границу части
+	for limit := 20; limit <= 40; limit++ {
+		markdown := "```go\n" + strings.Repeat("a", limit-len("```go\n")-len("\n```")) + "\n```\nтекст"
+		chunks := splitMarkdown(markdown, limit)
+		checkChunks(t, chunks, limit)
+		if last := chunks[len(chunks)-1]; last != "текст" {
+			t.Errorf("limit %d: после блока кода часть %q", limit, last)
+		}
+	}
+}
+
+func TestSplitLongLine(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		limit int
+		want  []string
+	}{
+		{"Первое предложение. Второе предложение.", 25, []string{"Первое предложение.", "Второе предложение."}},
+		{"один два три четыре пять", 10, []string{"один два", "три", "четыре", "пять"}},
+		{"абвгдежзий", 4, []string{"абвг", "дежз", "ий"}},
+		{"короткая", 20, []string{"короткая"}},
+	} {
+		got := splitLongLine(tc.line, tc.limit)
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("splitLongLine(%q, %d) = %q вместо %q", tc.line, tc.limit, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// moderation.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Раздел хранилища с журналом срабатываний модерации по чатам
+const moderationBucket = "moderation_incidents"
+
+// Сколько последних срабатываний хранить на чат
+const maxModerationIncidents = 50
+
+// Уровни строгости модерации
+const (
+	moderationOff    = "off"    // проверка отключена
+	moderationLow    = "low"    // блокируются только самые тяжелые категории
+	moderationMedium = "medium" // блокируется все, что отметил модератор
+	moderationHigh   = "high"   // блокируется и то, что модератор счел сомнительным
+)
+
+var moderationLevels = []string{moderationOff, moderationLow, moderationMedium, moderationHigh}
+
+// Категории, которые блокируются даже на уровне low
+var severeCategories = map[string]bool{
+	"sexual/minors":          true,
+	"self-harm/instructions": true,
+	"hate/threatening":       true,
+	"harassment/threatening": true,
+	"violence/graphic":       true,
+	"keyword":                true,
+}
+
+// На уровне high блокируется категория с вероятностью не ниже этой
+const strictModerationScore = 0.3
+
+// Модерация запросов; nil — модерация не настроена
+var moderator llmModerator
+
+// Модератор не ответил, а строгость чата не позволяет пропустить текст без проверки
+var errModerationFailed = errors.New("модерация временно недоступна")
+
+// Защищает журнал срабатываний при параллельных запросах
+var moderationMutex sync.Mutex
+
+// Локальный фильтр по регулярным выражениям из [moderation] patterns.
+// Совпадение относится к категории keyword и блокируется на любом уровне.
+type keywordModerator struct {
+	patterns []*regexp.Regexp
+}
+
+func newKeywordModerator(patterns []string) (*keywordModerator, error) {
+	m := &keywordModerator{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("неверный шаблон модерации %q: %w", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+func (m *keywordModerator) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	for _, re := range m.patterns {
+		if re.MatchString(text) {
+			return moderationResult{
+				Flagged:    true,
+				Categories: []string{"keyword"},
+				Scores:     map[string]float64{"keyword": 1},
+			}, nil
+		}
+	}
+	return moderationResult{}, ctx.Err()
+}
+
+// Несколько модераторов подряд: локальный фильтр, затем модерация провайдера
+type moderatorChain []llmModerator
+
+func (c moderatorChain) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	var combined moderationResult
+	for _, m := range c {
+		result, err := m.Moderate(ctx, text, images)
+		if err != nil {
+			return combined, err
+		}
+		combined.Flagged = combined.Flagged || result.Flagged
+		combined.Categories = append(combined.Categories, result.Categories...)
+		for category, score := range result.Scores {
+			if combined.Scores == nil {
+				combined.Scores = make(map[string]float64)
+			}
+			if score > combined.Scores[category] {
+				combined.Scores[category] = score
+			}
+		}
+		if combined.Flagged && len(result.Categories) > 0 && result.Categories[0] == "keyword" {
+			// Локальный фильтр уже все решил, платный запрос не нужен
+			break
+		}
+	}
+	return combined, nil
+}
+
+// Собирает модерацию по настройкам [moderation]. provider — модерация
+// провайдера LLM, если он ее поддерживает, см. providerModeration.
+func newModerationStage(cfg *Config, provider llmModerator) (llmModerator, error) {
+	if !slices.Contains(moderationLevels, cfg.Moderation.Level) {
+		return nil, fmt.Errorf("неизвестный уровень модерации %q", cfg.Moderation.Level)
+	}
+	var chain moderatorChain
+	if len(cfg.Moderation.Patterns) > 0 {
+		local, err := newKeywordModerator(cfg.Moderation.Patterns)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, local)
+	}
+
+	switch cfg.Moderation.Provider {
+	case "":
+		// У совместимых серверов вроде Ollama нет /moderations, поэтому
+		// их модерация подключается только явным выбором openai
+		if provider != nil {
+			chain = append(chain, provider)
+		} else if cfg.LLM.Provider == "openai_compatible" {
+			log.Printf("Модерация провайдера %s не используется, действуют только шаблоны [moderation] patterns", cfg.LLM.Provider)
+		}
+	case "openai":
+		// Явный выбор: сервер openai_compatible сам поддерживает /moderations
+		if provider == nil {
+			return nil, fmt.Errorf("провайдер LLM %q не поддерживает модерацию", cfg.LLM.Provider)
+		}
+		chain = append(chain, provider)
+	case "local":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("неизвестный провайдер модерации %q", cfg.Moderation.Provider)
+	}
+
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// Блокирует ли результат проверки текст на уровне строгости level.
+// Возвращает категории, из-за которых текст заблокирован.
+func moderationBlocks(result moderationResult, level string) (bool, []string) {
+	var categories []string
+	switch level {
+	case moderationLow:
+		for _, category := range result.Categories {
+			if severeCategories[category] {
+				categories = append(categories, category)
+			}
+		}
+	case moderationMedium:
+		if result.Flagged {
+			categories = result.Categories
+		}
+	case moderationHigh:
+		categories = append(categories, result.Categories...)
+		for category, score := range result.Scores {
+			if score >= strictModerationScore && !slices.Contains(categories, category) {
+				categories = append(categories, category)
+			}
+		}
+		sort.Strings(categories)
+	}
+	return len(categories) > 0, categories
+}
+
+// Срабатывание модерации в чате
+type moderationIncident struct {
+	Time       time.Time `json:"time"`
+	UserID     int64     `json:"user_id"`
+	UserName   string    `json:"user_name"`
+	Stage      string    `json:"stage"` // question или answer
+	Categories []string  `json:"categories"`
+	Excerpt    string    `json:"excerpt"`
+}
+
+// Записывает срабатывание в журнал чата, храня только последние
+func recordModerationIncident(chatID int64, incident moderationIncident) {
+	log.Printf("Модерация в чате %d заблокировала %s пользователя %d: %s",
+		chatID, incident.Stage, incident.UserID, strings.Join(incident.Categories, ", "))
+
+	moderationMutex.Lock()
+	defer moderationMutex.Unlock()
+
+	key := strconv.FormatInt(chatID, 10)
+	var incidents []moderationIncident
+	db.get(moderationBucket, key, &incidents)
+	incidents = append(incidents, incident)
+	if len(incidents) > maxModerationIncidents {
+		incidents = incidents[len(incidents)-maxModerationIncidents:]
+	}
+	if err := db.put(moderationBucket, key, incidents); err != nil {
+		log.Printf("Ошибка при сохранении журнала модерации: %v", err)
+	}
+}
+
+// Проверяются ли в чате ответы модели. Такие ответы нельзя показывать
+// по мере генерации: непроверенный текст успел бы попасть в чат.
+func answersModerated(settings chatSettings) bool {
+	return moderator != nil && settings.Moderation != moderationOff
+}
+
+// Проверяет вопрос или ответ модели с учетом строгости чата.
+// images — изображения, которые модель получит вместе с вопросом.
+// Возвращает nil, если текст можно показывать, errContentFlagged, если он
+// заблокирован, и errModerationFailed, если модератор не ответил. Без проверки
+// текст пропускается только на уровне low или при [moderation] fail_open.
+func moderateGPTText(ctx context.Context, chatID int64, user *tgbotapi.User, settings chatSettings, stage, text string, images []llmImage) error {
+	if !answersModerated(settings) || (strings.TrimSpace(text) == "" && len(images) == 0) {
+		return nil
+	}
+	result, err := moderator.Moderate(ctx, text, images)
+	if err != nil {
+		if settings.Moderation == moderationLow || config.Moderation.FailOpen {
+			log.Printf("Ошибка модерации в чате %d, текст пропущен без проверки: %v", chatID, err)
+			return nil
+		}
+		log.Printf("Ошибка модерации в чате %d, текст не пропущен: %v", chatID, err)
+		return fmt.Errorf("%w: %v", errModerationFailed, err)
+	}
+	blocked, categories := moderationBlocks(result, settings.Moderation)
+	if !blocked {
+		return nil
+	}
+
+	excerpt := []rune(text)
+	if len(excerpt) > 100 {
+		excerpt = append(excerpt[:100], '…')
+	}
+	recordModerationIncident(chatID, moderationIncident{
+		Time:       time.Now(),
+		UserID:     user.ID,
+		UserName:   displayName(user),
+		Stage:      stage,
+		Categories: categories,
+		Excerpt:    string(excerpt),
+	})
+	return fmt.Errorf("%w: %s", errContentFlagged, strings.Join(categories, ", "))
+}
+
+// Сообщение пользователю о вопросе или ответе, не пропущенном модерацией
+func moderationBlockedMessage(stage string, err error) string {
+	unavailable := errors.Is(err, errModerationFailed)
+	switch {
+	case stage == "question" && unavailable:
+		return "Модерация чата сейчас недоступна, поэтому вопрос не отправлен модели. Попробуйте позже."
+	case stage == "question":
+		return "Этот вопрос не прошел модерацию чата, отвечать на него не буду."
+	case unavailable:
+		return "Ответ скрыт: модерация чата сейчас недоступна и не смогла его проверить."
+	}
+	return "Ответ скрыт: он не прошел модерацию чата."
+}
+
+// Текст журнала модерации чата для администраторов
+func moderationLogText(chatID int64) string {
+	var incidents []moderationIncident
+	db.get(moderationBucket, strconv.FormatInt(chatID, 10), &incidents)
+	if len(incidents) == 0 {
+		return "Модерация в этом чате еще не срабатывала."
+	}
+
+	var text strings.Builder
+	text.WriteString("<b>Последние срабатывания модерации</b>\n")
+	if len(incidents) > 10 {
+		incidents = incidents[len(incidents)-10:]
+	}
+	for _, incident := range incidents {
+		stage := "вопрос"
+		if incident.Stage == "answer" {
+			stage = "ответ"
+		}
+		fmt.Fprintf(&text, "\n%s, %s (%d), %s: %s\n<i>%s</i>\n",
+			incident.Time.Format("02.01 15:04"), html.EscapeString(incident.UserName), incident.UserID,
+			stage, html.EscapeString(strings.Join(incident.Categories, ", ")), html.EscapeString(incident.Excerpt))
+	}
+	return text.String()
+}
+
+// Отправляет журнал модерации администратору в личные сообщения:
+// в нем отрывки заблокированных текстов и имена авторов
+func sendModerationLog(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	adminID := ctx.Message.From.ID
+	if _, err := ctx.Bot.Send(newHTMLMessage(adminID, moderationLogText(chatID))); err != nil {
+		log.Printf("Ошибка при отправке журнала модерации пользователю %d: %v", adminID, err)
+		if !ctx.Message.Chat.IsPrivate() {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Не удалось отправить журнал в личные сообщения. Напишите боту /start в личке и повторите команду."))
+		}
+		return
+	}
+	if !ctx.Message.Chat.IsPrivate() {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Журнал модерации отправлен вам в личные сообщения."))
+	}
+}
+
+// Обработка команды /moderation: уровень строгости и журнал срабатываний
+func handleModerationCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	settings := getChatSettings(chatID)
+	if len(ctx.Args) == 0 {
+		status := fmt.Sprintf("Модерация вопросов и ответов: <b>%s</b>\nУровни: %s\n\nИзменить: /moderation medium\nЖурнал: /moderation log",
+			settings.Moderation, strings.Join(moderationLevels, ", "))
+		if moderator == nil {
+			status += "\n\nМодерация не настроена в конфигурации бота, уровень не действует."
+		}
+		ctx.Bot.Send(newHTMLMessage(chatID, status))
+		return
+	}
+
+	if !isChatAdmin(ctx.Bot, ctx.Message.Chat, ctx.Message.From.ID) {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Модерацию могут настраивать только администраторы чата."))
+		return
+	}
+	level := strings.ToLower(ctx.Args[0])
+	if level == "log" {
+		sendModerationLog(ctx)
+		return
+	}
+	if !slices.Contains(moderationLevels, level) {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Доступные уровни: "+strings.Join(moderationLevels, ", ")+"."))
+		return
+	}
+	overrides := loadChatOverrides(chatID)
+	overrides.Moderation = level
+	if err := saveChatOverrides(chatID, overrides); err != nil {
+		log.Printf("Ошибка при сохранении настроек чата %d: %v", chatID, err)
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Не удалось сохранить уровень модерации."))
+		return
+	}
+	ctx.Bot.Send(newHTMLMessage(chatID, fmt.Sprintf("Модерация: <b>%s</b>", level)))
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "moderation",
+		Usage:       "[off | low | medium | high | log]",
+		Description: "Модерация вопросов и ответов модели",
+		Feature:     "gpt",
+		Handler:     handleModerationCommand,
+	})
+}
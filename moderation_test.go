@@ -0,0 +1,75 @@
+// moderation_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Модератор, который всегда возвращает err или result
+type stubModerator struct {
+	result moderationResult
+	err    error
+}
+
+func (m stubModerator) Moderate(ctx context.Context, text string, images []llmImage) (moderationResult, error) {
+	return m.result, m.err
+}
+
+// Подменяет модератора на время теста
+func useModerator(t *testing.T, m llmModerator) {
+	t.Helper()
+	useMemoryStore(t)
+	saved, savedConfig := moderator, *config
+	moderator = m
+	t.Cleanup(func() {
+		moderator = saved
+		*config = savedConfig
+	})
+}
+
+func TestModerateGPTTextFailsClosed(t *testing.T) {
+	useModerator(t, stubModerator{err: errors.New("503 Service Unavailable")})
+	user := &tgbotapi.User{ID: 1, FirstName: "Вася"}
+
+	for _, tc := range []struct {
+		level    string
+		failOpen bool
+		allowed  bool
+	}{
+		{moderationOff, false, true},
+		{moderationLow, false, true},
+		{moderationMedium, false, false},
+		{moderationHigh, false, false},
+		{moderationHigh, true, true},
+	} {
+		config.Moderation.FailOpen = tc.failOpen
+		settings := getChatSettings(2)
+		settings.Moderation = tc.level
+		err := moderateGPTText(context.Background(), 2, user, settings, "question", "вопрос", nil)
+		if tc.allowed && err != nil {
+			t.Errorf("уровень %s, fail_open %v: текст не пропущен: %v", tc.level, tc.failOpen, err)
+		}
+		if !tc.allowed && !errors.Is(err, errModerationFailed) {
+			t.Errorf("уровень %s, fail_open %v: ошибка %v вместо errModerationFailed", tc.level, tc.failOpen, err)
+		}
+	}
+}
+
+func TestModerateGPTTextBlocksFlagged(t *testing.T) {
+	useModerator(t, stubModerator{result: moderationResult{Flagged: true, Categories: []string{"keyword"}, Scores: map[string]float64{"keyword": 1}}})
+	settings := getChatSettings(2)
+	settings.Moderation = moderationLow
+
+	err := moderateGPTText(context.Background(), 2, &tgbotapi.User{ID: 1}, settings, "answer", "ответ", nil)
+	if !errors.Is(err, errContentFlagged) {
+		t.Fatalf("ошибка %v вместо errContentFlagged", err)
+	}
+	if moderationBlockedMessage("answer", err) == moderationBlockedMessage("answer", errModerationFailed) {
+		t.Errorf("блокировка и недоступность модерации описаны одинаково")
+	}
+}
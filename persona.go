@@ -0,0 +1,121 @@
+// persona.go
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Имя персоны с собственным промптом чата
+const customPersona = "custom"
+
+// Максимальная длина собственного промпта
+const maxCustomPromptLength = 2000
+
+// Указание языка ответа для каждого поддерживаемого языка
+var languageInstructions = map[string]string{
+	"ru": "Отвечай на русском языке.",
+	"en": "Answer in English.",
+}
+
+// Возвращает системный промпт для чата: текст персоны и указание языка
+func systemPrompt(settings chatSettings) string {
+	var parts []string
+	if settings.Persona == customPersona {
+		parts = append(parts, settings.CustomPrompt)
+	} else if prompt, ok := config.Personas[settings.Persona]; ok {
+		parts = append(parts, prompt)
+	}
+	if instruction, ok := languageInstructions[settings.Language]; ok {
+		parts = append(parts, instruction)
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n\n"))
+}
+
+// Список доступных персон в алфавитном порядке
+func personaNames() []string {
+	names := make([]string, 0, len(config.Personas)+1)
+	for name := range config.Personas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(names, customPersona)
+}
+
+// Обработка команды /persona
+func handlePersonaCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	settings := getChatSettings(chatID)
+
+	// Без аргументов показываем текущую персону
+	if len(ctx.Args) == 0 {
+		response := fmt.Sprintf("Текущая персона: <b>%s</b>\nДоступные: %s\n\nСменить: /persona salty, /persona custom \"текст промпта\"",
+			html.EscapeString(settings.Persona), html.EscapeString(strings.Join(personaNames(), ", ")))
+		if settings.Persona == customPersona {
+			response += "\n\nПромпт чата:\n" + html.EscapeString(settings.CustomPrompt)
+		}
+		ctx.Bot.Send(newHTMLMessage(chatID, response))
+		return
+	}
+
+	if !isChatAdmin(ctx.Bot, ctx.Message.Chat, ctx.Message.From.ID) {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Персону могут менять только администраторы чата."))
+		return
+	}
+
+	name := strings.ToLower(ctx.Args[0])
+	overrides := loadChatOverrides(chatID)
+	switch {
+	case name == "reset":
+		overrides.Persona = ""
+		overrides.CustomPrompt = ""
+	case name == customPersona:
+		// Берем исходный текст, чтобы сохранить переносы строк и пробелы промпта
+		prompt := ""
+		if i := strings.IndexFunc(ctx.RawArgs, unicode.IsSpace); i >= 0 {
+			prompt = trimQuotes(ctx.RawArgs[i:])
+		}
+		if prompt == "" {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Укажите текст промпта: /persona custom \"Ты — пират…\""))
+			return
+		}
+		if len([]rune(prompt)) > maxCustomPromptLength {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Промпт слишком длинный: не больше %d символов.", maxCustomPromptLength)))
+			return
+		}
+		overrides.Persona = customPersona
+		overrides.CustomPrompt = prompt
+	default:
+		if _, ok := config.Personas[name]; !ok {
+			ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Нет такой персоны. Доступные: "+strings.Join(personaNames(), ", ")))
+			return
+		}
+		overrides.Persona = name
+		overrides.CustomPrompt = ""
+	}
+	if err := saveChatOverrides(chatID, overrides); err != nil {
+		log.Printf("Ошибка при сохранении персоны чата %d: %v", chatID, err)
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Не удалось сохранить персону."))
+		return
+	}
+
+	settings = getChatSettings(chatID)
+	ctx.Bot.Send(newHTMLMessage(chatID, fmt.Sprintf("Персона чата: <b>%s</b>", html.EscapeString(settings.Persona))))
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "persona",
+		Usage:       "[имя | custom \"промпт\" | reset]",
+		Description: "Персона бота в чате",
+		Feature:     "gpt",
+		Handler:     handlePersonaCommand,
+	})
+}
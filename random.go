@@ -0,0 +1,172 @@
+// random.go
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Источник случайности для игровой логики.
+// Игры получают его через gameRandom, поэтому с фиксированным зерном
+// любую партию можно воспроизвести заново.
+type RandomSource interface {
+	Intn(n int) int
+}
+
+// Количество камор в барабане револьвера
+const revolverChambers = 6
+
+// Источник случайности, используемый игровыми обработчиками
+var gameRandom RandomSource = newSeededRandom(1)
+
+// Зерно, с которым был создан текущий источник случайности
+var gameSeed int64 = 1
+
+// Создает детерминированный источник случайности с заданным зерном
+func newSeededRandom(seed int64) RandomSource {
+	return rand.New(rand.NewSource(seed))
+}
+
+// Устанавливает зерно для всех последующих игр
+func setGameSeed(seed int64) {
+	gameSeed = seed
+	gameRandom = newSeededRandom(seed)
+}
+
+// Выбор игрока, который ходит первым
+func pickFirstShooter(src RandomSource, participants int) int {
+	return src.Intn(participants)
+}
+
+// Результат выстрела в дуэли: true, если выстрел попал в цель
+func duelShotHits(src RandomSource) bool {
+	return src.Intn(2) == 0
+}
+
+// Заряжает револьвер одним патроном в случайную камору
+func loadRevolver(src RandomSource) [revolverChambers]bool {
+	var chambers [revolverChambers]bool
+	chambers[src.Intn(revolverChambers)] = true
+	return chambers
+}
+
+// Прокручивает барабан и возвращает камору, напротив которой остановился курок
+func spinChamber(src RandomSource) int {
+	return src.Intn(revolverChambers)
+}
+
+// Результат смоделированной дуэли
+type duelReplay struct {
+	FirstShooter int
+	Winner       int
+	Shots        []bool // исход каждого выстрела по порядку: true — попадание
+}
+
+// Моделирует дуэль двух игроков с тем же порядком вызовов, что и в боте
+func simulateDuel(src RandomSource) duelReplay {
+	turn := pickFirstShooter(src, 2)
+	result := duelReplay{FirstShooter: turn}
+	for {
+		hit := duelShotHits(src)
+		result.Shots = append(result.Shots, hit)
+		if hit {
+			result.Winner = turn
+			return result
+		}
+		turn = 1 - turn
+	}
+}
+
+// Результат смоделированной русской рулетки
+type rouletteReplay struct {
+	FirstShooter   int
+	BulletPosition int
+	Eliminated     []int
+	Winner         int
+	Pulls          int
+}
+
+// Моделирует русскую рулетку с тем же порядком вызовов, что и в боте
+func simulateRoulette(src RandomSource, players int) rouletteReplay {
+	participants := make([]int, players)
+	for i := range participants {
+		participants[i] = i
+	}
+
+	current := pickFirstShooter(src, len(participants))
+	chambers := loadRevolver(src)
+	result := rouletteReplay{FirstShooter: current}
+	for i, loaded := range chambers {
+		if loaded {
+			result.BulletPosition = i
+		}
+	}
+
+	for len(participants) > 1 {
+		result.Pulls++
+		if chambers[spinChamber(src)] {
+			result.Eliminated = append(result.Eliminated, participants[current])
+			participants = append(participants[:current], participants[current+1:]...)
+			if current >= len(participants) {
+				current = 0
+			}
+			continue
+		}
+		current = (current + 1) % len(participants)
+	}
+	result.Winner = participants[0]
+	return result
+}
+
+// Прогоняет серию игр с заданным зерном и возвращает отчет о распределениях.
+// Используется флагом -replay-seed для проверки и воспроизведения партий.
+func replayGamesReport(seed int64, games int, players int) string {
+	src := newSeededRandom(seed)
+	var report strings.Builder
+
+	firstShooter := make([]int, 2)
+	hits := 0
+	shots := 0
+	for i := 0; i < games; i++ {
+		duel := simulateDuel(src)
+		firstShooter[duel.FirstShooter]++
+		for _, hit := range duel.Shots {
+			shots++
+			if hit {
+				hits++
+			}
+		}
+	}
+	fmt.Fprintf(&report, "Зерно: %d, игр: %d\n", seed, games)
+	fmt.Fprintf(&report, "Дуэль: первым стрелял игрок 0 в %.3f случаев, вероятность попадания %.3f\n",
+		ratio(firstShooter[0], games), ratio(hits, shots))
+
+	bullets := make([]int, revolverChambers)
+	firstPlayers := make([]int, players)
+	wins := make([]int, players)
+	pulls := 0
+	for i := 0; i < games; i++ {
+		roulette := simulateRoulette(src, players)
+		bullets[roulette.BulletPosition]++
+		firstPlayers[roulette.FirstShooter]++
+		wins[roulette.Winner]++
+		pulls += roulette.Pulls
+	}
+	fmt.Fprintf(&report, "Рулетка (%d игроков): в среднем %.2f нажатий на курок за игру\n", players, ratio(pulls, games))
+	for i, count := range bullets {
+		fmt.Fprintf(&report, "  патрон в каморе %d: %.3f\n", i+1, ratio(count, games))
+	}
+	for i := 0; i < players; i++ {
+		fmt.Fprintf(&report, "  игрок %d: ходил первым %.3f, победил %.3f\n", i, ratio(firstPlayers[i], games), ratio(wins[i], games))
+	}
+	return report.String()
+}
+
+func ratio(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
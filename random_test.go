@@ -0,0 +1,178 @@
+// random_test.go
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Число игр в статистических проверках
+const simulatedGames = 20000
+
+// Критические значения хи-квадрат для уровня значимости 0.001
+// по числу степеней свободы
+var chiSquareCritical = map[int]float64{
+	1: 10.828,
+	2: 13.816,
+	3: 16.266,
+	5: 20.515,
+}
+
+// Статистика хи-квадрат для равномерного распределения по корзинам
+func chiSquareUniform(counts []int) float64 {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	expected := float64(total) / float64(len(counts))
+	stat := 0.0
+	for _, count := range counts {
+		diff := float64(count) - expected
+		stat += diff * diff / expected
+	}
+	return stat
+}
+
+// Проверяет равномерность распределения на нескольких зернах
+func checkUniform(t *testing.T, name string, bins int, sample func(seed int64) []int) {
+	t.Helper()
+	critical, ok := chiSquareCritical[bins-1]
+	if !ok {
+		t.Fatalf("нет критического значения для %d степеней свободы", bins-1)
+	}
+	for _, seed := range []int64{0, 1, 42, 20240601} {
+		counts := sample(seed)
+		if len(counts) != bins {
+			t.Fatalf("%s, зерно %d: %d корзин вместо %d", name, seed, len(counts), bins)
+		}
+		if stat := chiSquareUniform(counts); stat > critical {
+			t.Errorf("%s, зерно %d: распределение %v неравномерно, хи-квадрат %.2f > %.2f", name, seed, counts, stat, critical)
+		}
+	}
+}
+
+func TestFirstShooterDistribution(t *testing.T) {
+	for _, players := range []int{2, 3, 4} {
+		checkUniform(t, "первый стрелок", players, func(seed int64) []int {
+			src := newSeededRandom(seed)
+			counts := make([]int, players)
+			for i := 0; i < simulatedGames; i++ {
+				counts[pickFirstShooter(src, players)]++
+			}
+			return counts
+		})
+	}
+}
+
+func TestDuelFirstShooterDistribution(t *testing.T) {
+	checkUniform(t, "первый стрелок в дуэли", 2, func(seed int64) []int {
+		src := newSeededRandom(seed)
+		counts := make([]int, 2)
+		for i := 0; i < simulatedGames; i++ {
+			counts[simulateDuel(src).FirstShooter]++
+		}
+		return counts
+	})
+}
+
+func TestDuelHitProbability(t *testing.T) {
+	src := newSeededRandom(7)
+	hits, shots := 0, 0
+	for i := 0; i < simulatedGames; i++ {
+		duel := simulateDuel(src)
+		for j, hit := range duel.Shots {
+			shots++
+			if hit {
+				hits++
+				if j != len(duel.Shots)-1 {
+					t.Fatalf("дуэль продолжилась после попадания: %v", duel.Shots)
+				}
+			}
+		}
+		if !duel.Shots[len(duel.Shots)-1] {
+			t.Fatalf("дуэль закончилась без попадания: %v", duel.Shots)
+		}
+	}
+
+	// Ожидаемая вероятность 1/2; допуск — четыре стандартных отклонения
+	p := float64(hits) / float64(shots)
+	tolerance := 4 * math.Sqrt(0.25/float64(shots))
+	if math.Abs(p-0.5) > tolerance {
+		t.Errorf("вероятность попадания %.4f, ожидалось 0.5 ± %.4f", p, tolerance)
+	}
+}
+
+func TestBulletPositionDistribution(t *testing.T) {
+	checkUniform(t, "камора с патроном", revolverChambers, func(seed int64) []int {
+		src := newSeededRandom(seed)
+		counts := make([]int, revolverChambers)
+		for i := 0; i < simulatedGames; i++ {
+			chambers := loadRevolver(src)
+			loaded := 0
+			for chamber, bullet := range chambers {
+				if bullet {
+					counts[chamber]++
+					loaded++
+				}
+			}
+			if loaded != 1 {
+				t.Fatalf("в барабане %d патронов вместо одного", loaded)
+			}
+		}
+		return counts
+	})
+}
+
+func TestSpinChamberDistribution(t *testing.T) {
+	checkUniform(t, "прокрутка барабана", revolverChambers, func(seed int64) []int {
+		src := newSeededRandom(seed)
+		counts := make([]int, revolverChambers)
+		for i := 0; i < simulatedGames; i++ {
+			counts[spinChamber(src)]++
+		}
+		return counts
+	})
+}
+
+func TestRouletteWinnerDistribution(t *testing.T) {
+	const players = 3
+	checkUniform(t, "победитель рулетки", players, func(seed int64) []int {
+		src := newSeededRandom(seed)
+		counts := make([]int, players)
+		for i := 0; i < simulatedGames; i++ {
+			roulette := simulateRoulette(src, players)
+			if len(roulette.Eliminated) != players-1 {
+				t.Fatalf("выбыло %d игроков из %d", len(roulette.Eliminated), players)
+			}
+			counts[roulette.Winner]++
+		}
+		return counts
+	})
+}
+
+func TestReplayIsDeterministic(t *testing.T) {
+	for _, seed := range []int64{0, 99} {
+		a, b := newSeededRandom(seed), newSeededRandom(seed)
+		for i := 0; i < 100; i++ {
+			if duelA, duelB := simulateDuel(a), simulateDuel(b); !reflect.DeepEqual(duelA, duelB) {
+				t.Fatalf("зерно %d: дуэли разошлись: %+v и %+v", seed, duelA, duelB)
+			}
+			if rouletteA, rouletteB := simulateRoulette(a, 4), simulateRoulette(b, 4); !reflect.DeepEqual(rouletteA, rouletteB) {
+				t.Fatalf("зерно %d: рулетки разошлись: %+v и %+v", seed, rouletteA, rouletteB)
+			}
+		}
+		if replayGamesReport(seed, 500, 3) != replayGamesReport(seed, 500, 3) {
+			t.Fatalf("зерно %d: отчеты разошлись", seed)
+		}
+	}
+}
+
+func TestReplayReportHitProbability(t *testing.T) {
+	report := replayGamesReport(3, simulatedGames, 2)
+	if !strings.Contains(report, "вероятность попадания 0.49") && !strings.Contains(report, "вероятность попадания 0.50") {
+		t.Errorf("вероятность попадания в отчете далека от 0.5:\n%s", report)
+	}
+}
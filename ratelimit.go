@@ -0,0 +1,164 @@
+// ratelimit.go
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Как часто удалять заполнившиеся корзины
+const rateLimitSweepInterval = 10 * time.Minute
+
+// Ограничение частоты: не больше Burst действий подряд,
+// затем одно действие за каждый Interval
+type rateLimit struct {
+	Key      string
+	Burst    int
+	Interval time.Duration // 0 — без ограничения
+}
+
+// Корзина токенов одного ключа
+type tokenBucket struct {
+	tokens     float64
+	updated    time.Time
+	full       time.Time // когда корзина снова заполнится
+	quietUntil time.Time // до этого момента повторно не предупреждаем
+}
+
+// Результат проверки ограничений
+type rateLimitResult struct {
+	Allowed bool
+	Wait    time.Duration // сколько ждать до следующей попытки
+	Notify  bool          // нужно ли предупредить пользователя
+}
+
+// Ограничитель частоты с корзинами токенов по ключам
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Ограничитель, общий для GPT и игр
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Забирает по токену из всех корзин, только если токены есть в каждой.
+// Если хотя бы одна корзина пуста, ничего не списывается, а Notify
+// выставляется не чаще одного раза за время ожидания.
+func (l *rateLimiter) take(now time.Time, limits ...rateLimit) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweepLocked(now)
+	}
+
+	var result rateLimitResult
+	var blocked *tokenBucket
+	buckets := make([]*tokenBucket, len(limits))
+	for i, limit := range limits {
+		if limit.Interval <= 0 || limit.Burst <= 0 {
+			continue
+		}
+		bucket := l.refillLocked(limit, now)
+		buckets[i] = bucket
+		if bucket.tokens < 1 {
+			wait := time.Duration((1 - bucket.tokens) * float64(limit.Interval))
+			if wait > result.Wait {
+				result.Wait = wait
+				blocked = bucket
+			}
+		}
+	}
+
+	if blocked != nil {
+		if !now.Before(blocked.quietUntil) {
+			result.Notify = true
+			blocked.quietUntil = now.Add(result.Wait)
+		}
+		return result
+	}
+
+	for i, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+		bucket.tokens--
+		bucket.full = now.Add(time.Duration((float64(limits[i].Burst) - bucket.tokens) * float64(limits[i].Interval)))
+	}
+	result.Allowed = true
+	return result
+}
+
+// Пополняет корзину за прошедшее время
+func (l *rateLimiter) refillLocked(limit rateLimit, now time.Time) *tokenBucket {
+	bucket, ok := l.buckets[limit.Key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[limit.Key] = bucket
+	}
+	elapsed := now.Sub(bucket.updated)
+	if elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+float64(elapsed)/float64(limit.Interval))
+		bucket.updated = now
+	}
+	return bucket
+}
+
+// Удаляет корзины, которые уже заполнились: они ничем не отличаются от новых
+func (l *rateLimiter) sweepLocked(now time.Time) {
+	for key, bucket := range l.buckets {
+		if now.After(bucket.full) && now.After(bucket.quietUntil) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Ограничения для запросов к GPT: пользователь с паузой из настроек чата и чат целиком
+func gptRateLimits(userID, chatID int64, settings chatSettings) []rateLimit {
+	return []rateLimit{
+		{Key: "gpt:user:" + strconv.FormatInt(userID, 10), Burst: config.RateLimits.GPTUserBurst, Interval: settings.Cooldown},
+		{Key: "gpt:chat:" + strconv.FormatInt(chatID, 10), Burst: config.RateLimits.GPTChatBurst, Interval: config.RateLimits.GPTChatInterval},
+	}
+}
+
+// Ограничение на вызовы к играм от одного пользователя в чате
+func gameRateLimits(userID, chatID int64) []rateLimit {
+	return []rateLimit{
+		{Key: fmt.Sprintf("games:%d:%d", chatID, userID), Burst: config.RateLimits.GamesBurst, Interval: config.RateLimits.GamesInterval},
+	}
+}
+
+// Проверяет ограничения частоты. Если действие запрещено,
+// один раз за время ожидания отвечает пользователю, сколько подождать.
+func checkRateLimit(bot *tgbotapi.BotAPI, message *tgbotapi.Message, limits ...rateLimit) bool {
+	result := limiter.take(time.Now(), limits...)
+	if result.Allowed {
+		return true
+	}
+	if result.Notify {
+		msg := tgbotapi.NewMessage(message.Chat.ID, rateLimitMessage(result.Wait))
+		msg.ReplyToMessageID = message.MessageID
+		bot.Send(msg)
+	}
+	return false
+}
+
+// Текст предупреждения о превышении частоты
+func rateLimitMessage(wait time.Duration) string {
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("Пожалуйста, подождите %v перед следующим запросом.", wait.Round(time.Second))
+}
@@ -0,0 +1,149 @@
+// ratelimit_test.go
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var rateLimitStart = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestRateLimitBurstAndRefill(t *testing.T) {
+	l := newRateLimiter()
+	limit := rateLimit{Key: "user", Burst: 3, Interval: 10 * time.Second}
+	now := rateLimitStart
+
+	for i := 0; i < 3; i++ {
+		if !l.take(now, limit).Allowed {
+			t.Fatalf("действие %d из запаса отклонено", i+1)
+		}
+	}
+	result := l.take(now, limit)
+	if result.Allowed || result.Wait != 10*time.Second {
+		t.Fatalf("после запаса: %+v", result)
+	}
+
+	// Через 4 секунды токен пополнен лишь на 0.4
+	now = now.Add(4 * time.Second)
+	if result := l.take(now, limit); result.Allowed || result.Wait != 6*time.Second {
+		t.Errorf("до пополнения: %+v", result)
+	}
+	now = now.Add(6 * time.Second)
+	if !l.take(now, limit).Allowed {
+		t.Errorf("пополненный токен не выдан")
+	}
+	if l.take(now, limit).Allowed {
+		t.Errorf("выдан второй токен за один интервал")
+	}
+
+	// Долгий простой наполняет корзину не больше запаса
+	now = now.Add(time.Hour)
+	allowed := 0
+	for l.take(now, limit).Allowed {
+		allowed++
+	}
+	if allowed != limit.Burst {
+		t.Errorf("после простоя выдано %d вместо %d", allowed, limit.Burst)
+	}
+}
+
+func TestRateLimitNotifyOnce(t *testing.T) {
+	l := newRateLimiter()
+	limit := rateLimit{Key: "user", Burst: 1, Interval: 10 * time.Second}
+	now := rateLimitStart
+	l.take(now, limit)
+
+	if result := l.take(now, limit); !result.Notify {
+		t.Fatalf("первый отказ без предупреждения: %+v", result)
+	}
+	for _, offset := range []time.Duration{0, time.Second, 9 * time.Second} {
+		if result := l.take(now.Add(offset), limit); result.Allowed || result.Notify {
+			t.Errorf("через %v после отказа: %+v", offset, result)
+		}
+	}
+	if result := l.take(now.Add(10*time.Second), limit); !result.Allowed {
+		t.Errorf("после ожидания действие отклонено: %+v", result)
+	}
+	if result := l.take(now.Add(10*time.Second), limit); !result.Notify {
+		t.Errorf("новый отказ после ожидания без предупреждения: %+v", result)
+	}
+}
+
+func TestRateLimitAllOrNothing(t *testing.T) {
+	l := newRateLimiter()
+	user := rateLimit{Key: "user", Burst: 5, Interval: time.Second}
+	chat := rateLimit{Key: "chat", Burst: 1, Interval: time.Minute}
+	now := rateLimitStart
+
+	if !l.take(now, user, chat).Allowed {
+		t.Fatal("первое действие отклонено")
+	}
+	// Чат исчерпан: токен пользователя не должен списываться
+	for i := 0; i < 10; i++ {
+		result := l.take(now, user, chat)
+		if result.Allowed || result.Wait != time.Minute {
+			t.Fatalf("при пустой корзине чата: %+v", result)
+		}
+	}
+	if tokens := l.buckets["user"].tokens; tokens != 4 {
+		t.Errorf("у пользователя %v токенов вместо 4", tokens)
+	}
+	for i := 0; i < 4; i++ {
+		if !l.take(now, user).Allowed {
+			t.Fatalf("токен пользователя %d пропал при отказе чата", i+1)
+		}
+	}
+
+	// Ожидание — по самой пустой корзине
+	now = now.Add(30 * time.Second)
+	if result := l.take(now, user, chat); result.Wait != 30*time.Second {
+		t.Errorf("ожидание %v вместо 30s", result.Wait)
+	}
+}
+
+func TestRateLimitDisabledAndSweep(t *testing.T) {
+	l := newRateLimiter()
+	off := rateLimit{Key: "off", Burst: 1, Interval: 0}
+	limit := rateLimit{Key: "user", Burst: 2, Interval: time.Second}
+	now := rateLimitStart
+	for i := 0; i < 5; i++ {
+		if !l.take(now, off).Allowed {
+			t.Fatal("ограничение с нулевым интервалом сработало")
+		}
+	}
+	l.take(now, limit)
+	if len(l.buckets) != 1 {
+		t.Fatalf("корзин %d вместо 1", len(l.buckets))
+	}
+
+	// Заполнившиеся корзины удаляются при следующей проверке после интервала очистки
+	now = now.Add(rateLimitSweepInterval + time.Second)
+	l.take(now, off)
+	if len(l.buckets) != 0 {
+		t.Errorf("после очистки осталось корзин: %d", len(l.buckets))
+	}
+}
+
+func TestCheckRateLimitNotifiesOnce(t *testing.T) {
+	bot, telegram := newRecordingBot(t)
+	saved := limiter
+	limiter = newRateLimiter()
+	t.Cleanup(func() { limiter = saved })
+
+	message := &tgbotapi.Message{MessageID: 7, Chat: &tgbotapi.Chat{ID: 1}}
+	limit := rateLimit{Key: "user", Burst: 1, Interval: time.Hour}
+	results := []bool{}
+	for i := 0; i < 3; i++ {
+		results = append(results, checkRateLimit(bot, message, limit))
+	}
+	if !results[0] || results[1] || results[2] {
+		t.Errorf("результаты проверок %v", results)
+	}
+	sent := telegram.called("sendMessage")
+	if len(sent) != 1 || sent[0].Params["text"] != rateLimitMessage(time.Hour) {
+		t.Errorf("предупреждения: %+v", sent)
+	}
+}
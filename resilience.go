@@ -0,0 +1,214 @@
+// resilience.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Провайдер временно отключен после серии сбоев
+var errCircuitOpen = errors.New("языковая модель временно недоступна")
+
+// Размыкатель цепи: после threshold сбоев подряд запросы не отправляются
+// в течение cooldown, затем пропускается один пробный запрос
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool // пробный запрос уже отправлен
+}
+
+// Разрешает запрос или возвращает errCircuitOpen
+func (b *circuitBreaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return nil
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return errCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Снимает пробный запрос, не меняя счетчик: запрос отменен,
+// и о доступности провайдера ничего не известно
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Запоминает результат запроса
+func (b *circuitBreaker) record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Printf("Провайдер LLM недоступен, запросы приостановлены на %v", b.cooldown)
+		}
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// Обертка над провайдером: таймаут на каждую попытку, повторы временных
+// ошибок с экспоненциальной задержкой и размыкатель цепи
+type resilientProvider struct {
+	provider   llmProvider
+	timeout    time.Duration
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	breaker    *circuitBreaker
+}
+
+// То же для провайдеров с потоковой генерацией
+type resilientStreamer struct {
+	*resilientProvider
+	streamer llmStreamer
+}
+
+// Оборачивает провайдера согласно настройкам [llm]
+func newResilientProvider(provider llmProvider, cfg *Config) llmProvider {
+	wrapped := &resilientProvider{
+		provider:   provider,
+		timeout:    cfg.LLM.Timeout,
+		maxRetries: cfg.LLM.MaxRetries,
+		baseDelay:  cfg.LLM.RetryBaseDelay,
+		maxDelay:   cfg.LLM.RetryMaxDelay,
+		breaker: &circuitBreaker{
+			threshold: cfg.LLM.BreakerThreshold,
+			cooldown:  cfg.LLM.BreakerCooldown,
+		},
+	}
+	if streamer, ok := provider.(llmStreamer); ok {
+		return &resilientStreamer{resilientProvider: wrapped, streamer: streamer}
+	}
+	return wrapped
+}
+
+func (p *resilientProvider) Name() string {
+	return p.provider.Name()
+}
+
+func (p *resilientProvider) ChatCompletion(ctx context.Context, req llmRequest) (llmResponse, error) {
+	return p.do(ctx, func(ctx context.Context) (llmResponse, bool, error) {
+		resp, err := p.provider.ChatCompletion(ctx, req)
+		return resp, false, err
+	})
+}
+
+// Повторяет поток, только если пользователь еще не увидел ни одного фрагмента
+func (p *resilientStreamer) ChatCompletionStream(ctx context.Context, req llmRequest, onDelta func(delta string)) (llmResponse, error) {
+	return p.do(ctx, func(ctx context.Context) (llmResponse, bool, error) {
+		received := false
+		resp, err := p.streamer.ChatCompletionStream(ctx, req, func(delta string) {
+			received = true
+			onDelta(delta)
+		})
+		return resp, received, err
+	})
+}
+
+// Выполняет запрос через размыкатель цепи. Размыкатель учитывает исход
+// запроса целиком, а не каждую попытку: иначе один запрос с повторами
+// засчитывался бы как несколько сбоев подряд.
+func (p *resilientProvider) do(ctx context.Context, attempt func(ctx context.Context) (llmResponse, bool, error)) (llmResponse, error) {
+	if err := p.breaker.allow(time.Now()); err != nil {
+		return llmResponse{}, err
+	}
+	resp, err := p.retry(ctx, attempt)
+	if ctx.Err() != nil {
+		p.breaker.abort()
+	} else {
+		p.breaker.record(time.Now(), isRetryableLLMError(err))
+	}
+	return resp, err
+}
+
+// Выполняет попытки запроса. attempt сообщает, начал ли ответ доходить
+// до пользователя: такой запрос повторять уже нельзя.
+func (p *resilientProvider) retry(ctx context.Context, attempt func(ctx context.Context) (llmResponse, bool, error)) (llmResponse, error) {
+	for try := 0; ; try++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		}
+		resp, started, err := attempt(attemptCtx)
+		cancel()
+
+		if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			// Истек таймаут попытки, а не запроса в целом
+			err = &llmError{Message: "Языковая модель не ответила вовремя.", Retryable: true, Err: err}
+		}
+		if !isRetryableLLMError(err) || started || try >= p.maxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		delay := p.backoff(try)
+		log.Printf("Запрос к %s не удался (%v), повтор через %v", p.provider.Name(), err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return llmResponse{}, ctx.Err()
+		}
+	}
+}
+
+// Экспоненциальная задержка со случайным разбросом (full jitter)
+func (p *resilientProvider) backoff(try int) time.Duration {
+	limit := p.baseDelay << try
+	if limit <= 0 || (p.maxDelay > 0 && limit > p.maxDelay) {
+		limit = p.maxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit))) + time.Millisecond
+}
+
+// Временная ли ошибка: лимит частоты, сбой сервера или сети
+func isRetryableLLMError(err error) bool {
+	var providerErr *llmError
+	return errors.As(err, &providerErr) && providerErr.Retryable
+}
+
+// Текст ошибки GPT для пользователя
+func gptErrorMessage(err error) string {
+	var providerErr *llmError
+	var quotaErr *quotaError
+	switch {
+	case errors.As(err, &quotaErr):
+		return quotaErr.Error()
+	case errors.Is(err, errPromptTooLong):
+		return fmt.Sprintf("Вопрос слишком длинный (%v). Сократите его или начните новый диалог.", strings.TrimPrefix(err.Error(), errPromptTooLong.Error()+": "))
+	case errors.Is(err, errBudgetExhausted):
+		return "Бюджет на языковую модель в этом месяце исчерпан. Попробуйте в следующем месяце."
+	case errors.Is(err, errCircuitOpen):
+		return "Языковая модель сейчас недоступна. Попробуйте через пару минут."
+	case errors.Is(err, errEmptyResponse):
+		return "Модель вернула пустой ответ. Попробуйте переформулировать вопрос."
+	case errors.As(err, &providerErr) && providerErr.Retryable:
+		return "Языковая модель перегружена или не отвечает. Попробуйте чуть позже."
+	}
+	return "Извините, произошла ошибка при обработке вашего запроса."
+}
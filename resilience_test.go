@@ -0,0 +1,95 @@
+// resilience_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Провайдер с повторами без задержек поверх mockProvider
+func newTestResilientProvider(mock *mockProvider, retries, threshold int) *resilientStreamer {
+	cfg := defaultConfig()
+	cfg.LLM.MaxRetries = retries
+	cfg.LLM.RetryBaseDelay = 0
+	cfg.LLM.RetryMaxDelay = 0
+	cfg.LLM.BreakerThreshold = threshold
+	cfg.LLM.BreakerCooldown = time.Hour
+	return newResilientProvider(mock, cfg).(*resilientStreamer)
+}
+
+func TestResilientProviderRetries(t *testing.T) {
+	mock := newMockProvider("ответ")
+	serverErr := &llmError{Message: "сбой", Status: 500, Retryable: true}
+	mock.script(mockReply{Err: serverErr}, mockReply{Err: serverErr})
+	provider := newTestResilientProvider(mock, 3, 2)
+
+	resp, err := provider.ChatCompletion(context.Background(), llmRequest{})
+	if err != nil || resp.Content != "ответ" {
+		t.Fatalf("ответ %q, ошибка %v", resp.Content, err)
+	}
+	if n := len(mock.requests()); n != 3 {
+		t.Errorf("попыток %d вместо 3", n)
+	}
+	if provider.breaker.failures != 0 {
+		t.Errorf("успешный запрос с повторами засчитан как сбой: %d", provider.breaker.failures)
+	}
+}
+
+func TestResilientProviderDoesNotRetryPermanentErrors(t *testing.T) {
+	mock := newMockProvider()
+	mock.script(mockReply{Err: &llmError{Message: "ключ", Status: 401}})
+	provider := newTestResilientProvider(mock, 3, 2)
+
+	if _, err := provider.ChatCompletion(context.Background(), llmRequest{}); err == nil {
+		t.Fatal("ошибка потеряна")
+	}
+	if n := len(mock.requests()); n != 1 {
+		t.Errorf("постоянная ошибка повторена: попыток %d", n)
+	}
+}
+
+func TestBreakerCountsLogicalCalls(t *testing.T) {
+	mock := newMockProvider()
+	serverErr := &llmError{Message: "сбой", Status: 503, Retryable: true}
+	for i := 0; i < 6; i++ {
+		mock.script(mockReply{Err: serverErr})
+	}
+	provider := newTestResilientProvider(mock, 2, 2)
+
+	// Первый запрос: три неудачные попытки, но один сбой
+	if _, err := provider.ChatCompletion(context.Background(), llmRequest{}); !errors.Is(err, serverErr) {
+		t.Fatalf("ошибка %v", err)
+	}
+	if provider.breaker.failures != 1 {
+		t.Fatalf("сбоев %d после одного запроса", provider.breaker.failures)
+	}
+	if err := provider.breaker.allow(time.Now()); err != nil {
+		t.Fatalf("цепь разомкнута после одного запроса")
+	}
+
+	// Второй неудачный запрос размыкает цепь
+	provider.ChatCompletion(context.Background(), llmRequest{})
+	if _, err := provider.ChatCompletion(context.Background(), llmRequest{}); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("после двух неудачных запросов ожидалась errCircuitOpen, получено %v", err)
+	}
+	if n := len(mock.requests()); n != 6 {
+		t.Errorf("попыток %d вместо 6", n)
+	}
+}
+
+func TestBreakerIgnoresCancelledCalls(t *testing.T) {
+	mock := newMockProvider()
+	provider := newTestResilientProvider(mock, 0, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := provider.ChatCompletion(ctx, llmRequest{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ошибка %v", err)
+	}
+	if provider.breaker.failures != 0 || provider.breaker.probing {
+		t.Errorf("отмененный запрос изменил размыкатель: %+v", provider.breaker)
+	}
+}
@@ -0,0 +1,142 @@
+// router.go
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Тарифы чатов: в premium по умолчанию отвечает сильная модель
+const (
+	tierBasic   = "basic"
+	tierPremium = "premium"
+)
+
+// Выбранная для запроса модель
+type modelRoute struct {
+	Model    string
+	Fallback string // модель на случай ошибки; пусто — без запасной
+	Reason   string // почему выбрана модель, для журнала
+}
+
+// Выбирает модель для запроса по правилам [routing]: явный умный режим,
+// тариф чата и длина запроса ведут к сильной модели, а нехватка бюджета
+// или квоты пользователя — к дешевой.
+// images — в запросе есть фото: дешевой тогда служит модель [vision],
+// а сильная модель должна понимать изображения.
+func routeModel(userID, chatID int64, promptTokens int, smart, images bool) modelRoute {
+	cheap := config.GPT.Model
+	if images {
+		cheap = config.Vision.Model
+	}
+	route := pickRoute(userID, chatID, promptTokens, smart, cheap)
+	if images {
+		route.Reason = "vision," + route.Reason
+	}
+	return route
+}
+
+func pickRoute(userID, chatID int64, promptTokens int, smart bool, cheap string) modelRoute {
+	strong := config.Routing.StrongModel
+	if strong == "" || strong == cheap {
+		return modelRoute{Model: cheap, Reason: "default"}
+	}
+
+	if reason := lowBudgetReason(userID, chatID); reason != "" {
+		return modelRoute{Model: cheap, Reason: reason}
+	}
+	strongRoute := func(reason string) modelRoute {
+		return modelRoute{Model: strong, Fallback: cheap, Reason: reason}
+	}
+	switch {
+	case smart:
+		return strongRoute("smart")
+	case getChatSettings(chatID).Tier == tierPremium:
+		return strongRoute("tier")
+	case config.Routing.LongPromptTokens > 0 && promptTokens > config.Routing.LongPromptTokens:
+		return strongRoute("long_prompt")
+	}
+	return modelRoute{Model: cheap, Reason: "default"}
+}
+
+// Возвращает причину перейти на дешевую модель, если бюджета или квоты осталось мало
+func lowBudgetReason(userID, chatID int64) string {
+	share := config.Routing.LowBudgetShare
+	if share <= 0 {
+		return ""
+	}
+	if limit := config.Budget.MonthlyCap; limit > 0 {
+		if _, month := spentUSD(); limit-month < limit*share {
+			return "low_budget"
+		}
+	}
+	for _, q := range usageQuotas(userID, chatID) {
+		if q.Limit > 0 && float64(q.remaining()) < float64(q.Limit)*share {
+			return "low_quota"
+		}
+	}
+	return ""
+}
+
+// Обработка команды /ask: вопрос без упоминания бота.
+// /ask! включает умный режим — ответ сильной модели.
+func handleAskCommand(ctx *commandContext) {
+	message := ctx.Message
+	smart := strings.HasPrefix(afterCommand(message), "!")
+	query := strings.TrimSpace(strings.TrimPrefix(ctx.RawArgs, "!"))
+	if query == "" {
+		ctx.Bot.Send(tgbotapi.NewMessage(message.Chat.ID, "Напишите вопрос после команды: /ask вопрос или /ask! вопрос для умного режима."))
+		return
+	}
+	requestGPT(ctx.Bot, message, query, smart)
+}
+
+// Обработка команды /tier: тариф чата меняет только владелец бота
+func handleTierCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	if len(ctx.Args) == 0 {
+		ctx.Bot.Send(newHTMLMessage(chatID, fmt.Sprintf("Тариф чата: <b>%s</b>", html.EscapeString(getChatSettings(chatID).Tier))))
+		return
+	}
+	if config.Bot.OwnerID == 0 || ctx.Message.From.ID != config.Bot.OwnerID {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Тариф может менять только владелец бота."))
+		return
+	}
+
+	tier := strings.ToLower(ctx.Args[0])
+	if tier != tierBasic && tier != tierPremium {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Доступные тарифы: basic, premium."))
+		return
+	}
+	overrides := loadChatOverrides(chatID)
+	overrides.Tier = tier
+	if err := saveChatOverrides(chatID, overrides); err != nil {
+		log.Printf("Ошибка при сохранении тарифа чата %d: %v", chatID, err)
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Не удалось сохранить тариф."))
+		return
+	}
+	ctx.Bot.Send(newHTMLMessage(chatID, fmt.Sprintf("Тариф чата: <b>%s</b>", tier)))
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "ask",
+		Usage:       "вопрос",
+		Description: "Задать вопрос модели; /ask! — умный режим",
+		Feature:     "gpt",
+		Handler:     handleAskCommand,
+	})
+	commands.register(&botCommand{
+		Name:        "tier",
+		Usage:       "[basic | premium]",
+		Description: "Тариф чата (только для владельца бота)",
+		Hidden:      true,
+		Feature:     "gpt",
+		Handler:     handleTierCommand,
+	})
+}
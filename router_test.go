@@ -0,0 +1,70 @@
+// router_test.go
+
+package main
+
+import "testing"
+
+func TestRouteModel(t *testing.T) {
+	const premiumChat = 3
+	for _, tc := range []struct {
+		name          string
+		userID        int64
+		chatID        int64
+		promptTokens  int
+		smart, images bool
+		want          modelRoute
+	}{
+		{"default", 1, 2, 100, false, false, modelRoute{Model: "cheap", Reason: "default"}},
+		{"smart", 1, 2, 100, true, false, modelRoute{Model: "strong", Fallback: "cheap", Reason: "smart"}},
+		{"tier", 1, premiumChat, 100, false, false, modelRoute{Model: "strong", Fallback: "cheap", Reason: "tier"}},
+		{"long_prompt", 1, 2, 1001, false, false, modelRoute{Model: "strong", Fallback: "cheap", Reason: "long_prompt"}},
+		{"low_quota", 5, 2, 100, true, false, modelRoute{Model: "cheap", Reason: "low_quota"}},
+		{"vision", 1, 2, 100, false, true, modelRoute{Model: "eye", Reason: "vision,default"}},
+		{"vision smart", 1, 2, 100, true, true, modelRoute{Model: "strong", Fallback: "eye", Reason: "vision,smart"}},
+		{"vision low_quota", 5, premiumChat, 100, false, true, modelRoute{Model: "eye", Reason: "vision,low_quota"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useQuotas(t, 1000)
+			config.GPT.Model = "cheap"
+			config.Vision.Model = "eye"
+			config.Routing.StrongModel = "strong"
+			config.Routing.LongPromptTokens = 1000
+			config.Routing.LowBudgetShare = 0.2
+			if err := saveChatOverrides(premiumChat, chatOverrides{Tier: tierPremium}); err != nil {
+				t.Fatal(err)
+			}
+			// У пятого пользователя осталось меньше 20% дневной квоты
+			recordUsage(5, 2, llmUsage{PromptTokens: 850}, 0)
+
+			if got := routeModel(tc.userID, tc.chatID, tc.promptTokens, tc.smart, tc.images); got != tc.want {
+				t.Errorf("маршрут %+v вместо %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteModelLowBudget(t *testing.T) {
+	useBudget(t)
+	config.Routing.StrongModel = "strong"
+	config.Routing.LowBudgetShare = 0.2
+	if got := routeModel(1, 2, 100, true, false); got.Model != "strong" || got.Fallback != config.GPT.Model {
+		t.Fatalf("при полном бюджете маршрут %+v", got)
+	}
+
+	// Потрачено $8.5 из $10: осталось меньше 20%
+	recordUsage(1, 2, llmUsage{}, 8.5)
+	if got := lowBudgetReason(1, 2); got != "low_budget" {
+		t.Errorf("причина %q вместо low_budget", got)
+	}
+	if got := routeModel(1, 2, 100, true, false); got.Model != config.GPT.Model || got.Fallback != "" || got.Reason != "low_budget" {
+		t.Errorf("маршрут %+v вместо дешевой модели", got)
+	}
+	if got := routeModel(1, 2, 100, true, true); got.Model != config.Vision.Model || got.Reason != "vision,low_budget" {
+		t.Errorf("маршрут с фото %+v вместо модели [vision]", got)
+	}
+
+	config.Routing.LowBudgetShare = 0
+	if got := lowBudgetReason(1, 2); got != "" {
+		t.Errorf("без low_budget_share причина %q", got)
+	}
+}
@@ -0,0 +1,326 @@
+// settings.go
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Раздел хранилища с настройками чатов
+const chatSettingsBucket = "chat_settings"
+
+// Настройки, переопределенные в конкретном чате.
+// Пустое поле означает, что действует значение из конфигурации.
+type chatOverrides struct {
+	GamesEnabled  *bool               `json:"games_enabled,omitempty"`
+	GPTEnabled    *bool               `json:"gpt_enabled,omitempty"`
+	Cooldown      *time.Duration      `json:"cooldown,omitempty"`
+	HistoryWindow *int                `json:"history_window,omitempty"`
+	Triggers      map[string][]string `json:"triggers,omitempty"`
+	Language      string              `json:"language,omitempty"`
+	Persona       string              `json:"persona,omitempty"`
+	CustomPrompt  string              `json:"custom_prompt,omitempty"`
+	Tier          string              `json:"tier,omitempty"`
+	Summary       *bool               `json:"summary,omitempty"`
+	Moderation    string              `json:"moderation,omitempty"`
+}
+
+// Итоговые настройки чата с учетом конфигурации
+type chatSettings struct {
+	GamesEnabled  bool
+	GPTEnabled    bool
+	Cooldown      time.Duration
+	HistoryWindow int
+	Triggers      map[string][]string
+	Language      string
+	Persona       string
+	CustomPrompt  string
+	Tier          string
+	// Сообщения чата запоминаются для /summary; по умолчанию выключено
+	SummaryEnabled bool
+	// Строгость модерации вопросов и ответов модели
+	Moderation string
+}
+
+// Варианты паузы между запросами, которые перебирает кнопка в меню
+var cooldownPresets = []time.Duration{0, 15 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute}
+
+// Варианты размера скользящего окна истории чата
+var historyWindowPresets = []int{0, 5, 10, maxHistoryWindow}
+
+// Максимальный размер скользящего окна истории
+const maxHistoryWindow = 20
+
+// Поддерживаемые языки ответов
+var supportedLanguages = []string{"ru", "en"}
+
+// Возвращает переопределения чата из хранилища
+func loadChatOverrides(chatID int64) chatOverrides {
+	var overrides chatOverrides
+	db.get(chatSettingsBucket, strconv.FormatInt(chatID, 10), &overrides)
+	return overrides
+}
+
+// Сохраняет переопределения чата
+func saveChatOverrides(chatID int64, overrides chatOverrides) error {
+	return db.put(chatSettingsBucket, strconv.FormatInt(chatID, 10), overrides)
+}
+
+// Возвращает действующие настройки чата
+func getChatSettings(chatID int64) chatSettings {
+	overrides := loadChatOverrides(chatID)
+	settings := chatSettings{
+		GamesEnabled:  true,
+		GPTEnabled:    true,
+		Cooldown:      config.GPT.RequestInterval,
+		HistoryWindow: config.GPT.HistoryWindow,
+		Triggers: map[string][]string{
+			"duel":     config.Triggers.Duel,
+			"roulette": config.Triggers.Roulette,
+		},
+		Language:   config.Bot.Language,
+		Persona:    config.GPT.Persona,
+		Tier:       tierBasic,
+		Moderation: config.Moderation.Level,
+	}
+	if overrides.GamesEnabled != nil {
+		settings.GamesEnabled = *overrides.GamesEnabled
+	}
+	if overrides.GPTEnabled != nil {
+		settings.GPTEnabled = *overrides.GPTEnabled
+	}
+	if overrides.Cooldown != nil {
+		settings.Cooldown = *overrides.Cooldown
+	}
+	if overrides.HistoryWindow != nil {
+		settings.HistoryWindow = *overrides.HistoryWindow
+	}
+	for command, keywords := range overrides.Triggers {
+		settings.Triggers[command] = keywords
+	}
+	if overrides.Language != "" {
+		settings.Language = overrides.Language
+	}
+	if overrides.Persona != "" {
+		settings.Persona = overrides.Persona
+		settings.CustomPrompt = overrides.CustomPrompt
+	}
+	if overrides.Tier != "" {
+		settings.Tier = overrides.Tier
+	}
+	if overrides.Summary != nil {
+		settings.SummaryEnabled = *overrides.Summary
+	}
+	if overrides.Moderation != "" {
+		settings.Moderation = overrides.Moderation
+	}
+	return settings
+}
+
+// Проверяет, включена ли функция бота в чате.
+// Функции GPT недоступны, если провайдер модели не настроен.
+func featureEnabled(chatID int64, feature string) bool {
+	return getChatSettings(chatID).featureEnabled(feature)
+}
+
+// То же для уже загруженных настроек чата
+func (settings chatSettings) featureEnabled(feature string) bool {
+	switch feature {
+	case "games":
+		return settings.GamesEnabled
+	case "gpt":
+		return llm != nil && settings.GPTEnabled
+	}
+	return true
+}
+
+// Проверяет, является ли пользователь администратором чата.
+// В личной переписке пользователь управляет настройками сам.
+func isChatAdmin(bot *tgbotapi.BotAPI, chat *tgbotapi.Chat, userID int64) bool {
+	if chat.IsPrivate() {
+		return true
+	}
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: userID},
+	})
+	if err != nil {
+		log.Printf("Не удалось проверить права пользователя %d в чате %d: %v", userID, chat.ID, err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// Текст меню настроек
+func settingsText(settings chatSettings) string {
+	var text strings.Builder
+	text.WriteString("<b>Настройки чата</b>\n")
+	for _, command := range []string{"duel", "roulette"} {
+		fmt.Fprintf(&text, "\nТриггеры /%s: %s", command, html.EscapeString(strings.Join(settings.Triggers[command], ", ")))
+	}
+	text.WriteString("\n\nИзменить триггеры: /settings triggers duel дуэль,вызов")
+	return text.String()
+}
+
+// Клавиатура меню настроек
+func settingsKeyboard(settings chatSettings) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Игры: "+onOff(settings.GamesEnabled), "settings|games"),
+			tgbotapi.NewInlineKeyboardButtonData("GPT: "+onOff(settings.GPTEnabled), "settings|gpt"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Пауза GPT: "+formatCooldown(settings.Cooldown), "settings|cooldown"),
+			tgbotapi.NewInlineKeyboardButtonData("Язык: "+settings.Language, "settings|language"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("История чата: "+formatHistoryWindow(settings.HistoryWindow), "settings|history"),
+			tgbotapi.NewInlineKeyboardButtonData("Сводки: "+onOff(settings.SummaryEnabled), "settings|summary"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Сбросить", "settings|reset"),
+		),
+	)
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "вкл"
+	}
+	return "выкл"
+}
+
+func formatCooldown(cooldown time.Duration) string {
+	if cooldown == 0 {
+		return "нет"
+	}
+	return cooldown.String()
+}
+
+// Обработка команды /settings
+func handleSettingsCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	if !isChatAdmin(ctx.Bot, ctx.Message.Chat, ctx.Message.From.ID) {
+		msg := tgbotapi.NewMessage(chatID, "Настройки могут менять только администраторы чата.")
+		ctx.Bot.Send(msg)
+		return
+	}
+
+	// /settings triggers <команда> <слово,слово>
+	if len(ctx.Args) > 0 && ctx.Args[0] == "triggers" {
+		if len(ctx.Args) < 3 {
+			msg := tgbotapi.NewMessage(chatID, "Использование: /settings triggers duel дуэль,вызов")
+			ctx.Bot.Send(msg)
+			return
+		}
+		command := ctx.Args[1]
+		if command != "duel" && command != "roulette" {
+			msg := tgbotapi.NewMessage(chatID, "Триггеры можно задать только для duel и roulette.")
+			ctx.Bot.Send(msg)
+			return
+		}
+		var keywords []string
+		for _, keyword := range strings.Split(strings.Join(ctx.Args[2:], " "), ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				keywords = append(keywords, strings.ToLower(keyword))
+			}
+		}
+
+		overrides := loadChatOverrides(chatID)
+		if overrides.Triggers == nil {
+			overrides.Triggers = make(map[string][]string)
+		}
+		overrides.Triggers[command] = keywords
+		if err := saveChatOverrides(chatID, overrides); err != nil {
+			log.Printf("Ошибка при сохранении настроек чата %d: %v", chatID, err)
+		}
+	}
+
+	settings := getChatSettings(chatID)
+	msg := newHTMLMessage(chatID, settingsText(settings))
+	msg.ReplyMarkup = settingsKeyboard(settings)
+	ctx.Bot.Send(msg)
+}
+
+// Обработка нажатий в меню настроек
+func handleSettingsCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery, args []string) {
+	chat := callback.Message.Chat
+	if len(args) == 0 {
+		return
+	}
+	if !isChatAdmin(bot, chat, callback.From.ID) {
+		bot.Request(tgbotapi.NewCallbackWithAlert(callback.ID, "Настройки могут менять только администраторы чата."))
+		return
+	}
+
+	settings := getChatSettings(chat.ID)
+	overrides := loadChatOverrides(chat.ID)
+	switch args[0] {
+	case "games":
+		enabled := !settings.GamesEnabled
+		overrides.GamesEnabled = &enabled
+	case "gpt":
+		enabled := !settings.GPTEnabled
+		overrides.GPTEnabled = &enabled
+	case "cooldown":
+		next := cooldownPresets[0]
+		for i, preset := range cooldownPresets {
+			if preset == settings.Cooldown && i+1 < len(cooldownPresets) {
+				next = cooldownPresets[i+1]
+			}
+		}
+		overrides.Cooldown = &next
+	case "history":
+		next := historyWindowPresets[0]
+		for i, preset := range historyWindowPresets {
+			if preset == settings.HistoryWindow && i+1 < len(historyWindowPresets) {
+				next = historyWindowPresets[i+1]
+			}
+		}
+		overrides.HistoryWindow = &next
+	case "language":
+		next := supportedLanguages[0]
+		for i, language := range supportedLanguages {
+			if language == settings.Language && i+1 < len(supportedLanguages) {
+				next = supportedLanguages[i+1]
+			}
+		}
+		overrides.Language = next
+	case "summary":
+		enabled := !settings.SummaryEnabled
+		overrides.Summary = &enabled
+	case "reset":
+		overrides = chatOverrides{}
+	default:
+		return
+	}
+	if err := saveChatOverrides(chat.ID, overrides); err != nil {
+		log.Printf("Ошибка при сохранении настроек чата %d: %v", chat.ID, err)
+	}
+
+	settings = getChatSettings(chat.ID)
+	if !settings.SummaryEnabled {
+		// После выключения сводок сохраненные сообщения больше не нужны
+		chatBuffer.clear(chat.ID)
+	}
+	edit := tgbotapi.NewEditMessageTextAndMarkup(chat.ID, callback.Message.MessageID, settingsText(settings), settingsKeyboard(settings))
+	edit.ParseMode = tgbotapi.ModeHTML
+	bot.Send(edit)
+	bot.Request(tgbotapi.NewCallback(callback.ID, "Сохранено"))
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "settings",
+		Usage:       "[triggers команда слова]",
+		Description: "Настройки чата (только для администраторов)",
+		Handler:     handleSettingsCommand,
+	})
+	commands.registerCallback("settings", handleSettingsCallback)
+}
@@ -0,0 +1,368 @@
+// speech.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Голосовое сообщение длиннее допустимого
+var errAudioTooLong = errors.New("голосовое сообщение слишком длинное")
+
+// Telegram не сообщил ни длину, ни размер записи
+var errAudioLengthUnknown = errors.New("длина записи неизвестна")
+
+// Битрейт для оценки длины записи по размеру файла, если Telegram не прислал
+// длину: 16 кбит/с ниже битрейта почти любой записи, поэтому длина и цена
+// получаются с запасом
+const speechMinBytesPerSecond = 2000
+
+// Аудиозапись для расшифровки
+type speechAudio struct {
+	Data     []byte
+	FileName string // имя файла подсказывает серверу формат записи
+}
+
+// Провайдер распознавания речи
+type speechProvider interface {
+	// Имя провайдера для логов
+	Name() string
+	// Переводит запись в текст
+	Transcribe(ctx context.Context, audio speechAudio) (string, error)
+}
+
+// Текущий провайдер распознавания речи; nil — расшифровка отключена
+var speech speechProvider
+
+// Создает провайдера распознавания речи по конфигурации.
+// Возвращает nil без ошибки, если провайдер не настроен.
+func newSpeechProvider(cfg *Config) (speechProvider, error) {
+	apiKey := cfg.Speech.APIKey
+	if apiKey == "" {
+		apiKey = cfg.LLM.APIKey
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+
+	switch cfg.Speech.Provider {
+	case "":
+		// Без явного выбора используем Whisper API, если задан ключ OpenAI
+		if apiKey == "" {
+			return nil, nil
+		}
+		return newOpenAISpeechProvider(apiKey, cfg), nil
+	case "none":
+		return nil, nil
+	case "openai":
+		if apiKey == "" {
+			return nil, errors.New("для распознавания речи openai нужен OPENAI_API_KEY или [speech] api_key")
+		}
+		return newOpenAISpeechProvider(apiKey, cfg), nil
+	case "whisper_cpp":
+		if cfg.Speech.BaseURL == "" {
+			return nil, errors.New("для распознавания речи whisper_cpp нужен [speech] base_url")
+		}
+		return &whisperCppProvider{
+			url:      strings.TrimRight(cfg.Speech.BaseURL, "/") + "/inference",
+			language: cfg.Speech.Language,
+			client:   &http.Client{Timeout: cfg.Speech.Timeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("неизвестный провайдер распознавания речи %q", cfg.Speech.Provider)
+}
+
+// Распознавание через Whisper API OpenAI или совместимый сервер
+type openAISpeechProvider struct {
+	client   *openai.Client
+	model    string
+	language string
+	timeout  time.Duration
+}
+
+func newOpenAISpeechProvider(apiKey string, cfg *Config) *openAISpeechProvider {
+	clientConfig := openai.DefaultConfig(apiKey)
+	if cfg.Speech.BaseURL != "" {
+		clientConfig.BaseURL = cfg.Speech.BaseURL
+	}
+	return &openAISpeechProvider{
+		client:   openai.NewClientWithConfig(clientConfig),
+		model:    cfg.Speech.Model,
+		language: cfg.Speech.Language,
+		timeout:  cfg.Speech.Timeout,
+	}
+}
+
+func (p *openAISpeechProvider) Name() string {
+	return "openai"
+}
+
+func (p *openAISpeechProvider) Transcribe(ctx context.Context, audio speechAudio) (string, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	resp, err := p.client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    p.model,
+		FilePath: audio.FileName,
+		Reader:   bytes.NewReader(audio.Data),
+		Language: p.language,
+		Format:   openai.AudioResponseFormatJSON,
+	})
+	if err != nil {
+		return "", openAIError(err)
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// Распознавание через локальный сервер whisper.cpp (examples/server)
+type whisperCppProvider struct {
+	url      string
+	language string
+	client   *http.Client
+}
+
+func (p *whisperCppProvider) Name() string {
+	return "whisper_cpp"
+}
+
+func (p *whisperCppProvider) Transcribe(ctx context.Context, audio speechAudio) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", audio.FileName)
+	if err != nil {
+		return "", err
+	}
+	part.Write(audio.Data)
+	form.WriteField("response_format", "json")
+	form.WriteField("temperature", "0")
+	if p.language != "" {
+		form.WriteField("language", p.language)
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", &llmError{Message: "сервер whisper.cpp недоступен: " + err.Error(), Retryable: true, Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Text  string `json:"text"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil || resp.StatusCode != http.StatusOK || result.Error != "" {
+		message := result.Error
+		if message == "" {
+			message = strings.TrimSpace(string(data))
+		}
+		return "", &llmError{
+			Message:   fmt.Sprintf("whisper.cpp вернул статус %d: %s", resp.StatusCode, message),
+			Status:    resp.StatusCode,
+			Retryable: resp.StatusCode >= 500,
+		}
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// Голосовая запись сообщения: голосовое, аудиофайл или видеокружок
+func messageAudio(message *tgbotapi.Message) (fileID string, duration, fileSize int, fileName string, ok bool) {
+	switch {
+	case message.Voice != nil:
+		return message.Voice.FileID, message.Voice.Duration, message.Voice.FileSize, "voice.ogg", true
+	case message.Audio != nil:
+		name := message.Audio.FileName
+		if name == "" {
+			name = "audio.mp3"
+		}
+		return message.Audio.FileID, message.Audio.Duration, message.Audio.FileSize, name, true
+	case message.VideoNote != nil:
+		return message.VideoNote.FileID, message.VideoNote.Duration, message.VideoNote.FileSize, "video_note.mp4", true
+	}
+	return "", 0, 0, "", false
+}
+
+// Длина записи в секундах. Если Telegram ее не прислал, оценивается
+// по размеру файла с запасом; без размера запись не расшифровывается.
+func audioDuration(duration, fileSize int) (int, error) {
+	if duration > 0 {
+		return duration, nil
+	}
+	if fileSize <= 0 {
+		return 0, errAudioLengthUnknown
+	}
+	return (fileSize + speechMinBytesPerSecond - 1) / speechMinBytesPerSecond, nil
+}
+
+// Скачивает запись и переводит ее в текст.
+// Распознавание учитывается в расходах пользователя и чата по цене за минуту.
+func transcribeMessage(ctx context.Context, bot *tgbotapi.BotAPI, message, voice *tgbotapi.Message) (string, error) {
+	fileID, duration, fileSize, fileName, _ := messageAudio(voice)
+	duration, err := audioDuration(duration, fileSize)
+	if err != nil {
+		return "", err
+	}
+	if limit := config.Speech.MaxDuration; limit > 0 && time.Duration(duration)*time.Second > limit {
+		return "", errAudioTooLong
+	}
+	cost := config.Speech.PricePerMinute * float64(duration) / 60
+	if !reserveBudget(cost) {
+		return "", errBudgetExhausted
+	}
+	defer releaseBudget(cost)
+	data, err := downloadTelegramFile(ctx, bot, fileID, config.Speech.MaxFileBytes)
+	if err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	text, err := speech.Transcribe(ctx, speechAudio{Data: data, FileName: fileName})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Расшифрована запись длиной %d с через %s за %v", duration, speech.Name(), time.Since(started).Round(time.Millisecond))
+
+	recordSpeechUsage(message.From.ID, message.Chat.ID, duration, cost)
+	return text, nil
+}
+
+// Текст ошибки расшифровки для пользователя
+func speechErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, errAudioTooLong):
+		return fmt.Sprintf("Запись слишком длинная: расшифровываю не больше %d с.", int(config.Speech.MaxDuration.Seconds()))
+	case errors.Is(err, errAudioLengthUnknown):
+		return "Не удалось узнать длину записи, поэтому расшифровать ее нельзя."
+	case errors.Is(err, errFileTooLarge):
+		return fmt.Sprintf("Файл записи слишком большой: не больше %d МБ.", config.Speech.MaxFileBytes>>20)
+	case errors.Is(err, errBudgetExhausted):
+		return gptErrorMessage(err)
+	case isRetryableLLMError(err):
+		return "Сервис распознавания речи сейчас недоступен. Попробуйте позже."
+	}
+	return "Не удалось расшифровать запись."
+}
+
+// Проверяет ограничения и ставит расшифровку записи в очередь.
+// Если answer, на расшифрованный текст отвечает модель.
+func requestTranscription(bot *tgbotapi.BotAPI, message, voice *tgbotapi.Message, answer bool) {
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	settings := getChatSettings(chatID)
+
+	if !checkRateLimit(bot, message, gptRateLimits(userID, chatID, settings)...) {
+		return
+	}
+	if !checkQuota(bot, chatID, userID) {
+		return
+	}
+
+	submitGPTJob(bot, chatID, userID, message.MessageID, func(ctx context.Context) {
+		bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
+		text, err := transcribeMessage(ctx, bot, message, voice)
+		if err != nil {
+			log.Printf("Ошибка при расшифровке записи: %v", err)
+			msg := tgbotapi.NewMessage(chatID, speechErrorMessage(err))
+			msg.ReplyToMessageID = voice.MessageID
+			bot.Send(msg)
+			return
+		}
+		if text == "" {
+			msg := tgbotapi.NewMessage(chatID, "В записи не удалось разобрать речь.")
+			msg.ReplyToMessageID = voice.MessageID
+			bot.Send(msg)
+			return
+		}
+
+		msg := newHTMLMessage(chatID, "🎤 <i>"+html.EscapeString(text)+"</i>")
+		msg.ReplyToMessageID = voice.MessageID
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("Ошибка при отправке расшифровки: %v", err)
+		}
+
+		if answer && llm != nil {
+			answerGPT(ctx, bot, message, text, settings, false)
+		}
+	})
+}
+
+// Голосовое сообщение, адресованное боту: ответ на сообщение бота
+// или запись с упоминанием бота в подписи. Как и вопросы модели,
+// расшифровка выключается вместе с GPT в настройках чата.
+func handleVoice(bot *tgbotapi.BotAPI, message *tgbotapi.Message) bool {
+	if speech == nil || message.IsCommand() || !getChatSettings(message.Chat.ID).GPTEnabled {
+		return false
+	}
+	if _, _, _, _, ok := messageAudio(message); !ok {
+		return false
+	}
+
+	addressed := repliesToBot(bot, message)
+	for _, m := range parseMentions(message.Caption, message.CaptionEntities) {
+		if m.refersTo(bot.Self) {
+			addressed = true
+			break
+		}
+	}
+	if !addressed {
+		return false
+	}
+
+	requestTranscription(bot, message, message, config.Speech.Answer)
+	return true
+}
+
+// Обработка команды /transcribe: расшифровка записи, на которую ответили
+func handleTranscribeCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	if speech == nil {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Распознавание речи не настроено."))
+		return
+	}
+	voice := ctx.Message.ReplyToMessage
+	if voice == nil {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "Ответьте командой /transcribe на голосовое сообщение."))
+		return
+	}
+	if _, _, _, _, ok := messageAudio(voice); !ok {
+		ctx.Bot.Send(tgbotapi.NewMessage(chatID, "В этом сообщении нет голосовой записи."))
+		return
+	}
+	requestTranscription(ctx.Bot, ctx.Message, voice, false)
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "transcribe",
+		Description: "Расшифровать голосовое сообщение (ответом на него)",
+		Feature:     "gpt",
+		Handler:     handleTranscribeCommand,
+	})
+}
@@ -0,0 +1,63 @@
+// speech_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestAudioDuration(t *testing.T) {
+	for _, tc := range []struct {
+		duration, fileSize int
+		want               int
+		err                error
+	}{
+		{30, 1 << 20, 30, nil},
+		{0, 60 * speechMinBytesPerSecond, 60, nil},
+		{0, 60*speechMinBytesPerSecond + 1, 61, nil},
+		{0, 0, 0, errAudioLengthUnknown},
+	} {
+		got, err := audioDuration(tc.duration, tc.fileSize)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("audioDuration(%d, %d) = %d, %v", tc.duration, tc.fileSize, got, err)
+		}
+	}
+}
+
+// Записи без длины проверяются до скачивания, поэтому бот не нужен
+func TestTranscribeWithoutDuration(t *testing.T) {
+	useBudget(t)
+	config.Speech.MaxDuration = 5 * time.Minute
+	config.Speech.PricePerMinute = 1
+	message := &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 2}}
+
+	for _, tc := range []struct {
+		name  string
+		voice *tgbotapi.Message
+		err   error
+	}{
+		{"без длины и размера", &tgbotapi.Message{Audio: &tgbotapi.Audio{FileID: "a"}}, errAudioLengthUnknown},
+		{"длинная по размеру", &tgbotapi.Message{Voice: &tgbotapi.Voice{FileID: "v", FileSize: 301 * speechMinBytesPerSecond}}, errAudioTooLong},
+		{"длинная по длине", &tgbotapi.Message{VideoNote: &tgbotapi.VideoNote{FileID: "n", Duration: 301}}, errAudioTooLong},
+	} {
+		if _, err := transcribeMessage(context.Background(), nil, message, tc.voice); !errors.Is(err, tc.err) {
+			t.Errorf("%s: ошибка %v вместо %v", tc.name, err, tc.err)
+		}
+	}
+
+	// Оценка длины по размеру учитывается в бюджете: $9.5 уже потрачено,
+	// а пять минут по цене $1 за минуту в остаток не помещаются
+	recordUsage(1, 2, llmUsage{}, 9.5)
+	voice := &tgbotapi.Message{Audio: &tgbotapi.Audio{FileID: "a", FileSize: 300 * speechMinBytesPerSecond}}
+	if _, err := transcribeMessage(context.Background(), nil, message, voice); !errors.Is(err, errBudgetExhausted) {
+		t.Errorf("ошибка %v вместо исчерпанного бюджета", err)
+	}
+	if reserved := budgetReserved; reserved != 0 {
+		t.Errorf("после отказа в резерве осталось $%v", reserved)
+	}
+}
@@ -0,0 +1,285 @@
+// storage.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Журнал, меньше которого снимок не перезаписывается
+const storeMinCompactBytes = 1 << 20
+
+// Простое хранилище данных чатов в JSON-файле.
+// Данные разложены по разделам (bucket) и ключам. Каждое изменение
+// сразу дописывается одной строкой в журнал рядом с файлом, а весь файл
+// перезаписывается, только когда журнал становится больше снимка.
+type jsonStore struct {
+	mu            sync.Mutex
+	path          string
+	buckets       map[string]map[string]json.RawMessage
+	journal       *os.File
+	journalBytes  int64
+	snapshotBytes int64
+}
+
+// Изменение одного раздела; строка журнала — список изменений,
+// сохраненных вместе
+type storeRecord struct {
+	Bucket string                     `json:"bucket"`
+	Set    map[string]json.RawMessage `json:"set,omitempty"`
+	Remove []string                   `json:"remove,omitempty"`
+}
+
+// Хранилище, используемое ботом
+var db = newMemoryStore()
+
+// Хранилище без файла: данные живут до перезапуска
+func newMemoryStore() *jsonStore {
+	return &jsonStore{buckets: make(map[string]map[string]json.RawMessage)}
+}
+
+// Открывает хранилище, загружая данные из файла, если он существует
+func openStore(path string) (*jsonStore, error) {
+	store := newMemoryStore()
+	store.path = path
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store.buckets); err != nil {
+			return nil, err
+		}
+		if store.buckets == nil {
+			store.buckets = make(map[string]map[string]json.RawMessage)
+		}
+	}
+	store.snapshotBytes = int64(len(data))
+
+	replayed, err := store.replayJournal()
+	if err != nil {
+		return nil, err
+	}
+	if store.journal, err = os.OpenFile(store.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	// Изменения из журнала сразу переносятся в снимок
+	if replayed {
+		if err := store.compactLocked(); err != nil {
+			store.journal.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Файл журнала изменений рядом с основным файлом
+func (s *jsonStore) journalPath() string {
+	return s.path + ".journal"
+}
+
+// Применяет к данным изменения из журнала. Недописанная при сбое
+// последняя строка и все после нее пропускаются.
+func (s *jsonStore) replayJournal() (bool, error) {
+	file, err := os.Open(s.journalPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	replayed := false
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var records []storeRecord
+			if err != nil || json.Unmarshal(line, &records) != nil {
+				log.Printf("Журнал хранилища %s поврежден, остаток пропущен", s.journalPath())
+				return true, nil
+			}
+			for _, record := range records {
+				s.applyLocked(record)
+			}
+			replayed = true
+		}
+		if err != nil {
+			break
+		}
+	}
+	return replayed, nil
+}
+
+// Читает значение по ключу в v. Возвращает false, если ключа нет.
+func (s *jsonStore) get(bucket, key string, v interface{}) bool {
+	s.mu.Lock()
+	raw, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, v) == nil
+}
+
+// Сохраняет значение по ключу
+func (s *jsonStore) put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeLocked(storeRecord{Bucket: bucket, Set: map[string]json.RawMessage{key: raw}})
+}
+
+// Сохраняет несколько значений раздела одной записью журнала
+func (s *jsonStore) putAll(bucket string, values map[string]interface{}) error {
+	return s.putBatch(map[string]map[string]interface{}{bucket: values})
+}
+
+// Сохраняет значения нескольких разделов одной записью журнала:
+// после сбоя они восстанавливаются либо все, либо ни одно
+func (s *jsonStore) putBatch(values map[string]map[string]interface{}) error {
+	var records []storeRecord
+	for bucket, bucketValues := range values {
+		if len(bucketValues) == 0 {
+			continue
+		}
+		raws := make(map[string]json.RawMessage, len(bucketValues))
+		for key, v := range bucketValues {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			raws[key] = raw
+		}
+		records = append(records, storeRecord{Bucket: bucket, Set: raws})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeLocked(records...)
+}
+
+// Удаляет значения по ключам
+func (s *jsonStore) remove(bucket string, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []string
+	for _, key := range keys {
+		if _, ok := s.buckets[bucket][key]; ok {
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return s.writeLocked(storeRecord{Bucket: bucket, Remove: removed})
+}
+
+// Возвращает отсортированный список ключей раздела
+func (s *jsonStore) keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Применяет изменение к данным в памяти
+func (s *jsonStore) applyLocked(record storeRecord) {
+	if len(record.Set) > 0 && s.buckets[record.Bucket] == nil {
+		s.buckets[record.Bucket] = make(map[string]json.RawMessage)
+	}
+	for key, raw := range record.Set {
+		s.buckets[record.Bucket][key] = raw
+	}
+	for _, key := range record.Remove {
+		delete(s.buckets[record.Bucket], key)
+	}
+}
+
+// Применяет изменения и дописывает их в журнал одной строкой
+func (s *jsonStore) writeLocked(records ...storeRecord) error {
+	for _, record := range records {
+		s.applyLocked(record)
+	}
+	if s.journal == nil {
+		return nil
+	}
+	line, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	n, err := s.journal.Write(append(line, '\n'))
+	s.journalBytes += int64(n)
+	// После неудачной записи в журнале может остаться обрывок строки,
+	// поэтому все данные сразу сохраняются снимком
+	if err != nil || s.journalBytes > max(s.snapshotBytes, storeMinCompactBytes) {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Записывает все данные в основной файл и очищает журнал.
+// Сбой между этими шагами безопасен: повтор журнала ничего не меняет.
+func (s *jsonStore) compactLocked() error {
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	s.journalBytes = 0
+	return nil
+}
+
+// Записывает все данные на диск атомарной заменой файла
+func (s *jsonStore) flushLocked() error {
+	data, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.snapshotBytes = int64(len(data))
+	return nil
+}
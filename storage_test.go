@@ -0,0 +1,151 @@
+// storage_test.go
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Открывает хранилище во временном каталоге
+func openTestStore(t *testing.T, path string) *jsonStore {
+	t.Helper()
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.journal.Close() })
+	return store
+}
+
+func TestStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store := openTestStore(t, path)
+	if err := store.put("chats", "1", map[string]int{"score": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.putAll("chats", map[string]interface{}{"2": "two", "3": []int{3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.remove("chats", "3", "missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestStore(t, path)
+	if got := reopened.keys("chats"); !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("ключи после повторного открытия: %v", got)
+	}
+	var value map[string]int
+	if !reopened.get("chats", "1", &value) || value["score"] != 3 {
+		t.Errorf("значение после повторного открытия: %v", value)
+	}
+}
+
+func TestStorePutAppendsToJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store := openTestStore(t, path)
+	for i := 0; i < 10; i++ {
+		if err := store.put("chats", "1", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Небольшие изменения не перезаписывают основной файл
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("основной файл записан до сжатия журнала: %v", err)
+	}
+	journal, err := os.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(journal), "\n"); lines != 10 {
+		t.Errorf("в журнале %d строк вместо 10", lines)
+	}
+}
+
+func TestStoreCompactsLargeJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store := openTestStore(t, path)
+	value := strings.Repeat("x", 64<<10)
+	for i := 0; i < 20; i++ {
+		if err := store.put("chats", "1", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > storeMinCompactBytes {
+		t.Errorf("журнал не сжат: %d байт", info.Size())
+	}
+	reopened := openTestStore(t, path)
+	var got string
+	if !reopened.get("chats", "1", &got) || got != value {
+		t.Errorf("значение потеряно после сжатия журнала")
+	}
+}
+
+func TestStoreSkipsTornJournalLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store := openTestStore(t, path)
+	if err := store.put("chats", "1", "one"); err != nil {
+		t.Fatal(err)
+	}
+	// Запись прервалась посреди строки
+	if _, err := store.journal.WriteString(`[{"bucket":"chats","set":{"2":`); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestStore(t, path)
+	if got := reopened.keys("chats"); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Fatalf("ключи после обрыва журнала: %v", got)
+	}
+	// Журнал перенесен в снимок, новые записи не смешиваются с обрывком
+	if err := reopened.put("chats", "3", "three"); err != nil {
+		t.Fatal(err)
+	}
+	again := openTestStore(t, path)
+	if got := again.keys("chats"); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("ключи после новой записи: %v", got)
+	}
+}
+
+func TestStorePutBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	store := openTestStore(t, path)
+	err := store.putBatch(map[string]map[string]interface{}{
+		"chats": {"1": "one", "2": "two"},
+		"index": {"day": []string{"1", "2"}},
+		"empty": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal, err := os.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(journal), "\n"); lines != 1 {
+		t.Errorf("пакет записан %d строками журнала вместо одной", lines)
+	}
+
+	reopened := openTestStore(t, path)
+	var index []string
+	if !reopened.get("index", "day", &index) || len(reopened.keys("chats")) != 2 || len(index) != 2 {
+		t.Errorf("пакет восстановлен не полностью: %v, %v", reopened.keys("chats"), index)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	if err := store.put("chats", "1", "one"); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if !store.get("chats", "1", &got) || got != "one" {
+		t.Errorf("значение в памяти: %q", got)
+	}
+}
@@ -0,0 +1,107 @@
+// streaming.go
+
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Текст сообщения-заглушки, пока модель не прислала первые слова
+const streamPlaceholder = "…"
+
+// Максимальная длина текста сообщения Telegram
+const telegramMessageLimit = 4096
+
+// Сообщение бота, которое дописывается по мере генерации ответа.
+// Правки отправляются не чаще interval, чтобы не упираться в лимиты Telegram.
+type streamingReply struct {
+	bot       *tgbotapi.BotAPI
+	chatID    int64
+	messageID int
+	interval  time.Duration
+	lastEdit  time.Time
+	shown     string
+	text      strings.Builder
+}
+
+// Отправляет заглушку в ответ на сообщение пользователя
+func startStreamingReply(bot *tgbotapi.BotAPI, chatID int64, replyTo int, interval time.Duration) (*streamingReply, error) {
+	msg := tgbotapi.NewMessage(chatID, streamPlaceholder)
+	msg.ReplyToMessageID = replyTo
+	sent, err := bot.Send(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &streamingReply{
+		bot:       bot,
+		chatID:    chatID,
+		messageID: sent.MessageID,
+		interval:  interval,
+		lastEdit:  time.Now(),
+		shown:     streamPlaceholder,
+	}, nil
+}
+
+// Добавляет фрагмент ответа и при необходимости обновляет сообщение
+func (r *streamingReply) append(delta string) {
+	r.text.WriteString(delta)
+	if time.Since(r.lastEdit) < r.interval {
+		return
+	}
+	r.edit(r.text.String() + " " + streamPlaceholder)
+}
+
+// Сбрасывает накопленный текст и возвращает заглушку, например когда
+// вместо ответа модель вызвала инструменты и ответ начнется заново
+func (r *streamingReply) reset() {
+	r.text.Reset()
+	r.edit(streamPlaceholder)
+}
+
+// Заменяет сообщение итоговым текстом
+func (r *streamingReply) finish(text string) {
+	r.edit(text)
+}
+
+// Заменяет сообщение частью ответа в разметке HTML.
+// Если Telegram не принял разметку, текст отправляется как есть.
+func (r *streamingReply) finishFormatted(markdown string, markup *tgbotapi.InlineKeyboardMarkup) error {
+	edit := tgbotapi.NewEditMessageText(r.chatID, r.messageID, renderMarkdownHTML(markdown))
+	edit.ParseMode = tgbotapi.ModeHTML
+	edit.ReplyMarkup = markup
+	if _, err := r.bot.Send(edit); err == nil {
+		return nil
+	}
+	edit = tgbotapi.NewEditMessageText(r.chatID, r.messageID, markdown)
+	edit.ReplyMarkup = markup
+	_, err := r.bot.Send(edit)
+	return err
+}
+
+// Правит сообщение, если текст изменился
+func (r *streamingReply) edit(text string) {
+	text = truncateMessage(strings.TrimSpace(text))
+	if text == "" || text == r.shown {
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(r.chatID, r.messageID, text)
+	if _, err := r.bot.Send(edit); err != nil {
+		// Ошибка правки не прерывает генерацию: попробуем в следующий раз
+		return
+	}
+	r.shown = text
+	r.lastEdit = time.Now()
+}
+
+// Обрезает текст до лимита длины сообщения Telegram
+func truncateMessage(text string) string {
+	if utf8.RuneCountInString(text) <= telegramMessageLimit {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:telegramMessageLimit-1]) + "…"
+}
@@ -0,0 +1,396 @@
+// summary.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Раздел хранилища с пользователями, запретившими сохранять свои сообщения для сводок
+const summaryOptOutBucket = "summary_optout"
+
+// Сколько раз сводки частей можно сводить заново, прежде чем обрезать остаток
+const maxSummaryLevels = 3
+
+// Промпты сводки: для фрагмента длинной истории и для итоговой сводки
+const (
+	summaryChunkPrompt = "Ниже фрагмент переписки группового чата. Кратко перескажи, о чем шла речь, " +
+		"сохраняя имена участников, договоренности и важные детали."
+	summaryFinalPrompt = "Ниже переписка группового чата или пересказы ее частей по порядку. " +
+		"Составь короткую сводку: основные темы, к чему пришли, какие вопросы остались открытыми. " +
+		"Упоминай участников по именам, не выдумывай того, чего нет в тексте."
+)
+
+// Сообщение чата в буфере для сводок
+type bufferedMessage struct {
+	Time   time.Time
+	UserID int64
+	Name   string
+	Text   string
+}
+
+// Кольцевой буфер последних сообщений одного чата
+type messageRing struct {
+	items []bufferedMessage
+	next  int // куда запишется следующее сообщение
+	full  bool
+}
+
+func newMessageRing(capacity int) *messageRing {
+	return &messageRing{items: make([]bufferedMessage, capacity)}
+}
+
+func (r *messageRing) add(message bufferedMessage) {
+	r.items[r.next] = message
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Сообщения от старых к новым
+func (r *messageRing) list() []bufferedMessage {
+	if !r.full {
+		return append([]bufferedMessage(nil), r.items[:r.next]...)
+	}
+	return append(append([]bufferedMessage(nil), r.items[r.next:]...), r.items[:r.next]...)
+}
+
+// Оставляет в буфере только сообщения, для которых keep вернул true
+func (r *messageRing) filter(keep func(bufferedMessage) bool) *messageRing {
+	filtered := newMessageRing(len(r.items))
+	for _, message := range r.list() {
+		if keep(message) {
+			filtered.add(message)
+		}
+	}
+	return filtered
+}
+
+// Буферы сообщений чатов, где включены сводки.
+// Хранятся только в памяти: после перезапуска бота история начинается заново.
+type chatBuffers struct {
+	mu    sync.Mutex
+	chats map[int64]*messageRing
+}
+
+var chatBuffer = &chatBuffers{chats: make(map[int64]*messageRing)}
+
+func (b *chatBuffers) add(chatID int64, message bufferedMessage, capacity int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ring, ok := b.chats[chatID]
+	if !ok {
+		ring = newMessageRing(capacity)
+		b.chats[chatID] = ring
+	}
+	ring.add(message)
+}
+
+// Сообщения чата новее since, от старых к новым
+func (b *chatBuffers) since(chatID int64, since time.Time) []bufferedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ring, ok := b.chats[chatID]
+	if !ok {
+		return nil
+	}
+	messages := ring.list()
+	for i, message := range messages {
+		if message.Time.After(since) {
+			return messages[i:]
+		}
+	}
+	return nil
+}
+
+// Удаляет буфер чата
+func (b *chatBuffers) clear(chatID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.chats, chatID)
+}
+
+// Удаляет сообщения пользователя из буферов всех чатов
+func (b *chatBuffers) forgetUser(userID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for chatID, ring := range b.chats {
+		b.chats[chatID] = ring.filter(func(message bufferedMessage) bool {
+			return message.UserID != userID
+		})
+	}
+}
+
+// Удаляет сообщения старше maxAge и опустевшие буферы
+func (b *chatBuffers) prune(now time.Time, maxAge time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := now.Add(-maxAge)
+	for chatID, ring := range b.chats {
+		ring = ring.filter(func(message bufferedMessage) bool {
+			return message.Time.After(cutoff)
+		})
+		if ring.next == 0 && !ring.full {
+			delete(b.chats, chatID)
+			continue
+		}
+		b.chats[chatID] = ring
+	}
+}
+
+// Раз в несколько минут забывает устаревшие сообщения
+func pruneChatBuffersPeriodically() {
+	for {
+		time.Sleep(5 * time.Minute)
+		if config.Summary.MaxAge > 0 {
+			chatBuffer.prune(time.Now(), config.Summary.MaxAge)
+		}
+	}
+}
+
+// Запретил ли пользователь сохранять свои сообщения для сводок
+func summaryOptedOut(userID int64) bool {
+	var optedOut bool
+	return db.get(summaryOptOutBucket, strconv.FormatInt(userID, 10), &optedOut) && optedOut
+}
+
+// Запоминает сообщение группового чата для будущих сводок, если они включены
+func bufferChatMessage(message *tgbotapi.Message) {
+	if config.Summary.MaxMessages <= 0 || message.From == nil || message.From.IsBot || message.IsCommand() {
+		return
+	}
+	text, _ := messageText(message)
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	if !getChatSettings(message.Chat.ID).SummaryEnabled || summaryOptedOut(message.From.ID) {
+		return
+	}
+	chatBuffer.add(message.Chat.ID, bufferedMessage{
+		Time:   message.Time(),
+		UserID: message.From.ID,
+		Name:   displayName(message.From),
+		Text:   text,
+	}, config.Summary.MaxMessages)
+}
+
+// Строки переписки для модели: [15:04] Имя: текст
+func summaryLines(messages []bufferedMessage) []string {
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", message.Time.Format("15:04"), message.Name, message.Text))
+	}
+	return lines
+}
+
+// Собирает строки во фрагменты не длиннее limit токенов.
+// Слишком длинная строка обрезается, чтобы поместиться во фрагмент целиком.
+func chunkLines(lines []string, limit int) []string {
+	var chunks []string
+	var current strings.Builder
+	tokens := 0
+	for _, line := range lines {
+		cost := heuristicTokens(line) + 1
+		if cost > limit {
+			line = truncateToTokens(line, limit-1)
+			cost = limit
+		}
+		if tokens+cost > limit && current.Len() > 0 {
+			chunks = append(chunks, current.String())
+			current.Reset()
+			tokens = 0
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		tokens += cost
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// Размер фрагмента истории: не больше лимита запроса за вычетом промпта
+func summaryChunkTokens() int {
+	limit := config.Summary.ChunkTokens
+	if available := config.GPT.MaxPromptTokens - estimateTokens(summaryFinalPrompt) - tokensPerReply - 64; config.GPT.MaxPromptTokens > 0 && limit > available {
+		limit = available
+	}
+	return limit
+}
+
+// Составляет сводку переписки. Длинная история делится на фрагменты,
+// каждый пересказывается отдельно, затем пересказы сводятся вместе.
+func summarizeMessages(ctx context.Context, userID, chatID int64, settings chatSettings, messages []bufferedMessage) (string, error) {
+	system := func(prompt string) string {
+		if instruction, ok := languageInstructions[settings.Language]; ok {
+			return prompt + "\n\n" + instruction
+		}
+		return prompt
+	}
+	ask := func(prompt, text string) (string, error) {
+		resp, err := getGPTResponse(ctx, userID, chatID, false, []llmMessage{{Role: roleUser, Content: text}}, system(prompt), nil, nil)
+		return resp.Content, err
+	}
+
+	limit := summaryChunkTokens()
+	parts := chunkLines(summaryLines(messages), limit)
+	for level := 0; len(parts) > 1 && level < maxSummaryLevels; level++ {
+		partials := make([]string, 0, len(parts))
+		for _, part := range parts {
+			partial, err := ask(summaryChunkPrompt, part)
+			if err != nil {
+				return "", err
+			}
+			partials = append(partials, partial)
+		}
+		parts = chunkLines(partials, limit)
+	}
+	text := strings.Join(parts, "\n")
+	if len(parts) > 1 {
+		text = truncateToTokens(text, limit)
+	}
+	return ask(summaryFinalPrompt, text)
+}
+
+// Разбирает аргумент /summary: число сообщений или период вроде 1h, 30m
+func parseSummaryRange(arg string) (count int, period time.Duration, ok bool) {
+	if arg == "" {
+		return config.Summary.DefaultCount, 0, true
+	}
+	if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+		return n, 0, true
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return 0, d, true
+	}
+	return 0, 0, false
+}
+
+// Период для заголовка сводки: 1h вместо 1h0m0s
+func formatPeriod(d time.Duration) string {
+	text := strings.TrimSuffix(d.String(), "0s")
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
+
+// Обработка команды /summary: сводка недавней переписки и управление буфером
+func handleSummaryCommand(ctx *commandContext) {
+	message := ctx.Message
+	chatID := message.Chat.ID
+	userID := message.From.ID
+	reply := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyToMessageID = message.MessageID
+		ctx.Bot.Send(msg)
+	}
+
+	arg := ""
+	if len(ctx.Args) > 0 {
+		arg = strings.ToLower(ctx.Args[0])
+	}
+	switch arg {
+	case "optout":
+		if err := db.put(summaryOptOutBucket, strconv.FormatInt(userID, 10), true); err != nil {
+			log.Printf("Ошибка при сохранении отказа от сводок: %v", err)
+		}
+		chatBuffer.forgetUser(userID)
+		reply("Ваши сообщения больше не сохраняются для сводок, уже сохраненные удалены.")
+		return
+	case "optin":
+		if err := db.remove(summaryOptOutBucket, strconv.FormatInt(userID, 10)); err != nil {
+			log.Printf("Ошибка при сохранении отказа от сводок: %v", err)
+		}
+		reply("Ваши сообщения снова попадают в сводки чатов, где они включены.")
+		return
+	case "clear":
+		if !isChatAdmin(ctx.Bot, message.Chat, userID) {
+			reply("Очистить историю для сводок могут только администраторы чата.")
+			return
+		}
+		chatBuffer.clear(chatID)
+		reply("История для сводок очищена.")
+		return
+	}
+
+	settings := getChatSettings(chatID)
+	if !settings.SummaryEnabled {
+		reply("Сводки в этом чате выключены. Администратор может включить их в /settings.")
+		return
+	}
+	count, period, ok := parseSummaryRange(arg)
+	if !ok {
+		reply("Использование: /summary [число сообщений | период, например 1h или 30m]")
+		return
+	}
+
+	var messages []bufferedMessage
+	var title string
+	if period > 0 {
+		messages = chatBuffer.since(chatID, time.Now().Add(-period))
+		title = "Сводка за " + formatPeriod(period)
+	} else {
+		messages = chatBuffer.since(chatID, time.Time{})
+		if len(messages) > count {
+			messages = messages[len(messages)-count:]
+		}
+		title = fmt.Sprintf("Сводка последних сообщений: %d", len(messages))
+	}
+	if len(messages) == 0 {
+		reply("Пока нечего пересказывать: с момента включения сводок в чате не было сообщений.")
+		return
+	}
+
+	if !checkRateLimit(ctx.Bot, message, gptRateLimits(userID, chatID, settings)...) {
+		return
+	}
+	if !checkQuota(ctx.Bot, chatID, userID) {
+		return
+	}
+
+	submitGPTJob(ctx.Bot, chatID, userID, message.MessageID, func(jobCtx context.Context) {
+		ctx.Bot.Send(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
+		summary, err := summarizeMessages(jobCtx, userID, chatID, settings, messages)
+		if err != nil {
+			log.Printf("Ошибка при составлении сводки чата %d: %v", chatID, err)
+			reply(gptErrorMessage(err))
+			return
+		}
+		// Сводка пересказывает чужие сообщения и проверяется как ответ модели
+		if err := moderateGPTText(jobCtx, chatID, message.From, settings, "answer", summary, nil); err != nil {
+			reply(moderationBlockedMessage("answer", err))
+			return
+		}
+		for _, chunk := range splitMarkdown("**"+title+"**\n\n"+summary, markdownChunkLimit) {
+			if _, err := sendMarkdownMessage(ctx.Bot, chatID, message.MessageID, chunk, nil); err != nil {
+				log.Printf("Ошибка при отправке сводки: %v", err)
+				break
+			}
+		}
+	})
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "summary",
+		Usage:       "[N | 1h | optout | optin | clear]",
+		Description: "Сводка недавней переписки чата",
+		Feature:     "gpt",
+		Handler:     handleSummaryCommand,
+	})
+}
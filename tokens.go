@@ -0,0 +1,195 @@
+// tokens.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Служебные токены формата чата: на каждое сообщение и на начало ответа
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// Меньше этого ответ не имеет смысла: запрос отклоняется
+const minCompletionTokens = 64
+
+// Предельная погрешность heuristicTokens относительно токенизатора cl100k
+// (но не меньше одного токена), проверенная в tokens_test.go. Токены вопроса
+// резервируются в квотах и бюджете с этим запасом.
+const tokenEstimateError = 0.25
+
+// Режимы обработки слишком длинного вопроса
+const (
+	oversizedReject   = "reject"
+	oversizedTruncate = "truncate"
+)
+
+// Разбиение текста на фрагменты как у токенизатора cl100k:
+// окончания слов, слова с ведущим пробелом, группы до трех цифр,
+// знаки препинания и пробелы. Каждый фрагмент кодируется отдельно.
+var tokenPieces = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// Вопрос не помещается в лимит запроса
+var errPromptTooLong = errors.New("вопрос слишком длинный")
+
+// Оценивает число токенов в тексте без обращения к API и без словаря BPE.
+// Это эвристика, а не токенизатор: текст делится на фрагменты как у cl100k,
+// а число токенов фрагмента оценивается по классам символов. Расхождение
+// с настоящим токенизатором — до tokenEstimateError в любую сторону.
+// Ответ, о расходе на который провайдер не сообщил, оценивается ею же.
+func heuristicTokens(text string) int {
+	tokens := 0
+	for _, piece := range tokenPieces.FindAllString(text, -1) {
+		tokens += heuristicPieceTokens(piece)
+	}
+	return tokens
+}
+
+// Оценивает число токенов одного фрагмента по тому, из каких символов он состоит
+func heuristicPieceTokens(piece string) int {
+	var letters, symbols, cyrillic, wide, other int
+	for i, r := range piece {
+		switch {
+		case i == 0 && r == ' ' && len(piece) > 1:
+			// Пробел перед словом входит в токен слова
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			letters++
+		case r < utf8.RuneSelf:
+			symbols++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			wide++
+		default:
+			// Эмодзи и редкие символы занимают несколько байтов, каждый может стать токеном
+			other += utf8.RuneLen(r)
+		}
+	}
+
+	// Частые английские слова — один токен, длинные делятся примерно по 4 символа;
+	// русские слова делятся мельче, примерно по 3 буквы
+	tokens := ceilDiv(symbols, 2) + ceilDiv(cyrillic*10, 27) + wide + ceilDiv(other, 2)
+	if letters > 7 {
+		tokens += ceilDiv(letters, 4)
+	} else if letters > 0 {
+		tokens++
+	}
+	if tokens == 0 {
+		tokens = 1
+	}
+	return tokens
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// Оценка токенов с запасом на погрешность эвристики: столько резервируется в квотах
+func withTokenMargin(tokens int) int {
+	return tokens + int(float64(tokens)*tokenEstimateError+0.5)
+}
+
+// Оценка токенов одного сообщения диалога вместе со служебными
+func estimateTokens(text string) int {
+	return heuristicTokens(text) + tokensPerMessage
+}
+
+// Оценка токенов всего запроса вместе с изображениями
+func estimatePromptTokens(messages []llmMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += estimateTokens(message.Content)
+		for _, image := range message.Images {
+			tokens += imageTokens(image)
+		}
+		tokens += toolCallTokens(message.ToolCalls)
+	}
+	return tokens
+}
+
+// Оценка токенов вызовов инструментов в ответе модели
+func toolCallTokens(calls []llmToolCall) int {
+	tokens := 0
+	for _, call := range calls {
+		tokens += heuristicTokens(call.Name) + heuristicTokens(call.Arguments) + tokensPerMessage
+	}
+	return tokens
+}
+
+// Оценка токенов описаний инструментов: они входят в запрос как часть промпта
+func estimateToolTokens(tools []llmTool) int {
+	tokens := 0
+	for _, tool := range tools {
+		tokens += heuristicTokens(tool.Name) + heuristicTokens(tool.Description) + heuristicTokens(string(tool.Parameters))
+	}
+	return tokens
+}
+
+// Подгоняет запрос под лимит: сначала отбрасывает старые сообщения истории,
+// затем, в режиме truncate, обрезает сам вопрос. Системный промпт и вопрос
+// (последнее сообщение пользователя) сохраняются всегда, как и вызовы
+// инструментов и их результаты после вопроса: без них API отклонит запрос.
+func fitPrompt(messages []llmMessage, limit int, mode string) ([]llmMessage, error) {
+	if limit <= 0 || estimatePromptTokens(messages) <= limit {
+		return messages, nil
+	}
+
+	first := 0
+	if len(messages) > 0 && messages[0].Role == roleSystem {
+		first = 1
+	}
+	question := len(messages) - 1
+	for i := len(messages) - 1; i >= first; i-- {
+		if messages[i].Role == roleUser {
+			question = i
+			break
+		}
+	}
+	for question > first && estimatePromptTokens(messages) > limit {
+		// Сообщение истории отбрасывается вместе с результатами вызванных им инструментов
+		drop := first + 1
+		for drop < question && messages[drop].Role == roleTool {
+			drop++
+		}
+		messages = append(messages[:first:first], messages[drop:]...)
+		question -= drop - first
+	}
+
+	tokens := estimatePromptTokens(messages)
+	if tokens <= limit {
+		return messages, nil
+	}
+	if mode != oversizedTruncate || question < 0 {
+		return nil, fmt.Errorf("%w: около %d токенов при лимите %d", errPromptTooLong, tokens, limit)
+	}
+
+	available := limit - (tokens - heuristicTokens(messages[question].Content))
+	if available < minCompletionTokens {
+		return nil, fmt.Errorf("%w: около %d токенов при лимите %d", errPromptTooLong, tokens, limit)
+	}
+	truncated := messages[question]
+	truncated.Content = truncateToTokens(truncated.Content, available)
+	fitted := append(messages[:question:question], truncated)
+	return append(fitted, messages[question+1:]...), nil
+}
+
+// Обрезает текст так, чтобы он занимал не больше limit токенов
+func truncateToTokens(text string, limit int) string {
+	tokens := 0
+	end := 0
+	for _, loc := range tokenPieces.FindAllStringIndex(text, -1) {
+		cost := heuristicPieceTokens(text[loc[0]:loc[1]])
+		if tokens+cost > limit {
+			break
+		}
+		tokens += cost
+		end = loc[1]
+	}
+	return text[:end]
+}
@@ -0,0 +1,177 @@
+// tokens_test.go
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Число токенов по токенизатору cl100k_base для примеров из руководства
+// OpenAI «How to count tokens with tiktoken» и простых фраз
+var knownTokenCounts = []struct {
+	text   string
+	tokens int
+}{
+	{"", 0},
+	{"hello world", 2},
+	{"Hello, world!", 4},
+	{"The quick brown fox jumps over the lazy dog.", 10},
+	{"1234567890", 4},
+	{"tiktoken is great!", 6},
+	{"antidisestablishmentarianism", 6},
+	{"2 + 2 = 4", 7},
+	{"お誕生日おめでとう", 9},
+}
+
+func TestCountTokensKnownCounts(t *testing.T) {
+	for _, tc := range knownTokenCounts {
+		got := heuristicTokens(tc.text)
+		// Оценка допускает расхождение на токен или на tokenEstimateError
+		tolerance := max(1, int(float64(tc.tokens)*tokenEstimateError))
+		if diff := got - tc.tokens; diff > tolerance || diff < -tolerance {
+			t.Errorf("heuristicTokens(%q) = %d, по токенизатору %d", tc.text, got, tc.tokens)
+		}
+	}
+}
+
+func TestCountTokensCyrillicNotUnderestimated(t *testing.T) {
+	// Русский текст в cl100k занимает примерно токен на 2–3 буквы;
+	// оценка ниже токена на 4 буквы означала бы превышение лимитов
+	text := strings.Repeat("Привет, как дела у тебя сегодня? ", 20)
+	letters := 0
+	for _, r := range text {
+		if r >= 'А' && r <= 'я' {
+			letters++
+		}
+	}
+	if got := heuristicTokens(text); got < letters/4 {
+		t.Errorf("heuristicTokens для русского текста = %d, ожидалось не меньше %d", got, letters/4)
+	}
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	messages := []llmMessage{
+		{Role: roleSystem, Content: "hello world"},
+		{Role: roleUser, Content: "Hello, world!"},
+	}
+	want := tokensPerReply + 2*tokensPerMessage + 2 + 4
+	if got := estimatePromptTokens(messages); got != want {
+		t.Errorf("estimatePromptTokens = %d, ожидалось %d", got, want)
+	}
+
+	messages = append(messages, llmMessage{Role: roleAssistant, ToolCalls: []llmToolCall{{ID: "1", Name: "get_stats", Arguments: "{}"}}})
+	if got := estimatePromptTokens(messages); got <= want+tokensPerMessage {
+		t.Errorf("вызовы инструментов не учтены: %d", got)
+	}
+}
+
+func TestTruncateToTokens(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog."
+	if got := truncateToTokens(text, 100); got != text {
+		t.Errorf("короткий текст изменен: %q", got)
+	}
+	got := truncateToTokens(text, 4)
+	if got != "The quick brown fox" {
+		t.Errorf("truncateToTokens(4) = %q", got)
+	}
+	if heuristicTokens(got) > 4 {
+		t.Errorf("обрезанный текст длиннее лимита: %d токенов", heuristicTokens(got))
+	}
+}
+
+// Роли сообщений для сравнения в тестах
+func messageRoles(messages []llmMessage) string {
+	roles := make([]string, len(messages))
+	for i, message := range messages {
+		roles[i] = message.Role
+	}
+	return strings.Join(roles, ",")
+}
+
+func TestFitPromptDropsOldHistory(t *testing.T) {
+	long := strings.Repeat("word ", 200)
+	messages := []llmMessage{
+		{Role: roleSystem, Content: "system"},
+		{Role: roleUser, Content: long},
+		{Role: roleAssistant, Content: long},
+		{Role: roleUser, Content: "question"},
+	}
+	fitted, err := fitPrompt(messages, 100, oversizedReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageRoles(fitted); got != "system,user" || fitted[1].Content != "question" {
+		t.Errorf("осталось %s: %+v", got, fitted)
+	}
+}
+
+func TestFitPromptKeepsToolRound(t *testing.T) {
+	long := strings.Repeat("word ", 200)
+	messages := []llmMessage{
+		{Role: roleSystem, Content: "system"},
+		{Role: roleUser, Content: long},
+		{Role: roleAssistant, ToolCalls: []llmToolCall{{ID: "old", Name: "get_stats", Arguments: "{}"}}},
+		{Role: roleTool, ToolCallID: "old", Content: long},
+		{Role: roleAssistant, Content: "answer"},
+		{Role: roleUser, Content: "question"},
+		{Role: roleAssistant, ToolCalls: []llmToolCall{{ID: "new", Name: "get_stats", Arguments: "{}"}}},
+		{Role: roleTool, ToolCallID: "new", Content: "result"},
+	}
+	fitted, err := fitPrompt(messages, 100, oversizedReject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Старый вызов ушел вместе со своим результатом, текущий раунд сохранился
+	if got := messageRoles(fitted); got != "system,assistant,user,assistant,tool" {
+		t.Errorf("осталось %s", got)
+	}
+	for i, message := range fitted {
+		if message.Role == roleTool && (i == 0 || len(fitted[i-1].ToolCalls) == 0) {
+			t.Errorf("результат инструмента %d без вызова: %s", i, messageRoles(fitted))
+		}
+	}
+}
+
+func TestFitPromptNeverLeavesOrphanToolResult(t *testing.T) {
+	long := strings.Repeat("word ", 200)
+	messages := []llmMessage{
+		{Role: roleSystem, Content: "system"},
+		{Role: roleUser, Content: "question"},
+		{Role: roleAssistant, ToolCalls: []llmToolCall{{ID: "1", Name: "get_history", Arguments: "{}"}}},
+		{Role: roleTool, ToolCallID: "1", Content: long},
+	}
+	_, err := fitPrompt(messages, 100, oversizedReject)
+	if !errors.Is(err, errPromptTooLong) {
+		t.Fatalf("ожидалась ошибка errPromptTooLong, получено %v", err)
+	}
+}
+
+func TestFitPromptTruncatesQuestion(t *testing.T) {
+	messages := []llmMessage{
+		{Role: roleSystem, Content: "system"},
+		{Role: roleUser, Content: strings.Repeat("word ", 500)},
+		{Role: roleAssistant, ToolCalls: []llmToolCall{{ID: "1", Name: "get_stats", Arguments: "{}"}}},
+		{Role: roleTool, ToolCallID: "1", Content: "result"},
+	}
+	fitted, err := fitPrompt(messages, 200, oversizedTruncate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageRoles(fitted); got != "system,user,assistant,tool" {
+		t.Fatalf("осталось %s", got)
+	}
+	if fitted[3].Content != "result" {
+		t.Errorf("обрезан результат инструмента вместо вопроса: %q", fitted[3].Content)
+	}
+	if len(fitted[1].Content) >= len(messages[1].Content) {
+		t.Errorf("вопрос не обрезан")
+	}
+	if tokens := estimatePromptTokens(fitted); tokens > 200 {
+		t.Errorf("запрос после обрезки %d токенов при лимите 200", tokens)
+	}
+	if messages[1].Content != strings.Repeat("word ", 500) {
+		t.Errorf("исходный запрос изменен")
+	}
+}
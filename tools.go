@@ -0,0 +1,398 @@
+// tools.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Предельный размер результата инструмента, который получает модель
+const maxToolResultTokens = 1000
+
+// Сколько участников турнирной таблицы показывать модели
+const maxToolStatsEntries = 20
+
+// Действия с играми от инструментов модели. Состояние игр меняет только
+// цикл обновлений, поэтому инструменты передают ему действия через этот канал.
+var gameActions = make(chan func())
+
+// Выполняет действие в цикле обновлений и ждет его завершения.
+// Без очереди запросов инструменты вызываются только из тестов,
+// и действие выполняется сразу.
+func runInUpdateLoop(ctx context.Context, action func()) error {
+	if gptRequests == nil {
+		action()
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case gameActions <- func() { action(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Вызов инструмента от имени автора вопроса
+type toolContext struct {
+	Ctx      context.Context
+	Bot      *tgbotapi.BotAPI
+	Message  *tgbotapi.Message // вопрос, ради которого модель вызвала инструмент
+	Settings chatSettings
+}
+
+// Инструмент бота для модели
+type botTool struct {
+	llmTool
+	// Доступен ли инструмент в чате с такими настройками
+	Available func(settings chatSettings) bool
+	// Выполняет вызов и возвращает результат для модели.
+	// Текст ошибки тоже передается модели, чтобы она объяснила ее пользователю.
+	Run func(tc *toolContext, args json.RawMessage) (string, error)
+}
+
+// Реестр инструментов в порядке регистрации
+var botTools []*botTool
+
+func registerTool(tool *botTool) {
+	botTools = append(botTools, tool)
+}
+
+// Инструменты, доступные модели в чате
+func availableTools(settings chatSettings) []*botTool {
+	if !config.Tools.Enabled || config.Tools.MaxRounds <= 0 {
+		return nil
+	}
+	var tools []*botTool
+	for _, tool := range botTools {
+		if tool.Available == nil || tool.Available(settings) {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+// Результат с ошибкой в формате, понятном модели
+func toolError(err error) string {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(data)
+}
+
+// Выполняет вызов инструмента и возвращает результат для модели
+func runTool(tc *toolContext, tools []*botTool, call llmToolCall) string {
+	var tool *botTool
+	for _, t := range tools {
+		if t.Name == call.Name {
+			tool = t
+			break
+		}
+	}
+	if tool == nil {
+		return toolError(fmt.Errorf("инструмент %q недоступен", call.Name))
+	}
+
+	args := json.RawMessage(call.Arguments)
+	if strings.TrimSpace(call.Arguments) == "" {
+		args = json.RawMessage("{}")
+	}
+	// Аргументы с именами участников в лог не попадают, они есть в журнале запросов
+	log.Printf("Модель вызвала %s для пользователя %d в чате %d", call.Name, tc.Message.From.ID, tc.Message.Chat.ID)
+	result, err := tool.Run(tc, args)
+	if err != nil {
+		return toolError(err)
+	}
+	return truncateToTokens(result, maxToolResultTokens)
+}
+
+// Запрашивает ответ модели, выполняя вызванные ею инструменты.
+// Результаты инструментов возвращаются модели, пока она не ответит текстом;
+// после config.Tools.MaxRounds раундов инструменты больше не предлагаются.
+// Если передан reply, ответ показывается в нем по мере генерации; текст
+// раунда, закончившегося вызовом инструментов, из него убирается.
+func answerWithTools(ctx context.Context, bot *tgbotapi.BotAPI, message *tgbotapi.Message, settings chatSettings, smart bool, messages []llmMessage, reply *streamingReply) (llmResponse, error) {
+	tc := &toolContext{Ctx: ctx, Bot: bot, Message: message, Settings: settings}
+	tools := availableTools(settings)
+	var onDelta func(delta string)
+	if reply != nil {
+		onDelta = reply.append
+	}
+	for round := 0; ; round++ {
+		var offered []llmTool
+		if round < config.Tools.MaxRounds {
+			for _, tool := range tools {
+				offered = append(offered, tool.llmTool)
+			}
+		}
+		resp, err := getGPTResponse(ctx, message.From.ID, message.Chat.ID, smart, messages, systemPrompt(settings), offered, onDelta)
+		// Вызовы без предложенных инструментов не выполняются: иначе сервер,
+		// который их все равно присылает, зациклил бы запросы
+		if err != nil || len(resp.ToolCalls) == 0 || len(offered) == 0 {
+			return resp, err
+		}
+		if reply != nil {
+			reply.reset()
+		}
+
+		messages = append(messages, llmMessage{Role: roleAssistant, Content: resp.Content, ToolCalls: resp.ToolCalls})
+		for _, call := range resp.ToolCalls {
+			messages = append(messages, llmMessage{Role: roleTool, ToolCallID: call.ID, Content: runTool(tc, tools, call)})
+		}
+		bot.Send(tgbotapi.NewChatAction(message.Chat.ID, tgbotapi.ChatTyping))
+	}
+}
+
+// Находит участника чата по @username или имени
+func resolveToolUser(bot *tgbotapi.BotAPI, chatID int64, name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if userID, ok := directory.resolveUsername(bot, chatID, name); ok {
+		return userID, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return 0, fmt.Errorf("пользователь %s не найден в чате", name)
+	}
+
+	found := directory.findByName(chatID, name)
+	switch len(found) {
+	case 0:
+		return 0, fmt.Errorf("участник %q не найден: бот знает только тех, кто уже писал в чат", name)
+	case 1:
+		return found[0], nil
+	}
+	var candidates []string
+	for _, userID := range found {
+		candidates = append(candidates, toolUserName(userID))
+	}
+	return 0, fmt.Errorf("имени %q подходят несколько участников: %s; уточните, кого именно", name, strings.Join(candidates, ", "))
+}
+
+// Имя пользователя для модели: имя и username, если он есть
+func toolUserName(userID int64) string {
+	identity, ok := directory.lookup(userID)
+	if !ok {
+		return fmt.Sprintf("пользователь %d", userID)
+	}
+	if identity.Username == "" {
+		return identity.DisplayName
+	}
+	return fmt.Sprintf("%s (@%s)", identity.DisplayName, identity.Username)
+}
+
+// Проверяет ограничение частоты игр автора вопроса
+func takeGameLimit(tc *toolContext) error {
+	result := limiter.take(time.Now(), gameRateLimits(tc.Message.From.ID, tc.Message.Chat.ID)...)
+	if !result.Allowed {
+		return errors.New(rateLimitMessage(result.Wait))
+	}
+	return nil
+}
+
+// get_stats: турнирная таблица, как в /stats
+func runStatsTool(tc *toolContext, args json.RawMessage) (string, error) {
+	type entry struct {
+		userID int64
+		stat   UserStat
+	}
+	var entries []entry
+	err := runInUpdateLoop(tc.Ctx, func() {
+		for userID, stat := range userStats {
+			entries = append(entries, entry{userID, *stat})
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stat.Wins > entries[j].stat.Wins
+	})
+	if len(entries) > maxToolStatsEntries {
+		entries = entries[:maxToolStatsEntries]
+	}
+
+	type row struct {
+		Place  int    `json:"place"`
+		Name   string `json:"name"`
+		Wins   int    `json:"wins"`
+		Losses int    `json:"losses"`
+	}
+	rows := []row{}
+	for i, e := range entries {
+		rows = append(rows, row{Place: i + 1, Name: toolUserName(e.userID), Wins: e.stat.Wins, Losses: e.stat.Losses})
+	}
+	data, err := json.Marshal(map[string]any{"leaderboard": rows})
+	return string(data), err
+}
+
+// get_history: последние сообщения чата из буфера сводок
+func runHistoryTool(tc *toolContext, args json.RawMessage) (string, error) {
+	var params struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("неверные аргументы: %v", err)
+	}
+	if params.Count <= 0 || params.Count > 100 {
+		params.Count = 30
+	}
+
+	messages := chatBuffer.since(tc.Message.Chat.ID, time.Time{})
+	if len(messages) == 0 {
+		return "В истории чата пока нет сообщений.", nil
+	}
+	lines := summaryLines(messages[max(len(messages)-params.Count, 0):])
+
+	// В предел результата берем самые свежие сообщения
+	tokens := 0
+	first := len(lines)
+	for first > 0 {
+		cost := heuristicTokens(lines[first-1]) + 1
+		if tokens+cost > maxToolResultTokens {
+			break
+		}
+		tokens += cost
+		first--
+	}
+	return strings.Join(lines[first:], "\n"), nil
+}
+
+// start_duel: вызов на дуэль от имени автора вопроса
+func runDuelTool(tc *toolContext, args json.RawMessage) (string, error) {
+	var params struct {
+		Opponent string `json:"opponent"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("неверные аргументы: %v", err)
+	}
+	chatID := tc.Message.Chat.ID
+	opponentID, err := resolveToolUser(tc.Bot, chatID, params.Opponent)
+	if err != nil {
+		return "", err
+	}
+	if err := takeGameLimit(tc); err != nil {
+		return "", err
+	}
+
+	var refusal string
+	err = runInUpdateLoop(tc.Ctx, func() {
+		refusal = challengeToDuel(tc.Bot, chatID, tc.Message.MessageID, tc.Message.From, opponentID)
+	})
+	if err != nil {
+		return "", err
+	}
+	if refusal != "" {
+		return "", errors.New(refusal)
+	}
+	return fmt.Sprintf("Вызов на дуэль отправлен в чат, %s должен принять его кнопкой.", toolUserName(opponentID)), nil
+}
+
+// start_roulette: русская рулетка автора вопроса с указанными участниками
+func runRouletteTool(tc *toolContext, args json.RawMessage) (string, error) {
+	var params struct {
+		Opponents []string `json:"opponents"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("неверные аргументы: %v", err)
+	}
+	chatID := tc.Message.Chat.ID
+	initiatorID := tc.Message.From.ID
+	participants := []int64{initiatorID}
+	for _, name := range params.Opponents {
+		userID, err := resolveToolUser(tc.Bot, chatID, name)
+		if err != nil {
+			return "", err
+		}
+		if userID == tc.Bot.Self.ID {
+			return "", errors.New("с ботом в русскую рулетку играть нельзя")
+		}
+		if !slices.Contains(participants, userID) {
+			participants = append(participants, userID)
+		}
+	}
+	if len(participants) < 2 {
+		return "", errors.New("для русской рулетки нужен хотя бы один соперник, кроме автора вопроса")
+	}
+	if err := takeGameLimit(tc); err != nil {
+		return "", err
+	}
+
+	// Игра привязана к сообщению с вопросом, как к сообщению с командой
+	messageID := tc.Message.MessageID
+	started := false
+	err := runInUpdateLoop(tc.Ctx, func() {
+		if _, busy := russianRouletteGames[messageID]; busy {
+			return
+		}
+		startRouletteGame(tc.Bot, chatID, messageID, participants)
+		started = true
+	})
+	if err != nil {
+		return "", err
+	}
+	if !started {
+		return "", errors.New("по этому вопросу рулетка уже идет")
+	}
+	var names []string
+	for _, userID := range participants {
+		names = append(names, toolUserName(userID))
+	}
+	return "Русская рулетка началась, участники: " + strings.Join(names, ", ") + ".", nil
+}
+
+func gamesAvailable(settings chatSettings) bool {
+	return settings.GamesEnabled
+}
+
+func init() {
+	registerTool(&botTool{
+		llmTool: llmTool{
+			Name:        "get_stats",
+			Description: "Турнирная таблица дуэлей и русской рулетки: победы и поражения игроков, лидер первым.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		},
+		Available: gamesAvailable,
+		Run:       runStatsTool,
+	})
+	registerTool(&botTool{
+		llmTool: llmTool{
+			Name:        "get_history",
+			Description: "Последние сообщения этого чата в формате [время] Имя: текст.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"count":{"type":"integer","description":"Сколько последних сообщений, от 1 до 100","minimum":1,"maximum":100}}}`),
+		},
+		Available: func(settings chatSettings) bool {
+			return settings.SummaryEnabled && config.Summary.MaxMessages > 0
+		},
+		Run: runHistoryTool,
+	})
+	registerTool(&botTool{
+		llmTool: llmTool{
+			Name:        "start_duel",
+			Description: "Вызвать участника чата на дуэль от имени автора вопроса. Соперник принимает вызов кнопкой.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"opponent":{"type":"string","description":"@username или имя участника чата"}},"required":["opponent"]}`),
+		},
+		Available: gamesAvailable,
+		Run:       runDuelTool,
+	})
+	registerTool(&botTool{
+		llmTool: llmTool{
+			Name:        "start_roulette",
+			Description: "Начать русскую рулетку автора вопроса с указанными участниками чата.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"opponents":{"type":"array","items":{"type":"string"},"description":"@username или имена участников чата, кроме автора вопроса"}},"required":["opponents"]}`),
+		},
+		Available: gamesAvailable,
+		Run:       runRouletteTool,
+	})
+}
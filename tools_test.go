@@ -0,0 +1,119 @@
+// tools_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Подменяет инструменты бота одним тестовым, который запоминает аргументы
+func useEchoTool(t *testing.T, maxRounds int) *[]string {
+	t.Helper()
+	saved := botTools
+	t.Cleanup(func() { botTools = saved })
+	config.Tools.Enabled = true
+	config.Tools.MaxRounds = maxRounds
+
+	var calls []string
+	botTools = nil
+	registerTool(&botTool{
+		llmTool: llmTool{Name: "echo", Description: "Повторяет текст", Parameters: json.RawMessage(`{"type":"object"}`)},
+		Run: func(tc *toolContext, args json.RawMessage) (string, error) {
+			calls = append(calls, string(args))
+			var parsed struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal(args, &parsed); err != nil {
+				return "", err
+			}
+			if parsed.Text == "" {
+				return "", errors.New("пустой текст")
+			}
+			return "эхо: " + parsed.Text, nil
+		},
+	})
+	return &calls
+}
+
+func toolTestMessage() *tgbotapi.Message {
+	return &tgbotapi.Message{MessageID: 5, From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 2}}
+}
+
+func TestAnswerWithToolsRunsTools(t *testing.T) {
+	mock := useMockProvider(t, "итог")
+	calls := useEchoTool(t, 3)
+	mock.script(mockReply{ToolCalls: []llmToolCall{
+		{ID: "call_1", Name: "echo", Arguments: `{"text":"привет"}`},
+		{ID: "call_2", Name: "echo", Arguments: ""},
+	}})
+
+	messages := []llmMessage{{Role: roleUser, Content: "вопрос"}}
+	resp, err := answerWithTools(context.Background(), newTestBot(t), toolTestMessage(), getChatSettings(2), false, messages, nil)
+	if err != nil || resp.Content != "итог" {
+		t.Fatalf("ответ %q, ошибка %v", resp.Content, err)
+	}
+	if len(*calls) != 2 || (*calls)[0] != `{"text":"привет"}` || (*calls)[1] != "{}" {
+		t.Errorf("инструмент вызван с аргументами %q", *calls)
+	}
+
+	second := mock.requests()[1].Messages
+	results := second[len(second)-2:]
+	if results[0].Role != roleTool || results[0].ToolCallID != "call_1" || results[0].Content != "эхо: привет" {
+		t.Errorf("результат первого вызова: %+v", results[0])
+	}
+	if results[1].ToolCallID != "call_2" || results[1].Content != toolError(errors.New("пустой текст")) {
+		t.Errorf("ошибка второго вызова не передана модели: %+v", results[1])
+	}
+}
+
+func TestAnswerWithToolsRoundLimit(t *testing.T) {
+	mock := useMockProvider(t)
+	calls := useEchoTool(t, 2)
+	call := mockReply{ToolCalls: []llmToolCall{{ID: "call", Name: "echo", Arguments: `{"text":"еще"}`}}}
+	mock.script(call, call, call, call)
+
+	messages := []llmMessage{{Role: roleUser, Content: "вопрос"}}
+	resp, err := answerWithTools(context.Background(), newTestBot(t), toolTestMessage(), getChatSettings(2), false, messages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := mock.requests()
+	if len(requests) != 3 {
+		t.Fatalf("запросов к модели %d вместо 3", len(requests))
+	}
+	if len(requests[1].Tools) == 0 || len(requests[2].Tools) != 0 {
+		t.Errorf("после двух раундов инструменты все еще предлагаются")
+	}
+	if len(*calls) != 2 || len(resp.ToolCalls) != 1 {
+		t.Errorf("выполнено %d вызовов, в ответе %d", len(*calls), len(resp.ToolCalls))
+	}
+}
+
+func TestAnswerWithToolsStreamsFinalRoundOnly(t *testing.T) {
+	mock := useMockProvider(t, "Лидирует Вася.")
+	useEchoTool(t, 3)
+	mock.script(mockReply{Content: "Сейчас посмотрю таблицу.", ToolCalls: []llmToolCall{{ID: "call", Name: "echo", Arguments: `{"text":"x"}`}}})
+
+	bot, telegram := newRecordingBot(t)
+	reply, err := startStreamingReply(bot, 2, 5, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []llmMessage{{Role: roleUser, Content: "кто лидирует?"}}
+	if _, err := answerWithTools(context.Background(), bot, toolTestMessage(), getChatSettings(2), false, messages, reply); err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.text.String(); got != "Лидирует Вася." {
+		t.Errorf("в сообщении накоплено %q", got)
+	}
+	if edits := telegram.called("editMessageText"); len(edits) != 0 {
+		// Правки реже interval не отправляются, а заглушка уже показана
+		t.Errorf("лишние правки сообщения: %+v", edits)
+	}
+}
@@ -0,0 +1,446 @@
+// usage.go
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Раздел хранилища со счетчиками токенов
+const usageBucket = "token_usage"
+
+// Сколько хранить счетчики прошедших периодов
+const (
+	dailyUsageRetention   = 31 * 24 * time.Hour
+	monthlyUsageRetention = 366 * 24 * time.Hour
+)
+
+// Форматы периодов в ключах счетчиков
+const (
+	dayPeriodLayout   = "2006-01-02"
+	monthPeriodLayout = "2006-01"
+)
+
+// Израсходованные токены за период. Картинки и расшифровка записей
+// считаются отдельно: они не тратят токены, но входят в расходы.
+type usageRecord struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Requests         int     `json:"requests"` // запросы к модели
+	Images           int     `json:"images,omitempty"`
+	AudioSeconds     int     `json:"audio_seconds,omitempty"`
+	CostUSD          float64 `json:"cost_usd,omitempty"`
+}
+
+func (r usageRecord) total() int {
+	return r.PromptTokens + r.CompletionTokens
+}
+
+// Квота токенов и ее текущее использование
+type usageQuota struct {
+	Scope    string // user, chat или global
+	Daily    bool   // дневная или месячная квота
+	Limit    int    // 0 — без ограничения
+	Used     usageRecord
+	Reserved int       // токены запросов, которые еще выполняются
+	Reset    time.Time // когда начнется следующий период
+	key      string
+}
+
+// Остаток квоты с учетом резерва; для квоты без ограничения — -1
+func (q usageQuota) remaining() int {
+	if q.Limit <= 0 {
+		return -1
+	}
+	if left := q.Limit - q.Used.total() - q.Reserved; left > 0 {
+		return left
+	}
+	return 0
+}
+
+func (q usageQuota) exceeded() bool {
+	return q.Limit > 0 && q.remaining() == 0
+}
+
+// Квота исчерпана или не вмещает запрос
+type quotaError struct {
+	Quota usageQuota
+}
+
+func (e *quotaError) Error() string {
+	return quotaExceededMessage(e.Quota)
+}
+
+// Токены, зарезервированные под выполняющийся запрос
+type usageReservation struct {
+	keys    []string
+	tokens  int
+	costUSD float64 // Оценка стоимости, зарезервированная в месячном бюджете
+}
+
+// Защищает чтение и обновление счетчиков
+var usageMutex sync.Mutex
+
+// Зарезервированные токены по ключам счетчиков; хранятся только в памяти
+var usageReserved = make(map[string]int)
+
+// Ключ счетчика: user:<id>:<период>, chat:<id>:<период> или global:<период>
+func usageKey(scope string, id int64, period string) string {
+	if scope == "global" {
+		return scope + ":" + period
+	}
+	return scope + ":" + strconv.FormatInt(id, 10) + ":" + period
+}
+
+// Текущие дневной и месячный периоды
+func usagePeriods(now time.Time) (day, month string) {
+	return now.Format(dayPeriodLayout), now.Format(monthPeriodLayout)
+}
+
+// Учитывает токены и стоимость запроса пользователя в чате
+func recordUsage(userID, chatID int64, usage llmUsage, cost float64) {
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		// Провайдер сообщил только общее число токенов
+		usage.CompletionTokens = usage.TotalTokens
+	}
+	addUsage(userID, chatID, cost, func(record *usageRecord) {
+		record.PromptTokens += usage.PromptTokens
+		record.CompletionTokens += usage.CompletionTokens
+		record.Requests++
+	})
+}
+
+// Учитывает сгенерированную картинку и ее стоимость
+func recordImageUsage(userID, chatID int64, cost float64) {
+	addUsage(userID, chatID, cost, func(record *usageRecord) {
+		record.Images++
+	})
+}
+
+// Учитывает расшифрованную запись и ее стоимость
+func recordSpeechUsage(userID, chatID int64, seconds int, cost float64) {
+	addUsage(userID, chatID, cost, func(record *usageRecord) {
+		record.AudioSeconds += seconds
+	})
+}
+
+// Обновляет счетчики пользователя, чата и бота за день и месяц
+func addUsage(userID, chatID int64, cost float64, update func(record *usageRecord)) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	day, month := usagePeriods(time.Now())
+	keys := []string{
+		usageKey("user", userID, day), usageKey("user", userID, month),
+		usageKey("chat", chatID, day), usageKey("chat", chatID, month),
+		usageKey("global", 0, day), usageKey("global", 0, month),
+	}
+	records := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		var record usageRecord
+		db.get(usageBucket, key, &record)
+		update(&record)
+		record.CostUSD += cost
+		records[key] = record
+	}
+	if err := db.putAll(usageBucket, records); err != nil {
+		log.Printf("Ошибка при сохранении расхода токенов: %v", err)
+		return
+	}
+	if cost > 0 {
+		dayCost := records[usageKey("global", 0, day)].(usageRecord).CostUSD
+		monthCost := records[usageKey("global", 0, month)].(usageRecord).CostUSD
+		checkBudgetAlerts(dayCost, monthCost)
+	}
+}
+
+// Возвращает квоты пользователя, чата и общую с текущим использованием
+func usageQuotas(userID, chatID int64) []usageQuota {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	return usageQuotasLocked(userID, chatID)
+}
+
+// То же, когда usageMutex уже захвачен
+func usageQuotasLocked(userID, chatID int64) []usageQuota {
+	now := time.Now()
+	day, month := usagePeriods(now)
+	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+
+	quotas := []usageQuota{
+		{Scope: "user", Daily: true, Limit: config.Quotas.UserDaily},
+		{Scope: "user", Limit: config.Quotas.UserMonthly},
+		{Scope: "chat", Daily: true, Limit: config.Quotas.ChatDaily},
+		{Scope: "chat", Limit: config.Quotas.ChatMonthly},
+		{Scope: "global", Daily: true, Limit: config.GPT.TokenUsageLimit},
+		{Scope: "global", Limit: config.Quotas.GlobalMonthly},
+	}
+
+	for i := range quotas {
+		q := &quotas[i]
+		id := userID
+		if q.Scope == "chat" {
+			id = chatID
+		}
+		period, reset := month, nextMonth
+		if q.Daily {
+			period, reset = day, nextDay
+		}
+		q.Reset = reset
+		q.key = usageKey(q.Scope, id, period)
+		q.Reserved = usageReserved[q.key]
+		db.get(usageBucket, q.key, &q.Used)
+	}
+	return quotas
+}
+
+// Резервирует токены запроса во всех квотах до получения ответа.
+// promptTokens — эвристическая оценка вопроса, поэтому резервируется она
+// с запасом withTokenMargin.
+// Если вопрос не помещается в остаток какой-либо квоты, возвращает quotaError.
+// Иначе возвращает, сколько токенов можно отдать на ответ, не выходя за квоты.
+// Проверка и резерв идут под одной блокировкой по свежим счетчикам, поэтому
+// параллельные запросы не могут вместе превысить квоту.
+// Так же резервируется и стоимость запроса к model в месячном бюджете:
+// если на полный ответ денег не хватает, ответ укорачивается.
+func reserveUsage(userID, chatID int64, model string, promptTokens, maxCompletion int) (*usageReservation, int, error) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	budgetLeft := budgetLeftLocked()
+	if budgetLeft == 0 {
+		return nil, 0, errBudgetExhausted
+	}
+
+	promptTokens = withTokenMargin(promptTokens)
+	quotas := usageQuotasLocked(userID, chatID)
+	completion := maxCompletion
+	for _, q := range quotas {
+		if q.Limit <= 0 {
+			continue
+		}
+		left := q.remaining() - promptTokens
+		if left < minCompletionTokens {
+			return nil, 0, &quotaError{Quota: q}
+		}
+		if left < completion {
+			completion = left
+		}
+	}
+	if price, ok := modelPrice(model); ok && budgetLeft > 0 {
+		left := budgetLeft - float64(promptTokens)*price[0]/1e6
+		if price[1] > 0 {
+			left = left * 1e6 / price[1]
+		}
+		if left < minCompletionTokens {
+			return nil, 0, errBudgetExhausted
+		}
+		if price[1] > 0 && left < float64(completion) {
+			completion = int(left)
+		}
+	}
+
+	reservation := &usageReservation{
+		tokens:  promptTokens + completion,
+		costUSD: requestCost(model, llmUsage{PromptTokens: promptTokens, CompletionTokens: completion}),
+	}
+	for _, q := range quotas {
+		reservation.keys = append(reservation.keys, q.key)
+		usageReserved[q.key] += reservation.tokens
+	}
+	budgetReserved += reservation.costUSD
+	return reservation, completion, nil
+}
+
+// Снимает резерв, например если запрос завершился ошибкой
+func (r *usageReservation) release() {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	for _, key := range r.keys {
+		if usageReserved[key] -= r.tokens; usageReserved[key] <= 0 {
+			delete(usageReserved, key)
+		}
+	}
+	releaseBudgetLocked(r.costUSD)
+}
+
+// Заменяет резерв фактическим расходом из ответа провайдера.
+// Расход записывается до снятия резерва, чтобы между ними он не пропал из проверок.
+func (r *usageReservation) commit(userID, chatID int64, usage llmUsage, cost float64) {
+	recordUsage(userID, chatID, usage, cost)
+	r.release()
+}
+
+// Возвращает первую исчерпанную квоту, если запрос делать нельзя
+func exceededQuota(userID, chatID int64) (usageQuota, bool) {
+	for _, q := range usageQuotas(userID, chatID) {
+		if q.exceeded() {
+			return q, true
+		}
+	}
+	return usageQuota{}, false
+}
+
+// Сообщение для пользователя об исчерпанной квоте
+func quotaExceededMessage(q usageQuota) string {
+	var who string
+	switch q.Scope {
+	case "user":
+		who = "Ваш"
+	case "chat":
+		who = "Общий для этого чата"
+	default:
+		who = "Общий"
+	}
+	period := "месячный"
+	if q.Daily {
+		period = "дневной"
+	}
+	if left := q.remaining(); left > 0 {
+		return fmt.Sprintf("%s %s лимит токенов почти исчерпан: осталось %d, на этот запрос не хватит. Он обновится через %s.",
+			who, period, left, formatUntil(time.Until(q.Reset)))
+	}
+	return fmt.Sprintf("%s %s лимит токенов исчерпан. Он обновится через %s.",
+		who, period, formatUntil(time.Until(q.Reset)))
+}
+
+// Проверяет квоты перед запросом к модели и сообщает пользователю,
+// если какая-то из них исчерпана
+func checkQuota(bot *tgbotapi.BotAPI, chatID, userID int64) bool {
+	if budgetExhausted() {
+		bot.Send(tgbotapi.NewMessage(chatID, gptErrorMessage(errBudgetExhausted)))
+		return false
+	}
+	q, exceeded := exceededQuota(userID, chatID)
+	if !exceeded {
+		return true
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, quotaExceededMessage(q)))
+	return false
+}
+
+// Округляет время до обновления квоты для показа пользователю
+func formatUntil(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d дн.", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%d ч %d мин", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%d мин", int(d.Minutes())+1)
+	}
+}
+
+// Длительность записей для /usage
+func formatAudioDuration(seconds int) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%d с", seconds)
+	}
+	return fmt.Sprintf("%d мин", (seconds+59)/60)
+}
+
+// Удаляет счетчики давно прошедших периодов
+func pruneUsage(now time.Time) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	var stale []string
+	for _, key := range db.keys(usageBucket) {
+		period := key[strings.LastIndex(key, ":")+1:]
+		if start, err := time.ParseInLocation(dayPeriodLayout, period, now.Location()); err == nil {
+			if now.Sub(start) > dailyUsageRetention {
+				stale = append(stale, key)
+			}
+		} else if start, err := time.ParseInLocation(monthPeriodLayout, period, now.Location()); err == nil {
+			if now.Sub(start) > monthlyUsageRetention {
+				stale = append(stale, key)
+			}
+		}
+	}
+	if err := db.remove(usageBucket, stale...); err != nil {
+		log.Printf("Ошибка при удалении старых счетчиков токенов: %v", err)
+	}
+}
+
+// Раз в сутки удаляет старые счетчики
+func pruneUsagePeriodically() {
+	for {
+		pruneUsage(time.Now())
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// Обработка команды /usage
+func handleUsageCommand(ctx *commandContext) {
+	chatID := ctx.Message.Chat.ID
+	userID := ctx.Message.From.ID
+
+	var response strings.Builder
+	lastScope := ""
+	for _, q := range usageQuotas(userID, chatID) {
+		if q.Scope == "chat" && ctx.Message.Chat.IsPrivate() {
+			// В личном чате квоты чата совпадают с квотами пользователя
+			continue
+		}
+		if q.Scope != lastScope {
+			switch q.Scope {
+			case "user":
+				response.WriteString("<b>Ваш расход токенов</b>\n")
+			case "chat":
+				response.WriteString("\n<b>Расход в этом чате</b>\n")
+			default:
+				response.WriteString("\n<b>Общий расход бота</b>\n")
+			}
+			lastScope = q.Scope
+		}
+		period := "За месяц"
+		if q.Daily {
+			period = "Сегодня"
+		}
+		response.WriteString(fmt.Sprintf("%s: %d (запрос %d, ответ %d)", period,
+			q.Used.total(), q.Used.PromptTokens, q.Used.CompletionTokens))
+		if q.Limit > 0 {
+			response.WriteString(fmt.Sprintf(", осталось %d из %d", q.remaining(), q.Limit))
+		}
+		if q.Reserved > 0 {
+			response.WriteString(fmt.Sprintf(", в работе %d", q.Reserved))
+		}
+		if q.Used.AudioSeconds > 0 {
+			response.WriteString(fmt.Sprintf(", расшифровано %s записей", formatAudioDuration(q.Used.AudioSeconds)))
+		}
+		response.WriteString("\n")
+	}
+	if imageGenerator != nil && config.Images.Enabled {
+		var drawn int
+		db.get(usageBucket, imageQuotaKey(userID), &drawn)
+		response.WriteString(fmt.Sprintf("\nВаши картинки сегодня: %d", drawn))
+		if limit := config.Images.UserDaily; limit > 0 {
+			response.WriteString(fmt.Sprintf(" из %d", limit))
+		}
+		response.WriteString("\n")
+	}
+	if config.Bot.OwnerID != 0 && userID == config.Bot.OwnerID {
+		// Расходы в долларах видит только владелец бота
+		response.WriteString("\n" + budgetSummary() + "\n")
+	}
+	ctx.Bot.Send(newHTMLMessage(chatID, response.String()))
+}
+
+func init() {
+	commands.register(&botCommand{
+		Name:        "usage",
+		Description: "Расход токенов и оставшиеся лимиты",
+		Feature:     "gpt",
+		Handler:     handleUsageCommand,
+	})
+}
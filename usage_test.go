@@ -0,0 +1,192 @@
+// usage_test.go
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Счетчик пользователя за сегодня
+func todayUsage(userID int64) usageRecord {
+	day, _ := usagePeriods(time.Now())
+	var record usageRecord
+	db.get(usageBucket, usageKey("user", userID, day), &record)
+	return record
+}
+
+func TestRecordUsageCountersAreSeparate(t *testing.T) {
+	useMemoryStore(t)
+	recordUsage(1, 2, llmUsage{PromptTokens: 10, CompletionTokens: 5}, 0.01)
+	recordImageUsage(1, 2, 0.04)
+	recordSpeechUsage(1, 2, 90, 0.009)
+
+	record := todayUsage(1)
+	if record.Requests != 1 {
+		t.Errorf("запросов к модели %d вместо 1", record.Requests)
+	}
+	if record.total() != 15 {
+		t.Errorf("токенов %d вместо 15", record.total())
+	}
+	if record.Images != 1 || record.AudioSeconds != 90 {
+		t.Errorf("картинок %d, секунд записи %d", record.Images, record.AudioSeconds)
+	}
+	if cost := record.CostUSD; cost < 0.0589 || cost > 0.0591 {
+		t.Errorf("расходы %.4f вместо 0.059", cost)
+	}
+}
+
+func TestRecordUsageTotalTokensOnly(t *testing.T) {
+	useMemoryStore(t)
+	recordUsage(3, 4, llmUsage{TotalTokens: 42}, 0)
+	if record := todayUsage(3); record.CompletionTokens != 42 || record.Requests != 1 {
+		t.Errorf("счетчик %+v", record)
+	}
+}
+
+// Подменяет квоты на время теста
+func useQuotas(t *testing.T, userDaily int) {
+	t.Helper()
+	useMemoryStore(t)
+	saved := *config
+	t.Cleanup(func() { *config = saved })
+	*config = *defaultConfig()
+	config.Quotas.UserDaily = userDaily
+	config.GPT.TokenUsageLimit = 0
+}
+
+func TestReserveUsageConcurrent(t *testing.T) {
+	useQuotas(t, 1000)
+
+	var mu sync.Mutex
+	var reservations []*usageReservation
+	reserved := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, completion, err := reserveUsage(1, 2, config.GPT.Model, 100, 100)
+			if err != nil {
+				var quotaErr *quotaError
+				if !errors.As(err, &quotaErr) {
+					t.Errorf("неожиданная ошибка: %v", err)
+				}
+				return
+			}
+			mu.Lock()
+			reservations = append(reservations, reservation)
+			reserved += withTokenMargin(100) + completion
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if reserved > 1000 {
+		t.Errorf("параллельные запросы зарезервировали %d токенов при квоте 1000", reserved)
+	}
+	if len(reservations) == 0 {
+		t.Fatal("ни один запрос не получил резерв")
+	}
+	for _, reservation := range reservations {
+		reservation.release()
+	}
+	if len(usageReserved) != 0 {
+		t.Errorf("резерв не снят: %v", usageReserved)
+	}
+}
+
+func TestReserveUsageSeesRecordedUsage(t *testing.T) {
+	useQuotas(t, 1000)
+	recordUsage(1, 2, llmUsage{PromptTokens: 700, CompletionTokens: 50}, 0)
+
+	if _, _, err := reserveUsage(1, 2, config.GPT.Model, 200, 100); err == nil {
+		t.Errorf("резерв выдан сверх квоты после записанного расхода")
+	}
+	reservation, completion, err := reserveUsage(1, 2, config.GPT.Model, 100, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reservation.release()
+	// Вопрос резервируется с запасом на погрешность оценки: 125 токенов вместо 100
+	if completion != 125 {
+		t.Errorf("на ответ отдано %d токенов вместо 125", completion)
+	}
+}
+
+// Месячный бюджет $10 и модель по $0.01 за токен
+func useBudget(t *testing.T) {
+	t.Helper()
+	useQuotas(t, 0)
+	config.Budget.MonthlyCap = 10
+	config.Pricing = map[string][]float64{"test-model": {1e4, 1e4}}
+}
+
+func TestReserveUsageBudgetConcurrent(t *testing.T) {
+	useBudget(t)
+
+	var mu sync.Mutex
+	var reservations []*usageReservation
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Вопрос с запасом и ответ стоят ровно $2: бюджета хватает на пять
+			reservation, _, err := reserveUsage(1, 2, "test-model", 100, 75)
+			if err != nil {
+				if !errors.Is(err, errBudgetExhausted) {
+					t.Errorf("неожиданная ошибка: %v", err)
+				}
+				return
+			}
+			mu.Lock()
+			reservations = append(reservations, reservation)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if budgetReserved > 10+1e-9 {
+		t.Errorf("параллельные запросы зарезервировали $%.2f при бюджете $10", budgetReserved)
+	}
+	if len(reservations) == 0 {
+		t.Fatal("ни один запрос не получил резерв")
+	}
+	if _, _, err := reserveUsage(1, 2, "test-model", 1, 100); !errors.Is(err, errBudgetExhausted) {
+		t.Errorf("бюджет занят резервом, но запрос принят: %v", err)
+	}
+	for _, reservation := range reservations {
+		reservation.release()
+	}
+	if budgetReserved != 0 {
+		t.Errorf("резерв бюджета не снят: $%f", budgetReserved)
+	}
+}
+
+func TestReserveUsageBudgetLimitsCompletion(t *testing.T) {
+	useBudget(t)
+	recordUsage(1, 2, llmUsage{PromptTokens: 1}, 7)
+
+	// Осталось $3: $1.25 уходит на вопрос с запасом, на ответ хватает 175 токенов
+	reservation, completion, err := reserveUsage(1, 2, "test-model", 100, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completion != 175 {
+		t.Errorf("на ответ отдано %d токенов вместо 175", completion)
+	}
+	if _, _, err := reserveUsage(1, 2, "test-model", 10, 100); !errors.Is(err, errBudgetExhausted) {
+		t.Errorf("ошибка %v вместо errBudgetExhausted", err)
+	}
+	if reserveBudget(0.5) {
+		t.Errorf("картинка зарезервирована сверх бюджета")
+	}
+	reservation.release()
+	if !reserveBudget(0.5) {
+		t.Errorf("после снятия резерва бюджета должно хватать")
+	}
+	releaseBudget(0.5)
+}
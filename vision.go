@@ -0,0 +1,148 @@
+// vision.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Вопрос по умолчанию, если к фото нет подписи
+const defaultImageQuestion = "Что на этом изображении?"
+
+// Файл больше допустимого размера
+var errFileTooLarge = errors.New("файл слишком большой")
+
+// Текст сообщения и его разметка: у фото и документов это подпись
+func messageText(message *tgbotapi.Message) (string, []tgbotapi.MessageEntity) {
+	if message.Text == "" && message.Caption != "" {
+		return message.Caption, message.CaptionEntities
+	}
+	return message.Text, message.Entities
+}
+
+// Фото, о котором спрашивают: из самого сообщения или из сообщения, на которое ответили
+func questionPhoto(message *tgbotapi.Message) []tgbotapi.PhotoSize {
+	if len(message.Photo) > 0 {
+		return message.Photo
+	}
+	if reply := message.ReplyToMessage; reply != nil && len(reply.Photo) > 0 {
+		return reply.Photo
+	}
+	return nil
+}
+
+// Выбирает самый крупный размер фото, который укладывается в лимит.
+// Telegram присылает размеры по возрастанию.
+func largestPhoto(sizes []tgbotapi.PhotoSize, maxBytes int) (tgbotapi.PhotoSize, bool) {
+	for i := len(sizes) - 1; i >= 0; i-- {
+		if maxBytes <= 0 || sizes[i].FileSize <= maxBytes {
+			return sizes[i], true
+		}
+	}
+	return tgbotapi.PhotoSize{}, false
+}
+
+// Скачивает файл из Telegram, прерывая загрузку при превышении maxBytes
+func downloadTelegramFile(ctx context.Context, bot *tgbotapi.BotAPI, fileID string, maxBytes int) ([]byte, error) {
+	url, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("не удалось скачать файл: статус %d", resp.StatusCode)
+	}
+
+	reader := io.Reader(resp.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(resp.Body, int64(maxBytes)+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && len(data) > maxBytes {
+		return nil, errFileTooLarge
+	}
+	return data, nil
+}
+
+// Скачивает фото вопроса для модели. Возвращает nil, если фото нет.
+func loadQuestionImage(ctx context.Context, bot *tgbotapi.BotAPI, message *tgbotapi.Message) (*llmImage, error) {
+	sizes := questionPhoto(message)
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+	photo, ok := largestPhoto(sizes, config.Vision.MaxImageBytes)
+	if !ok {
+		return nil, errFileTooLarge
+	}
+	data, err := downloadTelegramFile(ctx, bot, photo.FileID, config.Vision.MaxImageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &llmImage{
+		MIMEType: http.DetectContentType(data),
+		Data:     data,
+		Width:    photo.Width,
+		Height:   photo.Height,
+		Detail:   config.Vision.Detail,
+	}, nil
+}
+
+// Оценивает токены изображения по правилам OpenAI: в режиме low — 85,
+// иначе картинка вписывается в 2048×2048, короткая сторона уменьшается
+// до 768, и каждый квадрат 512×512 стоит 170 токенов
+func imageTokens(image llmImage) int {
+	const base, perTile = 85, 170
+	width, height := float64(image.Width), float64(image.Height)
+	if image.Detail == "low" || width <= 0 || height <= 0 {
+		return base
+	}
+	if longest := max(width, height); longest > 2048 {
+		width, height = width*2048/longest, height*2048/longest
+	}
+	if shortest := min(width, height); shortest > 768 {
+		width, height = width*768/shortest, height*768/shortest
+	}
+	tiles := ceilDiv(int(width), 512) * ceilDiv(int(height), 512)
+	return base + perTile*tiles
+}
+
+// Есть ли в запросе изображения
+func hasImages(messages []llmMessage) bool {
+	for _, message := range messages {
+		if len(message.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Текст ошибки загрузки фото для пользователя
+func imageErrorMessage(err error) string {
+	if errors.Is(err, errFileTooLarge) {
+		return fmt.Sprintf("Фото слишком большое: не больше %d КБ.", config.Vision.MaxImageBytes>>10)
+	}
+	return "Не удалось загрузить фото."
+}
+
+// Помечает в истории вопрос, заданный к фото
+func imageQuestionText(query string) string {
+	return strings.TrimSpace("[фото] " + query)
+}